@@ -0,0 +1,213 @@
+package dbdrive
+
+import (
+	"context"
+	"database/sql"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
+)
+
+// Backfill job status
+const (
+	BackfillRunning   = "running"
+	BackfillDone      = "done"
+	BackfillFailed    = "failed"
+	BackfillCancelled = "cancelled"
+)
+
+// BackfillJob is a historical backfill of the blocks in [FromBlock, ToBlock], processed in
+// chunks of ChunkSize blocks. The completed chunks are checkpointed so that a running job
+// resumes where it stopped after a restart. A job with an Address only stores the logs of
+// that contract, restricted to the topic0s in Topics when it is not empty.
+type BackfillJob struct {
+	ID        int64     `bson:"_id"`
+	ChainID   int64     `bson:"chain_id"`
+	FromBlock int64     `bson:"from_block"`
+	ToBlock   int64     `bson:"to_block"`
+	ChunkSize int64     `bson:"chunk_size"`
+	Address   string    `bson:"address"`
+	Topics    []string  `bson:"topics"`
+	Status    string    `bson:"status"`
+	Error     string    `bson:"error"`
+	CreatedAt time.Time `bson:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+type mongoBackfillChunk struct {
+	JobID     int64 `bson:"job_id"`
+	FromBlock int64 `bson:"from_block"`
+}
+
+// CreateBackfillJob 保存新的回填任务并生成ID
+func (s *mysqlStore) CreateBackfillJob(job *BackfillJob) error {
+	job.ID, job.ChainID = getSnowflakeId(), s.chainID
+	job.CreatedAt = time.Now().UTC()
+	job.UpdatedAt = job.CreatedAt
+	_, err := s.db.Exec("INSERT INTO `backfill_job`(`id`,`chain_id`,`from_block`,`to_block`,`chunk_size`,`address`,`topics`,`status`,`error`,`created_at`,`updated_at`) values (?,?,?,?,?,?,?,?,?,?,?)",
+		job.ID, job.ChainID, job.FromBlock, job.ToBlock, job.ChunkSize, job.Address, strings.Join(job.Topics, ","), job.Status, job.Error,
+		job.CreatedAt.Format(mysqlTimeLayout), job.UpdatedAt.Format(mysqlTimeLayout))
+	return wrapErr(err)
+}
+
+// UpdateBackfillJob 更新回填任务的状态
+func (s *mysqlStore) UpdateBackfillJob(job BackfillJob) error {
+	_, err := s.db.Exec("UPDATE `backfill_job` SET `status` = ?, `error` = ?, `updated_at` = ? WHERE `chain_id` = ? AND `id` = ?",
+		job.Status, job.Error, time.Now().UTC().Format(mysqlTimeLayout), s.chainID, job.ID)
+	return wrapErr(err)
+}
+
+const backfillJobColumns = "`id`,`chain_id`,`from_block`,`to_block`,`chunk_size`,`address`,`topics`,`status`,`error`,`created_at`,`updated_at`"
+
+func scanBackfillJob(scan func(dest ...interface{}) error) (BackfillJob, error) {
+	var job BackfillJob
+	var topics string
+	var createdAt, updatedAt mysqlTime
+	err := scan(&job.ID, &job.ChainID, &job.FromBlock, &job.ToBlock, &job.ChunkSize, &job.Address, &topics, &job.Status, &job.Error, &createdAt, &updatedAt)
+	if topics != "" {
+		job.Topics = strings.Split(topics, ",")
+	}
+	job.CreatedAt, job.UpdatedAt = createdAt.Time, updatedAt.Time
+	return job, err
+}
+
+// GetBackfillJob 获取回填任务，不存在时返回nil
+func (s *mysqlStore) GetBackfillJob(id int64) (*BackfillJob, error) {
+	row := s.db.QueryRow("SELECT "+backfillJobColumns+" FROM `backfill_job` WHERE `chain_id` = ? AND `id` = ?", s.chainID, id)
+	job, err := scanBackfillJob(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	return &job, nil
+}
+
+// GetBackfillJobs 获取指定状态的回填任务
+func (s *mysqlStore) GetBackfillJobs(status string) ([]BackfillJob, error) {
+	rows, err := s.db.Query("SELECT "+backfillJobColumns+" FROM `backfill_job` WHERE `chain_id` = ? AND `status` = ? order by id", s.chainID, status)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer rows.Close()
+
+	var jobs []BackfillJob
+	for rows.Next() {
+		job, err := scanBackfillJob(rows.Scan)
+		if err != nil {
+			return nil, invalidData(err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, wrapErr(rows.Err())
+}
+
+// SaveBackfillChunk 记录已完成的分段
+func (s *mysqlStore) SaveBackfillChunk(jobID, fromBlock int64) error {
+	_, err := s.db.Exec("INSERT IGNORE INTO `backfill_chunk`(`job_id`,`from_block`) values (?,?)", jobID, fromBlock)
+	return wrapErr(err)
+}
+
+// GetBackfillChunks 获取已完成分段的起始区块
+func (s *mysqlStore) GetBackfillChunks(jobID int64) ([]int64, error) {
+	rows, err := s.db.Query("SELECT `from_block` FROM `backfill_chunk` WHERE `job_id` = ? order by from_block", jobID)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer rows.Close()
+
+	var chunks []int64
+	for rows.Next() {
+		var from int64
+		if err := rows.Scan(&from); err != nil {
+			return nil, invalidData(err)
+		}
+		chunks = append(chunks, from)
+	}
+	return chunks, wrapErr(rows.Err())
+}
+
+// CreateBackfillJob 保存新的回填任务并生成ID
+func (s *mongoStore) CreateBackfillJob(job *BackfillJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	job.ID, job.ChainID = getSnowflakeId(), s.chainID
+	job.CreatedAt = time.Now().UTC()
+	job.UpdatedAt = job.CreatedAt
+	_, err := s.jobs.InsertOne(ctx, job)
+	return wrapErr(err)
+}
+
+// UpdateBackfillJob 更新回填任务的状态
+func (s *mongoStore) UpdateBackfillJob(job BackfillJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := s.jobs.UpdateOne(ctx, bson.M{"_id": job.ID, "chain_id": s.chainID},
+		bson.M{"$set": bson.M{"status": job.Status, "error": job.Error, "updated_at": time.Now().UTC()}})
+	return wrapErr(err)
+}
+
+// GetBackfillJob 获取回填任务，不存在时返回nil
+func (s *mongoStore) GetBackfillJob(id int64) (*BackfillJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	var job BackfillJob
+	err := s.jobs.FindOne(ctx, bson.M{"_id": id, "chain_id": s.chainID}).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	return &job, nil
+}
+
+// GetBackfillJobs 获取指定状态的回填任务
+func (s *mongoStore) GetBackfillJobs(status string) ([]BackfillJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	cursor, err := s.jobs.Find(ctx, bson.M{"chain_id": s.chainID, "status": status}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer cursor.Close(ctx)
+
+	var jobs []BackfillJob
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, wrapErr(err)
+	}
+	return jobs, nil
+}
+
+// SaveBackfillChunk 记录已完成的分段
+func (s *mongoStore) SaveBackfillChunk(jobID, fromBlock int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	chunk := mongoBackfillChunk{JobID: jobID, FromBlock: fromBlock}
+	_, err := s.chunks.ReplaceOne(ctx, chunk, chunk, options.Replace().SetUpsert(true))
+	return wrapErr(err)
+}
+
+// GetBackfillChunks 获取已完成分段的起始区块
+func (s *mongoStore) GetBackfillChunks(jobID int64) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	cursor, err := s.chunks.Find(ctx, bson.M{"job_id": jobID}, options.Find().SetSort(bson.D{{Key: "from_block", Value: 1}}))
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer cursor.Close(ctx)
+
+	var chunks []int64
+	for cursor.Next(ctx) {
+		var doc mongoBackfillChunk
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, invalidData(err)
+		}
+		chunks = append(chunks, doc.FromBlock)
+	}
+	return chunks, wrapErr(cursor.Err())
+}
@@ -0,0 +1,196 @@
+package dbdrive
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+)
+
+const (
+	// BloomBitsSectionSize is the number of blocks in a bloombits section
+	BloomBitsSectionSize = 4096
+
+	// bloomBitsBatch is the number of bit vectors written by a single INSERT
+	bloomBitsBatch = 256
+)
+
+// bloomBitsSection returns the section containing the block
+func bloomBitsSection(blockNumber int64) int64 {
+	return blockNumber / BloomBitsSectionSize
+}
+
+// bloomSections returns the distinct sections containing the blocks
+func bloomSections(blooms []BlockBloom) []int64 {
+	var sections []int64
+	seen := make(map[int64]bool)
+	for _, bloom := range blooms {
+		if section := bloomBitsSection(bloom.BlockNumber); !seen[section] {
+			seen[section] = true
+			sections = append(sections, section)
+		}
+	}
+	return sections
+}
+
+// GetBloomBitsSections 获取[from, to]区间内已建立索引的section，按顺序返回。每个section保存全部bit位，只需查询bit 0
+func (s *mysqlStore) GetBloomBitsSections(from, to int64) ([]int64, error) {
+	rows, err := s.db.Query("SELECT section FROM bloom_bits WHERE chain_id = ? AND section >= ? AND section <= ? AND bit = 0 order by section",
+		s.chainID, from, to)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer rows.Close()
+
+	var sections []int64
+	for rows.Next() {
+		var section int64
+		if err := rows.Scan(&section); err != nil {
+			return nil, invalidData(err)
+		}
+		sections = append(sections, section)
+	}
+	return sections, wrapErr(rows.Err())
+}
+
+// DeleteBloomBits 删除[from, to]区间内section的索引，之后由索引任务重新建立
+func (s *mysqlStore) DeleteBloomBits(from, to int64) error {
+	_, err := s.db.Exec("DELETE FROM `bloom_bits` WHERE `chain_id` = ? AND `section` >= ? AND `section` <= ?", s.chainID, from, to)
+	return wrapErr(err)
+}
+
+// SaveBloomBits 保存section的压缩位向量，bits按bloom的bit位索引
+func (s *mysqlStore) SaveBloomBits(section int64, bits [][]byte) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return wrapErr(err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec("DELETE FROM `bloom_bits` WHERE `chain_id` = ? AND `section` = ?", s.chainID, section); err != nil {
+		return wrapErr(err)
+	}
+	for begin := 0; begin < len(bits); begin += bloomBitsBatch {
+		end := begin + bloomBitsBatch
+		if end > len(bits) {
+			end = len(bits)
+		}
+		values := make([]string, 0, end-begin)
+		args := make([]interface{}, 0, 4*(end-begin))
+		for bit := begin; bit < end; bit++ {
+			values = append(values, "(?,?,?,?)")
+			args = append(args, s.chainID, section, bit, bits[bit])
+		}
+		if _, err = tx.Exec("INSERT INTO `bloom_bits`(`chain_id`,`section`,`bit`,`bits`) values "+strings.Join(values, ","), args...); err != nil {
+			return wrapErr(err)
+		}
+	}
+	return wrapErr(tx.Commit())
+}
+
+// GetBloomBits 获取section中指定bit位的压缩位向量
+func (s *mysqlStore) GetBloomBits(section int64, bits []uint) (map[uint][]byte, error) {
+	if len(bits) == 0 {
+		return map[uint][]byte{}, nil
+	}
+	args := []interface{}{s.chainID, section}
+	for _, bit := range bits {
+		args = append(args, bit)
+	}
+	rows, err := s.db.Query("SELECT bit,bits FROM bloom_bits WHERE chain_id = ? AND section = ? AND bit IN ("+placeholders(len(bits))+")", args...)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer rows.Close()
+
+	vectors := make(map[uint][]byte, len(bits))
+	for rows.Next() {
+		var bit uint
+		var vector []byte
+		if err := rows.Scan(&bit, &vector); err != nil {
+			return nil, invalidData(err)
+		}
+		vectors[bit] = vector
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(err)
+	}
+	if len(vectors) == 0 && len(bits) > 0 {
+		return nil, notFound("bloombits section %d is not indexed", section)
+	}
+	if len(vectors) != len(bits) {
+		return nil, invalidData(errors.Errorf("bloombits section %d is incomplete", section))
+	}
+	return vectors, nil
+}
+
+// GetBloomBitsSections 获取[from, to]区间内已建立索引的section，按顺序返回
+func (s *mongoStore) GetBloomBitsSections(from, to int64) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	filter := bson.M{"chain_id": s.chainID, "section": bson.M{"$gte": from, "$lte": to}}
+	opts := options.Find().SetSort(bson.D{{Key: "section", Value: 1}}).SetProjection(bson.M{"section": 1})
+	cursor, err := s.bits.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer cursor.Close(ctx)
+
+	var sections []int64
+	for cursor.Next(ctx) {
+		var doc mongoBloomBits
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, invalidData(err)
+		}
+		sections = append(sections, doc.Section)
+	}
+	return sections, wrapErr(cursor.Err())
+}
+
+// DeleteBloomBits 删除[from, to]区间内section的索引
+func (s *mongoStore) DeleteBloomBits(from, to int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := s.bits.DeleteMany(ctx, bson.M{"chain_id": s.chainID, "section": bson.M{"$gte": from, "$lte": to}})
+	return wrapErr(err)
+}
+
+// SaveBloomBits 保存section的压缩位向量
+func (s *mongoStore) SaveBloomBits(section int64, bits [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	filter := bson.M{"chain_id": s.chainID, "section": section}
+	_, err := s.bits.ReplaceOne(ctx, filter, mongoBloomBits{ChainID: s.chainID, Section: section, Bits: bits},
+		options.Replace().SetUpsert(true))
+	return wrapErr(err)
+}
+
+// GetBloomBits 获取section中指定bit位的压缩位向量
+func (s *mongoStore) GetBloomBits(section int64, bits []uint) (map[uint][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	var doc mongoBloomBits
+	err := s.bits.FindOne(ctx, bson.M{"chain_id": s.chainID, "section": section}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, notFound("bloombits section %d is not indexed", section)
+	}
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	vectors := make(map[uint][]byte, len(bits))
+	for _, bit := range bits {
+		if int(bit) >= len(doc.Bits) {
+			return nil, invalidData(errors.Errorf("bloombits section %d is incomplete", section))
+		}
+		vectors[bit] = doc.Bits[bit]
+	}
+	return vectors, nil
+}
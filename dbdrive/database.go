@@ -3,141 +3,82 @@ package dbdrive
 import (
 	"blockchain-event-plugin/logger"
 	"blockchain-event-plugin/setting"
+	"context"
 	"database/sql"
-	"errors"
 	_ "github.com/go-sql-driver/mysql"
 	"os"
-	"runtime"
-	"sync"
 	"time"
 )
 
-var err error
-var DB *sql.DB
-var once sync.Once
-
 const (
-	MaxOpenConns = 150
-	MaxIdleConns = 100
-)
-
-func init() {
-	once.Do(func() {
-		defer func() {
-			if r := recover(); r != nil {
-				logger.Error("MySQL connection error, ", err)
-			}
-		}()
-
-		//开启MySQL的链接
-		mysqlSourceName := setting.GetString("mysql.source_name")
-		if mysqlSourceName == "" {
-			mysqlSourceName = os.Getenv("MysqlSourceName")
-			logger.Info("Command line get MysqlSourceName:", mysqlSourceName)
-		}
-		DB, err = sql.Open("mysql", mysqlSourceName)
-		if nil != err {
-			panic(err)
-		}
-
-		DB.SetMaxOpenConns(MaxOpenConns)
-		DB.SetMaxIdleConns(MaxIdleConns)
-		DB.SetConnMaxLifetime(time.Minute * 10)
-
-		err = DB.Ping()
-		if nil != err {
-			panic(err)
-		}
+	// 连接池的默认配置，mysql.max_open_conn、max_idle_conn、conn_max_life_time未配置时使用
+	defaultMaxOpenConns    = 150
+	defaultMaxIdleConns    = 100
+	defaultConnMaxLifetime = 10 * time.Minute
 
-		logger.Info("MySQL connection successful！")
-	})
-}
-
-// Close 关闭数据库连接
-func Close() {
-	DB.Close()
-}
+	pingTimeout = 5 * time.Second
+)
 
-func printCallerName() string {
-	pc, _, _, _ := runtime.Caller(2)
-	return runtime.FuncForPC(pc).Name()
+// mysqlStore is the MySQL implementation of Store, every table is partitioned by the chain_id column
+type mysqlStore struct {
+	db      *sql.DB
+	chainID int64
 }
 
-// Insert 插入操作
-func Insert(sql string, args ...interface{}) (int64, error) {
-	stmt, err := DB.Prepare(sql)
-	printCallerName := printCallerName()
-	err = CheckErr(err, printCallerName, "SQL语句设置失败", sql, args)
-	if err != nil {
-		return 0, err
+// NewMySQLStore 开启MySQL的链接
+func NewMySQLStore() (Store, error) {
+	mysqlSourceName := setting.GetString("mysql.source_name")
+	if mysqlSourceName == "" {
+		mysqlSourceName = os.Getenv("MysqlSourceName")
+		logger.Info("Command line get MysqlSourceName:", mysqlSourceName)
 	}
-
-	result, err := stmt.Exec(args...)
-	if err = CheckErr(err, printCallerName, "参数添加失败", sql, args); err != nil {
-		return 0, err
+	db, err := sql.Open("mysql", mysqlSourceName)
+	if nil != err {
+		return nil, err
 	}
 
-	id, err := result.LastInsertId()
-	if err = CheckErr(err, printCallerName, "插入失败", sql, args); err != nil {
-		return 0, err
-	}
-	logger.Debug("插入成功，ID", id, sql)
-	return id, nil
-}
+	maxOpenConns, maxIdleConns, connMaxLifetime := poolConfig()
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxLifetime(connMaxLifetime)
 
-// Delete 删除操作
-func Delete(sql string, args ...interface{}) error {
-	stmt, err := DB.Prepare(sql)
-	printCallerName := printCallerName()
-	if err = CheckErr(err, printCallerName, "SQL语句设置失败", sql, args); err != nil {
-		return err
+	if err = db.Ping(); nil != err {
+		db.Close()
+		return nil, err
 	}
 
-	result, err := stmt.Exec(args...)
-	if err = CheckErr(err, printCallerName, "参数添加失败", sql, args); err != nil {
-		return err
+	logger.Info("MySQL connection successful！")
+	return &mysqlStore{db: db}, nil
+}
+
+// poolConfig 读取连接池配置，未配置或不大于0时使用默认值
+func poolConfig() (maxOpenConns, maxIdleConns int, connMaxLifetime time.Duration) {
+	maxOpenConns, maxIdleConns, connMaxLifetime = defaultMaxOpenConns, defaultMaxIdleConns, defaultConnMaxLifetime
+	if n := setting.GetInt("mysql.max_open_conn"); n > 0 {
+		maxOpenConns = n
 	}
-	num, err := result.RowsAffected()
-	if err = CheckErr(err, printCallerName, "删除失败", sql, args); err != nil {
-		return err
+	if n := setting.GetInt("mysql.max_idle_conn"); n > 0 {
+		maxIdleConns = n
 	}
-	if int(num) == 0 {
-		logger.Error(printCallerName+"方法MYSQL错误", "删除失败", sql, args)
-		return errors.New("Delete failed. ")
+	if n := setting.GetInt("mysql.conn_max_life_time"); n > 0 {
+		connMaxLifetime = time.Duration(n)
 	}
-	logger.Debug("删除成功：", "影响条数", num, sql, args)
-	return nil
+	return maxOpenConns, maxIdleConns, connMaxLifetime
 }
 
-// Update 修改操作
-func Update(sql string, args ...interface{}) error {
-	stmt, err := DB.Prepare(sql)
-	printCallerName := printCallerName()
-	if err = CheckErr(err, printCallerName, "SQL语句设置失败", sql, args); err != nil {
-		return err
-	}
-	result, err := stmt.Exec(args...)
+// Chain 返回指定链的存储，共用数据库连接
+func (s *mysqlStore) Chain(chainID int64) Store {
+	return &mysqlStore{db: s.db, chainID: chainID}
+}
 
-	if err = CheckErr(err, printCallerName, "参数添加失败", sql, args); err != nil {
-		return err
-	}
-	num, err := result.RowsAffected()
-	if err = CheckErr(err, printCallerName, "修改失败", sql, args); err != nil {
-		return err
-	}
-	if int(num) == 0 {
-		logger.Error(printCallerName+"方法MYSQL错误", "修改失败", sql, args)
-		return errors.New("Update failed. ")
-	}
-	logger.Debug("修改成功：", "影响条数", num, sql, args)
-	return nil
+// Ping 检查数据库连接
+func (s *mysqlStore) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return wrapErr(s.db.PingContext(ctx))
 }
 
-// CheckErr 检查error
-func CheckErr(err error, printCallerName, msg, sql string, args ...interface{}) error {
-	if err != nil {
-		logger.Error(printCallerName+"方法MYSQL错误", msg, err.Error(), sql, args)
-		return err
-	}
-	return nil
+// Close 关闭数据库连接
+func (s *mysqlStore) Close() error {
+	return s.db.Close()
 }
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	ethtypes "github.com/ethereum/go-ethereum/core/types"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -28,170 +27,87 @@ type BlockBloom struct {
 	BlockNumber int64  `json:"blockNumber" description:"block in which the transaction was included"`
 	BlockHash   string `json:"blockHash" description:"hash of the block in which the transaction was included"`
 	Bloom       string `json:"bloom" description:"block bloom"`
+	// 区块头字段，旧版本存储的区块ParentHash为空
+	ParentHash string `json:"parentHash" description:"hash of the parent block"`
+	Timestamp  uint64 `json:"timestamp" description:"unix timestamp of the block"`
+	GasLimit   uint64 `json:"gasLimit" description:"gas limit of the block"`
+	GasUsed    uint64 `json:"gasUsed" description:"gas used by the transactions of the block"`
+	Miner      string `json:"miner" description:"beneficiary of the block"`
+	ExtraData  string `json:"extraData" description:"hex extra data of the block"`
 }
 
-// GetBloomByBlockNumber
-func GetBloomByBlockNumber(blockNum int64) (bloom string, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			logger.Error("GetLogs mysql error: ", r)
-		}
-	}()
+const blockColumns = "block_number,block_hash,bloom,parent_hash,`timestamp`,gas_limit,gas_used,miner,extra_data"
 
-	var rows *sql.Rows
-	sql := "SELECT bloom FROM block_bloom WHERE block_number = ? limit 1"
-	rows, err = DB.Query(sql, blockNum)
-
-	defer rows.Close()
-	if err != nil {
-		panic(err)
-	}
-	// 数据处理
-	for rows.Next() {
-		rows.Scan(&bloom)
-	}
-
-	if err := rows.Err(); err != nil {
-		panic(err)
-	}
-
-	return bloom, nil
+// scanBlock 读取blockColumns中的字段
+func scanBlock(row *sql.Row) (block BlockBloom, err error) {
+	err = row.Scan(&block.BlockNumber, &block.BlockHash, &block.Bloom, &block.ParentHash, &block.Timestamp,
+		&block.GasLimit, &block.GasUsed, &block.Miner, &block.ExtraData)
+	return block, wrapErr(err)
 }
 
-// GetBlockNumAndBloomByBlockHash
-func GetBlockNumAndBloomByBlockHash(blockHash string) (bloom BlockBloom, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			logger.Error("GetBlockNumAndBloomByBlockHash mysql error: ", r)
-		}
-	}()
-
-	var rows *sql.Rows
-	sql := "SELECT block_number,bloom FROM block_bloom WHERE block_hash = ? limit 1"
-	rows, err = DB.Query(sql, blockHash)
-
-	defer rows.Close()
-	if err != nil {
-		panic(err)
-	}
-	// 数据处理
-	for rows.Next() {
-		rows.Scan(&bloom.BlockNumber, &bloom.Bloom)
-	}
-
-	if err := rows.Err(); err != nil {
-		panic(err)
-	}
-
-	return bloom, nil
+// GetBloomByBlockNumber 获取区块bloom，区块未存储时返回ErrNotFound
+func (s *mysqlStore) GetBloomByBlockNumber(blockNum int64) (bloom string, err error) {
+	err = s.db.QueryRow("SELECT bloom FROM block_bloom WHERE chain_id = ? AND block_number = ? limit 1", s.chainID, blockNum).Scan(&bloom)
+	return bloom, wrapErr(err)
 }
 
-// GetLogsByBlockNum
-func GetLogsByBlockNumber(blockNumber int64) (logs []Logs, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			logger.Error("GetLogs mysql error: ", r)
-		}
-	}()
-
-	var rows *sql.Rows
-	sql := "SELECT address,topics,`data`,block_number,tx_hash,tx_index,block_hash,log_index,removed FROM logs WHERE block_number = ? "
-	rows, err = DB.Query(sql, blockNumber)
-
-	defer rows.Close()
-	if err != nil {
-		panic(err)
-	}
-	var log Logs
-	// 数据处理
-	for rows.Next() {
-		var topic string
-		var blockNumber int
-		var address string
-		rows.Scan(&address, &topic, &log.Data, &blockNumber, &log.TxHash, &log.TxIndex, &log.BlockHash, &log.LogIndex, &log.Removed)
-		//处理address大小写
-		log.Address = strings.ToLower(address)
-		//处理Topics
-		log.Topics = strings.Split(topic, ",")
-		//处理block_number
-		log.BlockNumber = toHex(blockNumber)
-		logs = append(logs, log)
-	}
-
-	if err := rows.Err(); err != nil {
-		panic(err)
-	}
+// GetBlockNumAndBloomByBlockHash 根据区块hash获取区块高度和bloom，区块未存储时返回ErrNotFound
+func (s *mysqlStore) GetBlockNumAndBloomByBlockHash(blockHash string) (bloom BlockBloom, err error) {
+	err = s.db.QueryRow("SELECT block_number,block_hash,bloom FROM block_bloom WHERE chain_id = ? AND block_hash = ? limit 1", s.chainID, blockHash).
+		Scan(&bloom.BlockNumber, &bloom.BlockHash, &bloom.Bloom)
+	return bloom, wrapErr(err)
+}
 
-	return logs, nil
+// GetBlockByNumber 获取区块bloom和区块头，区块未存储时返回ErrNotFound
+func (s *mysqlStore) GetBlockByNumber(blockNum int64) (BlockBloom, error) {
+	return scanBlock(s.db.QueryRow("SELECT "+blockColumns+" FROM block_bloom WHERE chain_id = ? AND block_number = ? limit 1", s.chainID, blockNum))
 }
 
-// GetLogByTxhashAndLogIndex
-func GetLogByTxhashAndLogIndex(ethLog ethtypes.Log) (logs []Logs, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			logger.Error("GetLogs mysql error: ", r)
-		}
-	}()
+// GetBlockByHash 根据区块hash获取区块bloom和区块头，区块未存储时返回ErrNotFound
+func (s *mysqlStore) GetBlockByHash(blockHash string) (BlockBloom, error) {
+	return scanBlock(s.db.QueryRow("SELECT "+blockColumns+" FROM block_bloom WHERE chain_id = ? AND block_hash = ? limit 1", s.chainID, blockHash))
+}
 
-	fmt.Println("ethLog.TxHash, ethLog.Index:", ethLog.TxHash, ethLog.Index)
-	var rows *sql.Rows
-	sql := "SELECT address,topics,`data`,block_number,tx_hash,tx_index,block_hash,log_index,removed FROM logs WHERE tx_hash = ? and log_index = ? "
-	logIndex := "0x" + strconv.Itoa(int(ethLog.Index))
-	rows, err = DB.Query(sql, ethLog.TxHash.String(), logIndex)
+// GetBlockHashByBlockNumber 获取区块hash，区块未存储时返回ErrNotFound
+func (s *mysqlStore) GetBlockHashByBlockNumber(blockNum int64) (blockHash string, err error) {
+	err = s.db.QueryRow("SELECT block_hash FROM block_bloom WHERE chain_id = ? AND block_number = ? limit 1", s.chainID, blockNum).Scan(&blockHash)
+	return blockHash, wrapErr(err)
+}
 
-	defer rows.Close()
+// GetBlockHashesByRange 获取(from, to]区间内的区块hash
+func (s *mysqlStore) GetBlockHashesByRange(from, to int64) (blockHashes []string, err error) {
+	rows, err := s.db.Query("SELECT block_hash FROM block_bloom WHERE chain_id = ? AND block_number > ? AND block_number <= ? order by block_number",
+		s.chainID, from, to)
 	if err != nil {
-		panic(err)
-	}
-	var log Logs
-	// 数据处理
-	for rows.Next() {
-		var topic string
-		var blockNumber int
-		var address string
-		rows.Scan(&address, &topic, &log.Data, &blockNumber, &log.TxHash, &log.TxIndex, &log.BlockHash, &log.LogIndex, &log.Removed)
-		//处理address大小写
-		log.Address = strings.ToLower(address)
-		//处理Topics
-		log.Topics = strings.Split(topic, ",")
-		//处理block_number
-		log.BlockNumber = toHex(blockNumber)
-		logs = append(logs, log)
+		return nil, wrapErr(err)
 	}
+	defer rows.Close()
 
-	if err := rows.Err(); err != nil {
-		panic(err)
+	for rows.Next() {
+		var blockHash string
+		if err := rows.Scan(&blockHash); err != nil {
+			return nil, invalidData(err)
+		}
+		blockHashes = append(blockHashes, blockHash)
 	}
-
-	return logs, nil
+	return blockHashes, wrapErr(rows.Err())
 }
 
-// GetBlockNumber
-func GetBlockHeight() (blockHeight int64, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			logger.Error("GetLogs mysql error: ", r)
-		}
-	}()
-
-	var rows *sql.Rows
-	sql := "SELECT block_number FROM block_bloom order by block_number desc limit 1"
-	rows, err = DB.Query(sql)
-
-	defer rows.Close()
+// GetLogsByBlockNumber 获取区块中未移除的logs
+func (s *mysqlStore) GetLogsByBlockNumber(blockNumber int64) ([]Logs, error) {
+	rows, err := s.db.Query("SELECT address,topics,`data`,block_number,tx_hash,tx_index,block_hash,log_index,removed FROM logs "+
+		"WHERE chain_id = ? AND block_number = ? AND removed = 'false' ORDER BY LENGTH(log_index), log_index", s.chainID, blockNumber)
 	if err != nil {
-		panic(err)
-	}
-	// 数据处理
-	for rows.Next() {
-		rows.Scan(&blockHeight)
-	}
-
-	if err := rows.Err(); err != nil {
-		panic(err)
+		return nil, wrapErr(err)
 	}
+	defer rows.Close()
+	return scanLogs(rows)
+}
 
-	return blockHeight, nil
+// GetBlockHeight 获取库中最高的区块高度，未存储区块时返回0
+func (s *mysqlStore) GetBlockHeight() (blockHeight int64, err error) {
+	err = s.db.QueryRow("SELECT COALESCE(MAX(block_number), 0) FROM block_bloom WHERE chain_id = ?", s.chainID).Scan(&blockHeight)
+	return blockHeight, wrapErr(err)
 }
 
 func toHex(ten int) string {
@@ -218,48 +134,208 @@ func toHex(ten int) string {
 
 }
 
-// save Logs
-func SaveLogs(logs []ethtypes.Log) {
+// ToLogs 将链上的logs转换为库中存储的格式
+func ToLogs(ethlogs []ethtypes.Log) []Logs {
+	logs := make([]Logs, 0, len(ethlogs))
+	for _, value := range ethlogs {
+		topics := make([]string, len(value.Topics))
+		for i, topic := range value.Topics {
+			topics[i] = topic.String()
+		}
+		logs = append(logs, Logs{
+			Address:     strings.ToLower(value.Address.String()),
+			Topics:      topics,
+			Data:        "0x" + fmt.Sprintf("%x", value.Data),
+			BlockNumber: toHex(int(value.BlockNumber)),
+			TxHash:      value.TxHash.String(),
+			TxIndex:     hexutil.Uint64(value.TxIndex).String(),
+			BlockHash:   value.BlockHash.String(),
+			LogIndex:    hexutil.Uint64(value.Index).String(),
+			Removed:     value.Removed,
+		})
+	}
+	return logs
+}
+
+// SaveLogs 在一个事务中批量保存logs
+func (s *mysqlStore) SaveLogs(logs []ethtypes.Log) error {
+	return s.SaveBlocks(nil, logs)
+}
+
+// SaveBlocks 在一个事务中批量保存区块bloom和logs，并删除区块所在section的bloombits索引。logs按(chain_id, tx_hash, log_index)唯一，
+// 已存在时覆盖，重组后重新打包的logs会恢复为未移除
+func (s *mysqlStore) SaveBlocks(blooms []BlockBloom, logs []ethtypes.Log) (err error) {
+	if len(blooms) == 0 && len(logs) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return wrapErr(err)
+	}
 	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("SaveLogs mysql error: ", r)
+		if err != nil {
+			tx.Rollback()
 		}
 	}()
 
-	for index, value := range logs {
-		if index < len(logs) {
-			//处理topics
-			topics := ""
-			for i := 0; i < len(value.Topics); i++ {
-				if i == len(value.Topics)-1 {
-					topics += value.Topics[i].String()
-				} else {
-					topics += value.Topics[i].String() + ","
-				}
+	for begin := 0; begin < len(logs); begin += saveBatch {
+		end := begin + saveBatch
+		if end > len(logs) {
+			end = len(logs)
+		}
+		args := make([]interface{}, 0, (end-begin)*15)
+		for _, value := range logs[begin:end] {
+			topics := make([]string, len(value.Topics))
+			for i, topic := range value.Topics {
+				topics[i] = topic.String()
 			}
-			_, err := Insert("INSERT INTO `logs`(`id`,`address`,`topics`,`data`,`block_number`,`tx_hash`,`tx_index`,`block_hash`,`log_index`,`removed`) values (?,?,?,?,?,?,?,?,?,?)",
-				getSnowflakeId(), value.Address.String(), topics, "0x"+fmt.Sprintf("%x", value.Data), value.BlockNumber,
+			columns := topicColumns(topics)
+			args = append(args, getSnowflakeId(), s.chainID, strings.ToLower(value.Address.String()), strings.Join(topics, ","),
+				columns[0], columns[1], columns[2], columns[3], "0x"+fmt.Sprintf("%x", value.Data), value.BlockNumber,
 				value.TxHash.String(), hexutil.Uint64(value.TxIndex).String(), value.BlockHash.String(), hexutil.Uint64(value.Index).String(), fmt.Sprint(value.Removed))
-			if err != nil {
-				fmt.Println("SaveLogs Insert error: ", err)
-			}
+		}
+		_, err = tx.Exec("INSERT INTO `logs`(`id`,`chain_id`,`address`,`topics`,`topic0`,`topic1`,`topic2`,`topic3`,`data`,`block_number`,`tx_hash`,`tx_index`,`block_hash`,`log_index`,`removed`) values "+
+			valueRows(end-begin, 15)+" ON DUPLICATE KEY UPDATE `address` = VALUES(`address`),`topics` = VALUES(`topics`),"+
+			"`topic0` = VALUES(`topic0`),`topic1` = VALUES(`topic1`),`topic2` = VALUES(`topic2`),`topic3` = VALUES(`topic3`),`data` = VALUES(`data`),"+
+			"`block_number` = VALUES(`block_number`),`tx_index` = VALUES(`tx_index`),`block_hash` = VALUES(`block_hash`),`removed` = VALUES(`removed`)", args...)
+		if err != nil {
+			return wrapErr(err)
+		}
+	}
+
+	for begin := 0; begin < len(blooms); begin += saveBatch {
+		end := begin + saveBatch
+		if end > len(blooms) {
+			end = len(blooms)
+		}
+		args := make([]interface{}, 0, (end-begin)*11)
+		for _, bloom := range blooms[begin:end] {
+			args = append(args, getSnowflakeId(), s.chainID, bloom.BlockNumber, bloom.BlockHash, bloom.Bloom,
+				bloom.ParentHash, bloom.Timestamp, bloom.GasLimit, bloom.GasUsed, bloom.Miner, bloom.ExtraData)
+		}
+		_, err = tx.Exec("INSERT INTO `block_bloom`(`id`,`chain_id`,`block_number`,`block_hash`,`bloom`,"+
+			"`parent_hash`,`timestamp`,`gas_limit`,`gas_used`,`miner`,`extra_data`) values "+
+			valueRows(end-begin, 11)+" ON DUPLICATE KEY UPDATE `block_hash` = VALUES(`block_hash`),`bloom` = VALUES(`bloom`),"+
+			"`parent_hash` = VALUES(`parent_hash`),`timestamp` = VALUES(`timestamp`),`gas_limit` = VALUES(`gas_limit`),"+
+			"`gas_used` = VALUES(`gas_used`),`miner` = VALUES(`miner`),`extra_data` = VALUES(`extra_data`)", args...)
+		if err != nil {
+			return wrapErr(err)
+		}
+	}
+
+	// 回填的区块可能落在已建立索引的section中，删除这些section的索引后重新建立
+	if sections := bloomSections(blooms); len(sections) > 0 {
+		args := []interface{}{s.chainID}
+		for _, section := range sections {
+			args = append(args, section)
+		}
+		if _, err = tx.Exec("DELETE FROM `bloom_bits` WHERE `chain_id` = ? AND `section` IN ("+placeholders(len(sections))+")", args...); err != nil {
+			return wrapErr(err)
 		}
 	}
+	return wrapErr(tx.Commit())
 }
 
-// Save block bloom
-func SaveBloom(blockeHeight int64, blockHash, bloom string) {
+// RollbackBlocks 链重组时回滚ancestor之后的区块：logs标记为removed，删除block_bloom，返回被移除的logs
+func (s *mysqlStore) RollbackBlocks(ancestor int64) (removed []Logs, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, wrapErr(err)
+	}
 	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("SaveLogs mysql error: ", r)
+		if err != nil {
+			tx.Rollback()
 		}
 	}()
 
-	_, err := Insert("INSERT INTO `block_bloom`(`id`,`block_number`,`block_hash`,`bloom`) values (?,?,?,?)",
-		getSnowflakeId(), blockeHeight, blockHash, bloom)
+	rows, err := tx.Query("SELECT address,topics,`data`,block_number,tx_hash,tx_index,block_hash,log_index FROM logs WHERE chain_id = ? AND block_number > ? AND removed = 'false' ", s.chainID, ancestor)
 	if err != nil {
-		fmt.Println("SaveBloom Insert error: ", err)
+		return nil, wrapErr(err)
 	}
+	for rows.Next() {
+		var log Logs
+		var topic string
+		var blockNumber int
+		var address string
+		if err = rows.Scan(&address, &topic, &log.Data, &blockNumber, &log.TxHash, &log.TxIndex, &log.BlockHash, &log.LogIndex); err != nil {
+			rows.Close()
+			return nil, invalidData(err)
+		}
+		log.Address = strings.ToLower(address)
+		log.Topics = strings.Split(topic, ",")
+		log.BlockNumber = toHex(blockNumber)
+		log.Removed = true
+		removed = append(removed, log)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, wrapErr(err)
+	}
+
+	if _, err = tx.Exec("UPDATE `logs` SET `removed` = ? WHERE `chain_id` = ? AND `block_number` > ? AND `removed` = 'false'", fmt.Sprint(true), s.chainID, ancestor); err != nil {
+		return nil, wrapErr(err)
+	}
+	if _, err = tx.Exec("DELETE FROM `block_bloom` WHERE `chain_id` = ? AND `block_number` > ?", s.chainID, ancestor); err != nil {
+		return nil, wrapErr(err)
+	}
+	if _, err = tx.Exec("DELETE FROM `bloom_bits` WHERE `chain_id` = ? AND `section` >= ?", s.chainID, bloomBitsSection(ancestor+1)); err != nil {
+		return nil, wrapErr(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, wrapErr(err)
+	}
+	logger.Info("Rollback blocks successful", "ancestor", ancestor, "removedLogs", len(removed))
+	return removed, nil
+}
+
+// SaveABI 保存合约ABI，地址已存在时覆盖
+func (s *mysqlStore) SaveABI(address, abiJSON string) error {
+	_, err := s.db.Exec("INSERT INTO `contract_abi`(`chain_id`,`address`,`abi`) values (?,?,?) ON DUPLICATE KEY UPDATE `abi` = VALUES(`abi`)",
+		s.chainID, strings.ToLower(address), abiJSON)
+	return wrapErr(err)
+}
+
+// GetABI 获取合约ABI，未注册时返回空字符串
+func (s *mysqlStore) GetABI(address string) (abiJSON string, err error) {
+	err = s.db.QueryRow("SELECT abi FROM contract_abi WHERE chain_id = ? AND address = ? limit 1", s.chainID, strings.ToLower(address)).Scan(&abiJSON)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return abiJSON, wrapErr(err)
+}
+
+// GetWatchList 获取监听的合约列表
+func (s *mysqlStore) GetWatchList() (watches []Watch, err error) {
+	rows, err := s.db.Query("SELECT address,topics FROM watch_list WHERE chain_id = ? order by address", s.chainID)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var watch Watch
+		var topics string
+		if err := rows.Scan(&watch.Address, &topics); err != nil {
+			return nil, invalidData(err)
+		}
+		if topics != "" {
+			watch.Topics = strings.Split(topics, ",")
+		}
+		watches = append(watches, watch)
+	}
+	return watches, wrapErr(rows.Err())
+}
+
+// SaveWatch 保存监听的合约，地址已存在时覆盖topics
+func (s *mysqlStore) SaveWatch(watch Watch) error {
+	_, err := s.db.Exec("INSERT INTO `watch_list`(`chain_id`,`address`,`topics`) values (?,?,?) ON DUPLICATE KEY UPDATE `topics` = VALUES(`topics`)",
+		s.chainID, strings.ToLower(watch.Address), strings.Join(watch.Topics, ","))
+	return wrapErr(err)
+}
+
+// DeleteWatch 删除监听的合约，已存储的logs保留
+func (s *mysqlStore) DeleteWatch(address string) error {
+	_, err := s.db.Exec("DELETE FROM `watch_list` WHERE `chain_id` = ? AND `address` = ?", s.chainID, strings.ToLower(address))
+	return wrapErr(err)
 }
 
 // --------------------id生成器-------------------------
@@ -0,0 +1,60 @@
+package dbdrive
+
+import (
+	"database/sql"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Kinds of the errors returned by the store, test them with errors.Is
+var (
+	// ErrNotFound is returned when the requested record is not stored
+	ErrNotFound = errors.New("not found")
+	// ErrUnavailable is returned when the database can not be reached or fails to execute a query
+	ErrUnavailable = errors.New("store unavailable")
+	// ErrInvalidData is returned when a stored record can not be decoded
+	ErrInvalidData = errors.New("invalid stored data")
+)
+
+// Error is an error returned by the store, Kind is one of ErrNotFound, ErrUnavailable
+// and ErrInvalidData and Err the underlying database error.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// wrapErr 将数据库错误转换为store错误，未找到记录为ErrNotFound，其余为ErrUnavailable
+func wrapErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	if err == sql.ErrNoRows || err == mongo.ErrNoDocuments {
+		return &Error{Kind: ErrNotFound, Err: err}
+	}
+	return &Error{Kind: ErrUnavailable, Err: err}
+}
+
+// invalidData 读取的记录无法解析
+func invalidData(err error) error {
+	return &Error{Kind: ErrInvalidData, Err: err}
+}
+
+// notFound 请求的记录不存在
+func notFound(format string, args ...interface{}) error {
+	return &Error{Kind: ErrNotFound, Err: errors.Errorf(format, args...)}
+}
@@ -0,0 +1,174 @@
+package dbdrive
+
+import (
+	"blockchain-event-plugin/metrics"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// meteredStore records the latency of every query of the wrapped store under
+// db/duration/{method}, and the failed ones under db/errors/{method}
+type meteredStore struct {
+	Store
+}
+
+// withMetrics 开启统计时为存储记录查询耗时和错误数
+func withMetrics(store Store) Store {
+	if !metrics.Enabled() {
+		return store
+	}
+	return &meteredStore{Store: store}
+}
+
+// observe 记录查询耗时，未找到记录不计为错误
+func observe(method string, start time.Time, err *error) {
+	metrics.GetOrRegisterTimer("db/duration/" + method).UpdateSince(start)
+	if *err != nil && !errors.Is(*err, ErrNotFound) {
+		metrics.GetOrRegisterCounter("db/errors/" + method).Inc(1)
+	}
+}
+
+func (s *meteredStore) Chain(chainID int64) Store {
+	return &meteredStore{Store: s.Store.Chain(chainID)}
+}
+
+func (s *meteredStore) GetBloomByBlockNumber(blockNum int64) (bloom string, err error) {
+	defer observe("GetBloomByBlockNumber", time.Now(), &err)
+	return s.Store.GetBloomByBlockNumber(blockNum)
+}
+
+func (s *meteredStore) GetBlockNumAndBloomByBlockHash(blockHash string) (bloom BlockBloom, err error) {
+	defer observe("GetBlockNumAndBloomByBlockHash", time.Now(), &err)
+	return s.Store.GetBlockNumAndBloomByBlockHash(blockHash)
+}
+
+func (s *meteredStore) GetBlockByNumber(blockNum int64) (block BlockBloom, err error) {
+	defer observe("GetBlockByNumber", time.Now(), &err)
+	return s.Store.GetBlockByNumber(blockNum)
+}
+
+func (s *meteredStore) GetBlockByHash(blockHash string) (block BlockBloom, err error) {
+	defer observe("GetBlockByHash", time.Now(), &err)
+	return s.Store.GetBlockByHash(blockHash)
+}
+
+func (s *meteredStore) GetBlockHashByBlockNumber(blockNum int64) (hash string, err error) {
+	defer observe("GetBlockHashByBlockNumber", time.Now(), &err)
+	return s.Store.GetBlockHashByBlockNumber(blockNum)
+}
+
+func (s *meteredStore) GetBloomsByRange(from, to int64) (blooms []BlockBloom, err error) {
+	defer observe("GetBloomsByRange", time.Now(), &err)
+	return s.Store.GetBloomsByRange(from, to)
+}
+
+func (s *meteredStore) GetBlockHashesByRange(from, to int64) (hashes []string, err error) {
+	defer observe("GetBlockHashesByRange", time.Now(), &err)
+	return s.Store.GetBlockHashesByRange(from, to)
+}
+
+func (s *meteredStore) GetLogsByBlockNumber(blockNumber int64) (logs []Logs, err error) {
+	defer observe("GetLogsByBlockNumber", time.Now(), &err)
+	return s.Store.GetLogsByBlockNumber(blockNumber)
+}
+
+func (s *meteredStore) GetLogsByRange(q LogQuery) (logs []Logs, err error) {
+	defer observe("GetLogsByRange", time.Now(), &err)
+	return s.Store.GetLogsByRange(q)
+}
+
+func (s *meteredStore) GetBlockHeight() (height int64, err error) {
+	defer observe("GetBlockHeight", time.Now(), &err)
+	return s.Store.GetBlockHeight()
+}
+
+func (s *meteredStore) SaveLogs(logs []ethtypes.Log) (err error) {
+	defer observe("SaveLogs", time.Now(), &err)
+	return s.Store.SaveLogs(logs)
+}
+
+func (s *meteredStore) SaveBlocks(blooms []BlockBloom, logs []ethtypes.Log) (err error) {
+	defer observe("SaveBlocks", time.Now(), &err)
+	return s.Store.SaveBlocks(blooms, logs)
+}
+
+func (s *meteredStore) GetBloomBitsSections(from, to int64) (sections []int64, err error) {
+	defer observe("GetBloomBitsSections", time.Now(), &err)
+	return s.Store.GetBloomBitsSections(from, to)
+}
+
+func (s *meteredStore) DeleteBloomBits(from, to int64) (err error) {
+	defer observe("DeleteBloomBits", time.Now(), &err)
+	return s.Store.DeleteBloomBits(from, to)
+}
+
+func (s *meteredStore) SaveBloomBits(section int64, bits [][]byte) (err error) {
+	defer observe("SaveBloomBits", time.Now(), &err)
+	return s.Store.SaveBloomBits(section, bits)
+}
+
+func (s *meteredStore) GetBloomBits(section int64, bits []uint) (vectors map[uint][]byte, err error) {
+	defer observe("GetBloomBits", time.Now(), &err)
+	return s.Store.GetBloomBits(section, bits)
+}
+
+func (s *meteredStore) RollbackBlocks(ancestor int64) (removed []Logs, err error) {
+	defer observe("RollbackBlocks", time.Now(), &err)
+	return s.Store.RollbackBlocks(ancestor)
+}
+
+func (s *meteredStore) SaveABI(address, abiJSON string) (err error) {
+	defer observe("SaveABI", time.Now(), &err)
+	return s.Store.SaveABI(address, abiJSON)
+}
+
+func (s *meteredStore) GetABI(address string) (abiJSON string, err error) {
+	defer observe("GetABI", time.Now(), &err)
+	return s.Store.GetABI(address)
+}
+
+func (s *meteredStore) GetWatchList() (watches []Watch, err error) {
+	defer observe("GetWatchList", time.Now(), &err)
+	return s.Store.GetWatchList()
+}
+
+func (s *meteredStore) SaveWatch(watch Watch) (err error) {
+	defer observe("SaveWatch", time.Now(), &err)
+	return s.Store.SaveWatch(watch)
+}
+
+func (s *meteredStore) DeleteWatch(address string) (err error) {
+	defer observe("DeleteWatch", time.Now(), &err)
+	return s.Store.DeleteWatch(address)
+}
+
+func (s *meteredStore) CreateBackfillJob(job *BackfillJob) (err error) {
+	defer observe("CreateBackfillJob", time.Now(), &err)
+	return s.Store.CreateBackfillJob(job)
+}
+
+func (s *meteredStore) UpdateBackfillJob(job BackfillJob) (err error) {
+	defer observe("UpdateBackfillJob", time.Now(), &err)
+	return s.Store.UpdateBackfillJob(job)
+}
+
+func (s *meteredStore) GetBackfillJob(id int64) (job *BackfillJob, err error) {
+	defer observe("GetBackfillJob", time.Now(), &err)
+	return s.Store.GetBackfillJob(id)
+}
+
+func (s *meteredStore) GetBackfillJobs(status string) (jobs []BackfillJob, err error) {
+	defer observe("GetBackfillJobs", time.Now(), &err)
+	return s.Store.GetBackfillJobs(status)
+}
+
+func (s *meteredStore) SaveBackfillChunk(jobID, fromBlock int64) (err error) {
+	defer observe("SaveBackfillChunk", time.Now(), &err)
+	return s.Store.SaveBackfillChunk(jobID, fromBlock)
+}
+
+func (s *meteredStore) GetBackfillChunks(jobID int64) (chunks []int64, err error) {
+	defer observe("GetBackfillChunks", time.Now(), &err)
+	return s.Store.GetBackfillChunks(jobID)
+}
@@ -0,0 +1,383 @@
+package dbdrive
+
+import (
+	"blockchain-event-plugin/logger"
+	"database/sql"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Migrator applies the versioned schema migrations embedded in the binary,
+// the applied versions are recorded in schema_version.
+type Migrator interface {
+	// MigrateUp applies the pending migrations up to target, or all of them if target is 0
+	MigrateUp(target int) error
+	// MigrateDown reverts the applied migrations above target
+	MigrateDown(target int) error
+	MigrationStatus() ([]MigrationStatus, error)
+}
+
+// MigrationStatus is the state of a single migration
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// sqlMigration is a MySQL migration, the statements are executed in order.
+// MySQL commits DDL implicitly, so a failed migration may be partially applied.
+type sqlMigration struct {
+	version int
+	name    string
+	up      []string
+	down    []string
+}
+
+var mysqlMigrations = []sqlMigration{
+	{
+		version: 1,
+		name:    "create logs and block_bloom",
+		up: []string{
+			"CREATE TABLE IF NOT EXISTS `block_bloom` (" +
+				"`id` bigint NOT NULL," +
+				"`block_number` bigint NOT NULL," +
+				"`block_hash` varchar(66) NOT NULL," +
+				"`bloom` varchar(1026) NOT NULL," +
+				"PRIMARY KEY (`id`)" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+			"CREATE TABLE IF NOT EXISTS `logs` (" +
+				"`id` bigint NOT NULL," +
+				"`address` varchar(42) NOT NULL," +
+				"`topics` varchar(267) NOT NULL DEFAULT ''," +
+				"`data` longtext NOT NULL," +
+				"`block_number` bigint NOT NULL," +
+				"`tx_hash` varchar(66) NOT NULL," +
+				"`tx_index` varchar(18) NOT NULL," +
+				"`block_hash` varchar(66) NOT NULL," +
+				"`log_index` varchar(18) NOT NULL," +
+				"`removed` varchar(5) NOT NULL DEFAULT 'false'," +
+				"PRIMARY KEY (`id`)" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+		},
+		down: []string{
+			"DROP TABLE IF EXISTS `logs`",
+			"DROP TABLE IF EXISTS `block_bloom`",
+		},
+	},
+	{
+		version: 2,
+		name:    "partition by chain_id, add contract_abi and watch_list",
+		up: []string{
+			"ALTER TABLE `block_bloom` ADD COLUMN `chain_id` bigint NOT NULL DEFAULT 0 AFTER `id`",
+			"ALTER TABLE `logs` ADD COLUMN `chain_id` bigint NOT NULL DEFAULT 0 AFTER `id`",
+			"CREATE TABLE IF NOT EXISTS `contract_abi` (" +
+				"`chain_id` bigint NOT NULL DEFAULT 0," +
+				"`address` varchar(42) NOT NULL," +
+				"`abi` longtext NOT NULL," +
+				"PRIMARY KEY (`chain_id`, `address`)" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+			"CREATE TABLE IF NOT EXISTS `watch_list` (" +
+				"`chain_id` bigint NOT NULL DEFAULT 0," +
+				"`address` varchar(42) NOT NULL," +
+				"`topics` text NOT NULL," +
+				"PRIMARY KEY (`chain_id`, `address`)" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+		},
+		down: []string{
+			"DROP TABLE IF EXISTS `watch_list`",
+			"DROP TABLE IF EXISTS `contract_abi`",
+			"ALTER TABLE `logs` DROP COLUMN `chain_id`",
+			"ALTER TABLE `block_bloom` DROP COLUMN `chain_id`",
+		},
+	},
+	{
+		version: 3,
+		name:    "add query indexes",
+		up: []string{
+			"ALTER TABLE `block_bloom` " +
+				"ADD UNIQUE KEY `uk_block_bloom_number` (`chain_id`, `block_number`)," +
+				"ADD KEY `idx_block_bloom_hash` (`chain_id`, `block_hash`)",
+			"ALTER TABLE `logs` " +
+				"ADD KEY `idx_logs_block_number` (`chain_id`, `block_number`)," +
+				"ADD KEY `idx_logs_block_hash` (`chain_id`, `block_hash`)," +
+				"ADD KEY `idx_logs_tx_log` (`chain_id`, `tx_hash`, `log_index`)," +
+				"ADD KEY `idx_logs_address` (`chain_id`, `address`)," +
+				"ADD KEY `idx_logs_topic0` (`chain_id`, `topics`(66))",
+		},
+		down: []string{
+			"ALTER TABLE `logs` " +
+				"DROP KEY `idx_logs_topic0`," +
+				"DROP KEY `idx_logs_address`," +
+				"DROP KEY `idx_logs_tx_log`," +
+				"DROP KEY `idx_logs_block_hash`," +
+				"DROP KEY `idx_logs_block_number`",
+			"ALTER TABLE `block_bloom` " +
+				"DROP KEY `idx_block_bloom_hash`," +
+				"DROP KEY `uk_block_bloom_number`",
+		},
+	},
+	{
+		version: 4,
+		name:    "split topics into topic0..topic3",
+		up: []string{
+			"ALTER TABLE `logs` " +
+				"ADD COLUMN `topic0` varchar(66) NOT NULL DEFAULT '' AFTER `topics`," +
+				"ADD COLUMN `topic1` varchar(66) NOT NULL DEFAULT '' AFTER `topic0`," +
+				"ADD COLUMN `topic2` varchar(66) NOT NULL DEFAULT '' AFTER `topic1`," +
+				"ADD COLUMN `topic3` varchar(66) NOT NULL DEFAULT '' AFTER `topic2`",
+			"UPDATE `logs` SET " +
+				"`topic0` = SUBSTRING_INDEX(`topics`, ',', 1)," +
+				"`topic1` = IF(LENGTH(`topics`) - LENGTH(REPLACE(`topics`, ',', '')) >= 1, SUBSTRING_INDEX(SUBSTRING_INDEX(`topics`, ',', 2), ',', -1), '')," +
+				"`topic2` = IF(LENGTH(`topics`) - LENGTH(REPLACE(`topics`, ',', '')) >= 2, SUBSTRING_INDEX(SUBSTRING_INDEX(`topics`, ',', 3), ',', -1), '')," +
+				"`topic3` = IF(LENGTH(`topics`) - LENGTH(REPLACE(`topics`, ',', '')) >= 3, SUBSTRING_INDEX(SUBSTRING_INDEX(`topics`, ',', 4), ',', -1), '') " +
+				"WHERE `topics` <> ''",
+			"ALTER TABLE `logs` " +
+				"DROP KEY `idx_logs_topic0`," +
+				"DROP KEY `idx_logs_address`," +
+				"ADD KEY `idx_logs_address` (`chain_id`, `address`, `block_number`)," +
+				"ADD KEY `idx_logs_topic0` (`chain_id`, `topic0`, `block_number`)," +
+				"ADD KEY `idx_logs_topic1` (`chain_id`, `topic1`, `block_number`)," +
+				"ADD KEY `idx_logs_topic2` (`chain_id`, `topic2`, `block_number`)," +
+				"ADD KEY `idx_logs_topic3` (`chain_id`, `topic3`, `block_number`)",
+		},
+		down: []string{
+			"ALTER TABLE `logs` " +
+				"DROP KEY `idx_logs_topic3`," +
+				"DROP KEY `idx_logs_topic2`," +
+				"DROP KEY `idx_logs_topic1`," +
+				"DROP KEY `idx_logs_topic0`," +
+				"DROP KEY `idx_logs_address`," +
+				"ADD KEY `idx_logs_address` (`chain_id`, `address`)," +
+				"ADD KEY `idx_logs_topic0` (`chain_id`, `topics`(66))",
+			"ALTER TABLE `logs` " +
+				"DROP COLUMN `topic3`," +
+				"DROP COLUMN `topic2`," +
+				"DROP COLUMN `topic1`," +
+				"DROP COLUMN `topic0`",
+		},
+	},
+	{
+		version: 5,
+		name:    "add bloom_bits",
+		up: []string{
+			"CREATE TABLE IF NOT EXISTS `bloom_bits` (" +
+				"`chain_id` bigint NOT NULL DEFAULT 0," +
+				"`section` bigint NOT NULL," +
+				"`bit` smallint NOT NULL," +
+				"`bits` blob NOT NULL," +
+				"PRIMARY KEY (`chain_id`, `section`, `bit`)" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+		},
+		down: []string{
+			"DROP TABLE IF EXISTS `bloom_bits`",
+		},
+	},
+	{
+		version: 6,
+		name:    "add backfill_job and backfill_chunk",
+		up: []string{
+			"CREATE TABLE IF NOT EXISTS `backfill_job` (" +
+				"`id` bigint NOT NULL," +
+				"`chain_id` bigint NOT NULL DEFAULT 0," +
+				"`from_block` bigint NOT NULL," +
+				"`to_block` bigint NOT NULL," +
+				"`chunk_size` bigint NOT NULL," +
+				"`status` varchar(16) NOT NULL," +
+				"`error` text NOT NULL," +
+				"`created_at` datetime NOT NULL," +
+				"`updated_at` datetime NOT NULL," +
+				"PRIMARY KEY (`id`)," +
+				"KEY `idx_backfill_job_status` (`chain_id`, `status`)" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+			"CREATE TABLE IF NOT EXISTS `backfill_chunk` (" +
+				"`job_id` bigint NOT NULL," +
+				"`from_block` bigint NOT NULL," +
+				"PRIMARY KEY (`job_id`, `from_block`)" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+		},
+		down: []string{
+			"DROP TABLE IF EXISTS `backfill_chunk`",
+			"DROP TABLE IF EXISTS `backfill_job`",
+		},
+	},
+	{
+		version: 7,
+		name:    "unique logs by tx_hash and log_index",
+		up: []string{
+			// 同一log重复存储时保留未移除的一条，都未移除时保留最早的一条
+			"DELETE l1 FROM `logs` l1 JOIN `logs` l2 " +
+				"ON l1.chain_id = l2.chain_id AND l1.tx_hash = l2.tx_hash AND l1.log_index = l2.log_index " +
+				"WHERE (l1.removed = 'true' AND l2.removed = 'false') OR (l1.removed = l2.removed AND l1.id > l2.id)",
+			"ALTER TABLE `logs` " +
+				"DROP KEY `idx_logs_tx_log`," +
+				"ADD UNIQUE KEY `uk_logs_tx_log` (`chain_id`, `tx_hash`, `log_index`)",
+		},
+		down: []string{
+			"ALTER TABLE `logs` " +
+				"DROP KEY `uk_logs_tx_log`," +
+				"ADD KEY `idx_logs_tx_log` (`chain_id`, `tx_hash`, `log_index`)",
+		},
+	},
+	{
+		version: 8,
+		name:    "add block header columns to block_bloom",
+		up: []string{
+			"ALTER TABLE `block_bloom` " +
+				"ADD COLUMN `parent_hash` varchar(66) NOT NULL DEFAULT ''," +
+				"ADD COLUMN `timestamp` bigint unsigned NOT NULL DEFAULT 0," +
+				"ADD COLUMN `gas_limit` bigint unsigned NOT NULL DEFAULT 0," +
+				"ADD COLUMN `gas_used` bigint unsigned NOT NULL DEFAULT 0," +
+				"ADD COLUMN `miner` varchar(42) NOT NULL DEFAULT ''," +
+				"ADD COLUMN `extra_data` text NOT NULL",
+		},
+		down: []string{
+			"ALTER TABLE `block_bloom` " +
+				"DROP COLUMN `extra_data`," +
+				"DROP COLUMN `miner`," +
+				"DROP COLUMN `gas_used`," +
+				"DROP COLUMN `gas_limit`," +
+				"DROP COLUMN `timestamp`," +
+				"DROP COLUMN `parent_hash`",
+		},
+	},
+	{
+		version: 9,
+		name:    "add contract filter to backfill_job",
+		up: []string{
+			"ALTER TABLE `backfill_job` " +
+				"ADD COLUMN `address` varchar(42) NOT NULL DEFAULT '' AFTER `chunk_size`," +
+				"ADD COLUMN `topics` text NOT NULL AFTER `address`",
+		},
+		down: []string{
+			"ALTER TABLE `backfill_job` " +
+				"DROP COLUMN `topics`," +
+				"DROP COLUMN `address`",
+		},
+	},
+}
+
+func (s *mysqlStore) ensureSchemaVersion() error {
+	_, err := s.db.Exec("CREATE TABLE IF NOT EXISTS `schema_version` (" +
+		"`version` int NOT NULL," +
+		"`name` varchar(255) NOT NULL," +
+		"`applied_at` datetime NOT NULL," +
+		"PRIMARY KEY (`version`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
+	return err
+}
+
+// appliedVersions returns the applied versions with the time they were applied
+func (s *mysqlStore) appliedVersions() (map[int]time.Time, error) {
+	if err := s.ensureSchemaVersion(); err != nil {
+		return nil, errors.Wrap(err, "create schema_version")
+	}
+	rows, err := s.db.Query("SELECT version,applied_at FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt mysqlTime
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt.Time
+	}
+	return applied, rows.Err()
+}
+
+// MigrateUp 执行未应用的迁移直到target，target为0时执行全部
+func (s *mysqlStore) MigrateUp(target int) error {
+	applied, err := s.appliedVersions()
+	if err != nil {
+		return err
+	}
+	for _, m := range mysqlMigrations {
+		if _, ok := applied[m.version]; ok || (target > 0 && m.version > target) {
+			continue
+		}
+		for _, stmt := range m.up {
+			if _, err := s.db.Exec(stmt); err != nil {
+				return errors.Wrapf(err, "migration %d %s", m.version, m.name)
+			}
+		}
+		if _, err := s.db.Exec("INSERT INTO `schema_version`(`version`,`name`,`applied_at`) values (?,?,?)",
+			m.version, m.name, time.Now().UTC().Format(mysqlTimeLayout)); err != nil {
+			return errors.Wrapf(err, "record migration %d", m.version)
+		}
+		logger.Info("Migration applied", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+// MigrateDown 回滚target之后已应用的迁移
+func (s *mysqlStore) MigrateDown(target int) error {
+	applied, err := s.appliedVersions()
+	if err != nil {
+		return err
+	}
+	for i := len(mysqlMigrations) - 1; i >= 0; i-- {
+		m := mysqlMigrations[i]
+		if _, ok := applied[m.version]; !ok || m.version <= target {
+			continue
+		}
+		for _, stmt := range m.down {
+			if _, err := s.db.Exec(stmt); err != nil {
+				return errors.Wrapf(err, "revert migration %d %s", m.version, m.name)
+			}
+		}
+		if _, err := s.db.Exec("DELETE FROM `schema_version` WHERE `version` = ?", m.version); err != nil {
+			return errors.Wrapf(err, "record revert of migration %d", m.version)
+		}
+		logger.Info("Migration reverted", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+// MigrationStatus 获取所有迁移的状态
+func (s *mysqlStore) MigrationStatus() ([]MigrationStatus, error) {
+	applied, err := s.appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, 0, len(mysqlMigrations))
+	for _, m := range mysqlMigrations {
+		appliedAt, ok := applied[m.version]
+		status = append(status, MigrationStatus{Version: m.version, Name: m.name, Applied: ok, AppliedAt: appliedAt})
+	}
+	return status, nil
+}
+
+const mysqlTimeLayout = "2006-01-02 15:04:05"
+
+// mysqlTime scans a datetime column whether or not the DSN sets parseTime
+type mysqlTime struct {
+	time.Time
+}
+
+func (t *mysqlTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case time.Time:
+		t.Time = v
+	case []byte:
+		return t.parse(string(v))
+	case string:
+		return t.parse(v)
+	case nil:
+		t.Time = time.Time{}
+	default:
+		return errors.Errorf("unsupported time value %T", value)
+	}
+	return nil
+}
+
+func (t *mysqlTime) parse(str string) (err error) {
+	t.Time, err = time.ParseInLocation(mysqlTimeLayout, str, time.UTC)
+	return err
+}
+
+var _ sql.Scanner = (*mysqlTime)(nil)
@@ -0,0 +1,177 @@
+package dbdrive
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// schemaDB is a database/sql driver recording the executed migration statements
+// and keeping the schema_version table in memory
+type schemaDB struct {
+	mu       sync.Mutex
+	executed []string
+	versions map[int64]string // applied_at by version
+}
+
+func (d *schemaDB) Open(name string) (driver.Conn, error) { return d, nil }
+func (d *schemaDB) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+func (d *schemaDB) Close() error { return nil }
+func (d *schemaDB) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+func (d *schemaDB) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS `schema_version`"):
+	case strings.HasPrefix(query, "INSERT INTO `schema_version`"):
+		d.versions[args[0].Value.(int64)] = args[2].Value.(string)
+	case strings.HasPrefix(query, "DELETE FROM `schema_version`"):
+		delete(d.versions, args[0].Value.(int64))
+	default:
+		d.executed = append(d.executed, query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (d *schemaDB) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if query != "SELECT version,applied_at FROM schema_version" {
+		return nil, errors.New("unexpected query " + query)
+	}
+	rows := &versionRows{}
+	for version, appliedAt := range d.versions {
+		rows.values = append(rows.values, []driver.Value{version, []byte(appliedAt)})
+	}
+	return rows, nil
+}
+
+type versionRows struct {
+	values [][]driver.Value
+}
+
+func (r *versionRows) Columns() []string { return []string{"version", "applied_at"} }
+func (r *versionRows) Close() error      { return nil }
+func (r *versionRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func newSchemaStore(t *testing.T) (*mysqlStore, *schemaDB) {
+	d := &schemaDB{versions: make(map[int64]string)}
+	db := sql.OpenDB(connector{d})
+	t.Cleanup(func() { db.Close() })
+	return &mysqlStore{db: db}, d
+}
+
+// connector opens the connections of a store to its own schemaDB
+type connector struct{ d *schemaDB }
+
+func (c connector) Connect(context.Context) (driver.Conn, error) { return c.d, nil }
+func (c connector) Driver() driver.Driver                        { return c.d }
+
+// takeExecuted returns the statements executed since the last call
+func (d *schemaDB) takeExecuted() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	executed := d.executed
+	d.executed = nil
+	return executed
+}
+
+func TestMigrationVersions(t *testing.T) {
+	for i, m := range mysqlMigrations {
+		if m.version != i+1 || m.name == "" || len(m.up) == 0 || len(m.down) == 0 {
+			t.Errorf("mysql migration %d: version %d name %q with %d up and %d down statements",
+				i, m.version, m.name, len(m.up), len(m.down))
+		}
+	}
+	for i, m := range mongoMigrations {
+		if m.version != i+1 || m.name == "" || m.up == nil || m.down == nil {
+			t.Errorf("mongo migration %d: version %d name %q", i, m.version, m.name)
+		}
+	}
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	store, db := newSchemaStore(t)
+	statements := func(from, to int, down bool) []string {
+		var stmts []string
+		if down {
+			for v := to; v >= from; v-- {
+				stmts = append(stmts, mysqlMigrations[v-1].down...)
+			}
+			return stmts
+		}
+		for v := from; v <= to; v++ {
+			stmts = append(stmts, mysqlMigrations[v-1].up...)
+		}
+		return stmts
+	}
+	applied := func() []int {
+		status, err := store.MigrationStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var versions []int
+		for _, s := range status {
+			if s.Applied {
+				if s.AppliedAt.IsZero() {
+					t.Errorf("migration %d has no applied time", s.Version)
+				}
+				versions = append(versions, s.Version)
+			}
+		}
+		sort.Ints(versions)
+		return versions
+	}
+	latest := len(mysqlMigrations)
+	versions := func(from, to int) []int {
+		var v []int
+		for i := from; i <= to; i++ {
+			v = append(v, i)
+		}
+		return v
+	}
+
+	steps := []struct {
+		name    string
+		run     func() error
+		stmts   []string
+		applied []int
+	}{
+		{name: "up to 2", run: func() error { return store.MigrateUp(2) }, stmts: statements(1, 2, false), applied: versions(1, 2)},
+		{name: "up to latest", run: func() error { return store.MigrateUp(0) }, stmts: statements(3, latest, false), applied: versions(1, latest)},
+		{name: "up again", run: func() error { return store.MigrateUp(0) }, applied: versions(1, latest)},
+		{name: "down to 1", run: func() error { return store.MigrateDown(1) }, stmts: statements(2, latest, true), applied: versions(1, 1)},
+		{name: "down to 0", run: func() error { return store.MigrateDown(0) }, stmts: statements(1, 1, true)},
+		{name: "up after down", run: func() error { return store.MigrateUp(0) }, stmts: statements(1, latest, false), applied: versions(1, latest)},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := db.takeExecuted(); !reflect.DeepEqual(got, step.stmts) {
+			t.Errorf("%s: executed %d statements, want %d in migration order", step.name, len(got), len(step.stmts))
+		}
+		if got := applied(); !reflect.DeepEqual(got, step.applied) {
+			t.Errorf("%s: applied versions %v, want %v", step.name, got, step.applied)
+		}
+	}
+}
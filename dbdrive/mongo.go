@@ -0,0 +1,634 @@
+package dbdrive
+
+import (
+	"blockchain-event-plugin/logger"
+	"blockchain-event-plugin/setting"
+	"context"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mongoTimeout = 10 * time.Second
+
+	bloomCollection = "block_bloom"
+	logsCollection  = "logs"
+	abiCollection   = "contract_abi"
+	watchCollection = "watch_list"
+	bitsCollection  = "bloom_bits"
+	jobCollection   = "backfill_job"
+	chunkCollection = "backfill_chunk"
+)
+
+// mongoStore is the MongoDB implementation of Store, using the same
+// collection and field names as the MySQL tables.
+type mongoStore struct {
+	client  *mongo.Client
+	db      *mongo.Database
+	blooms  *mongo.Collection
+	logs    *mongo.Collection
+	abis    *mongo.Collection
+	watches *mongo.Collection
+	bits    *mongo.Collection
+	jobs    *mongo.Collection
+	chunks  *mongo.Collection
+
+	chainID int64 // every document carries the chain_id of the chain it belongs to
+
+	// txn is true when the deployment supports transactions (replica set or sharded cluster).
+	// Otherwise the bloom of a block is written after its logs, and the logs of a block are
+	// only returned once its bloom is stored.
+	txn bool
+}
+
+type mongoBloom struct {
+	ChainID     int64  `bson:"chain_id"`
+	BlockNumber int64  `bson:"block_number"`
+	BlockHash   string `bson:"block_hash"`
+	Bloom       string `bson:"bloom"`
+	ParentHash  string `bson:"parent_hash"`
+	Timestamp   uint64 `bson:"timestamp"`
+	GasLimit    uint64 `bson:"gas_limit"`
+	GasUsed     uint64 `bson:"gas_used"`
+	Miner       string `bson:"miner"`
+	ExtraData   string `bson:"extra_data"`
+}
+
+func (b *mongoBloom) toBlockBloom() BlockBloom {
+	return BlockBloom{
+		BlockNumber: b.BlockNumber,
+		BlockHash:   b.BlockHash,
+		Bloom:       b.Bloom,
+		ParentHash:  b.ParentHash,
+		Timestamp:   b.Timestamp,
+		GasLimit:    b.GasLimit,
+		GasUsed:     b.GasUsed,
+		Miner:       b.Miner,
+		ExtraData:   b.ExtraData,
+	}
+}
+
+type mongoLog struct {
+	ChainID     int64    `bson:"chain_id"`
+	Address     string   `bson:"address"`
+	Topics      []string `bson:"topics"`
+	Data        string   `bson:"data"`
+	BlockNumber int64    `bson:"block_number"`
+	TxHash      string   `bson:"tx_hash"`
+	TxIndex     string   `bson:"tx_index"`
+	BlockHash   string   `bson:"block_hash"`
+	LogIndex    int64    `bson:"log_index"`
+	Removed     bool     `bson:"removed"`
+}
+
+type mongoWatch struct {
+	ChainID int64    `bson:"chain_id"`
+	Address string   `bson:"address"`
+	Topics  []string `bson:"topics"`
+}
+
+// mongoBloomBits is a bloombits section, Bits holds the compressed bit vectors indexed by bloom bit
+type mongoBloomBits struct {
+	ChainID int64    `bson:"chain_id"`
+	Section int64    `bson:"section"`
+	Bits    [][]byte `bson:"bits"`
+}
+
+type mongoABI struct {
+	ChainID int64  `bson:"chain_id"`
+	Address string `bson:"address"`
+	ABI     string `bson:"abi"`
+}
+
+func (l *mongoLog) toLogs() Logs {
+	return Logs{
+		Address:     l.Address,
+		Topics:      l.Topics,
+		Data:        l.Data,
+		BlockNumber: toHex(int(l.BlockNumber)),
+		TxHash:      l.TxHash,
+		TxIndex:     l.TxIndex,
+		BlockHash:   l.BlockHash,
+		LogIndex:    hexutil.Uint64(l.LogIndex).String(),
+		Removed:     l.Removed,
+	}
+}
+
+// NewMongoStore 开启MongoDB的链接并创建索引
+func NewMongoStore() (Store, error) {
+	uri := setting.GetString("mongodb.uri")
+	if uri == "" {
+		uri = os.Getenv("MongoURI")
+		logger.Info("Command line get MongoURI:", uri)
+	}
+	database := setting.GetString("mongodb.database")
+	if database == "" {
+		database = "cmp_chain"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	if err = client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, wrapErr(err)
+	}
+
+	db := client.Database(database)
+	s := &mongoStore{
+		client:  client,
+		db:      db,
+		blooms:  db.Collection(bloomCollection),
+		logs:    db.Collection(logsCollection),
+		abis:    db.Collection(abiCollection),
+		watches: db.Collection(watchCollection),
+		bits:    db.Collection(bitsCollection),
+		jobs:    db.Collection(jobCollection),
+		chunks:  db.Collection(chunkCollection),
+	}
+	if err = s.createIndexes(ctx); err != nil {
+		client.Disconnect(context.Background())
+		return nil, wrapErr(err)
+	}
+	if s.txn, err = s.supportsTransactions(ctx); err != nil {
+		client.Disconnect(context.Background())
+		return nil, wrapErr(err)
+	}
+
+	logger.Info("MongoDB connection successful！", "transactions", s.txn)
+	return s, nil
+}
+
+func (s *mongoStore) createIndexes(ctx context.Context) error {
+	_, err := s.blooms.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "chain_id", Value: 1}, {Key: "block_number", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "chain_id", Value: 1}, {Key: "block_hash", Value: 1}}},
+	})
+	if err != nil {
+		return wrapErr(err)
+	}
+	_, err = s.logs.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "chain_id", Value: 1}, {Key: "block_number", Value: 1}, {Key: "log_index", Value: 1}}},
+		{Keys: bson.D{{Key: "chain_id", Value: 1}, {Key: "address", Value: 1}, {Key: "block_number", Value: 1}}},
+		{Keys: bson.D{{Key: "chain_id", Value: 1}, {Key: "topics.0", Value: 1}, {Key: "block_number", Value: 1}}},
+	})
+	if err != nil {
+		return wrapErr(err)
+	}
+	_, err = s.abis.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "chain_id", Value: 1}, {Key: "address", Value: 1}}, Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return wrapErr(err)
+	}
+	_, err = s.watches.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "chain_id", Value: 1}, {Key: "address", Value: 1}}, Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return wrapErr(err)
+	}
+	_, err = s.bits.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "chain_id", Value: 1}, {Key: "section", Value: 1}}, Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return wrapErr(err)
+	}
+	_, err = s.jobs.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "chain_id", Value: 1}, {Key: "status", Value: 1}},
+	})
+	if err != nil {
+		return wrapErr(err)
+	}
+	_, err = s.chunks.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "job_id", Value: 1}, {Key: "from_block", Value: 1}}, Options: options.Index().SetUnique(true),
+	})
+	return wrapErr(err)
+}
+
+// supportsTransactions 副本集和分片集群支持事务，单机部署不支持
+func (s *mongoStore) supportsTransactions(ctx context.Context) (bool, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := s.db.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello); err != nil {
+		return false, err
+	}
+	return hello.SetName != "" || hello.Msg == "isdbgrid", nil
+}
+
+// inTransaction 支持事务时在事务中执行fn，否则直接执行
+func (s *mongoStore) inTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !s.txn {
+		return fn(ctx)
+	}
+	session, err := s.client.StartSession()
+	if err != nil {
+		return wrapErr(err)
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	})
+	return wrapErr(err)
+}
+
+// withBlooms 不支持事务时logs可能先于区块bloom写入，只返回bloom已写入的区块的logs
+func (s *mongoStore) withBlooms(ctx context.Context, logs []Logs) ([]Logs, error) {
+	if s.txn || len(logs) == 0 {
+		return logs, nil
+	}
+	numbers := make([]int64, 0, len(logs))
+	for _, log := range logs {
+		number, err := hexutil.DecodeUint64(log.BlockNumber)
+		if err != nil {
+			return nil, invalidData(err)
+		}
+		numbers = append(numbers, int64(number))
+	}
+	filter := bson.M{"chain_id": s.chainID, "block_number": bson.M{"$in": numbers}}
+	cursor, err := s.blooms.Find(ctx, filter, options.Find().SetProjection(bson.M{"block_number": 1, "block_hash": 1}))
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer cursor.Close(ctx)
+	stored := make(map[string]bool)
+	for cursor.Next(ctx) {
+		var bloom mongoBloom
+		if err := cursor.Decode(&bloom); err != nil {
+			return nil, invalidData(err)
+		}
+		stored[strings.ToLower(bloom.BlockHash)] = true
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, wrapErr(err)
+	}
+
+	present := logs[:0]
+	for _, log := range logs {
+		if stored[strings.ToLower(log.BlockHash)] {
+			present = append(present, log)
+		}
+	}
+	return present, nil
+}
+
+// Chain 返回指定链的存储，共用数据库连接
+func (s *mongoStore) Chain(chainID int64) Store {
+	chain := *s
+	chain.chainID = chainID
+	return &chain
+}
+
+// Ping 检查数据库连接
+func (s *mongoStore) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	return wrapErr(s.client.Ping(ctx, nil))
+}
+
+// Close 关闭数据库连接
+func (s *mongoStore) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	return s.client.Disconnect(ctx)
+}
+
+// findBloom returns the bloom matching the filter, or ErrNotFound if there is none
+func (s *mongoStore) findBloom(filter bson.M, opts ...*options.FindOneOptions) (bloom mongoBloom, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	err = s.blooms.FindOne(ctx, filter, opts...).Decode(&bloom)
+	return bloom, wrapErr(err)
+}
+
+// findLogs returns the logs matching the filter ordered by block number and log index
+func (s *mongoStore) findLogs(ctx context.Context, filter bson.M, opts ...*options.FindOptions) ([]Logs, error) {
+	sort := options.Find().SetSort(bson.D{{Key: "block_number", Value: 1}, {Key: "log_index", Value: 1}})
+	cursor, err := s.logs.Find(ctx, filter, append([]*options.FindOptions{sort}, opts...)...)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer cursor.Close(ctx)
+
+	var logs []Logs
+	for cursor.Next(ctx) {
+		var log mongoLog
+		if err := cursor.Decode(&log); err != nil {
+			return nil, invalidData(err)
+		}
+		logs = append(logs, log.toLogs())
+	}
+	return logs, wrapErr(cursor.Err())
+}
+
+// GetBloomByBlockNumber
+func (s *mongoStore) GetBloomByBlockNumber(blockNum int64) (string, error) {
+	bloom, err := s.findBloom(bson.M{"chain_id": s.chainID, "block_number": blockNum})
+	return bloom.Bloom, err
+}
+
+// GetBlockNumAndBloomByBlockHash
+func (s *mongoStore) GetBlockNumAndBloomByBlockHash(blockHash string) (BlockBloom, error) {
+	bloom, err := s.findBloom(bson.M{"chain_id": s.chainID, "block_hash": blockHash})
+	return BlockBloom{BlockNumber: bloom.BlockNumber, BlockHash: bloom.BlockHash, Bloom: bloom.Bloom}, err
+}
+
+// GetBlockByNumber 获取区块bloom和区块头
+func (s *mongoStore) GetBlockByNumber(blockNum int64) (BlockBloom, error) {
+	bloom, err := s.findBloom(bson.M{"chain_id": s.chainID, "block_number": blockNum})
+	return bloom.toBlockBloom(), err
+}
+
+// GetBlockByHash 根据区块hash获取区块bloom和区块头
+func (s *mongoStore) GetBlockByHash(blockHash string) (BlockBloom, error) {
+	bloom, err := s.findBloom(bson.M{"chain_id": s.chainID, "block_hash": blockHash})
+	return bloom.toBlockBloom(), err
+}
+
+// GetBlockHashByBlockNumber
+func (s *mongoStore) GetBlockHashByBlockNumber(blockNum int64) (string, error) {
+	bloom, err := s.findBloom(bson.M{"chain_id": s.chainID, "block_number": blockNum})
+	return bloom.BlockHash, err
+}
+
+// GetBlockHashesByRange 获取(from, to]区间内的区块hash
+func (s *mongoStore) GetBlockHashesByRange(from, to int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	filter := bson.M{"chain_id": s.chainID, "block_number": bson.M{"$gt": from, "$lte": to}}
+	opts := options.Find().SetSort(bson.D{{Key: "block_number", Value: 1}})
+	cursor, err := s.blooms.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer cursor.Close(ctx)
+
+	var blockHashes []string
+	for cursor.Next(ctx) {
+		var bloom mongoBloom
+		if err := cursor.Decode(&bloom); err != nil {
+			return nil, invalidData(err)
+		}
+		blockHashes = append(blockHashes, bloom.BlockHash)
+	}
+	return blockHashes, wrapErr(cursor.Err())
+}
+
+// GetBloomsByRange 获取[from, to]区间内的区块bloom，按区块高度排序
+func (s *mongoStore) GetBloomsByRange(from, to int64) ([]BlockBloom, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	filter := bson.M{"chain_id": s.chainID, "block_number": bson.M{"$gte": from, "$lte": to}}
+	opts := options.Find().SetSort(bson.D{{Key: "block_number", Value: 1}})
+	cursor, err := s.blooms.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer cursor.Close(ctx)
+
+	var blooms []BlockBloom
+	for cursor.Next(ctx) {
+		var bloom mongoBloom
+		if err := cursor.Decode(&bloom); err != nil {
+			return nil, invalidData(err)
+		}
+		blooms = append(blooms, BlockBloom{BlockNumber: bloom.BlockNumber, BlockHash: bloom.BlockHash, Bloom: bloom.Bloom})
+	}
+	return blooms, wrapErr(cursor.Err())
+}
+
+// GetLogsByBlockNumber
+func (s *mongoStore) GetLogsByBlockNumber(blockNumber int64) ([]Logs, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	logs, err := s.findLogs(ctx, bson.M{"chain_id": s.chainID, "block_number": blockNumber, "removed": false})
+	if err != nil {
+		return nil, err
+	}
+	return s.withBlooms(ctx, logs)
+}
+
+// GetLogsByRange 区间查询logs，地址和topic条件在数据库中过滤
+func (s *mongoStore) GetLogsByRange(q LogQuery) ([]Logs, error) {
+	if q.Empty() {
+		return nil, nil
+	}
+	filter := bson.M{
+		"chain_id":     s.chainID,
+		"block_number": bson.M{"$gte": q.FromBlock, "$lte": q.ToBlock},
+		"removed":      false,
+	}
+	if len(q.Heights) > 0 {
+		filter["block_number"] = bson.M{"$gte": q.FromBlock, "$lte": q.ToBlock, "$in": q.Heights}
+	}
+	if len(q.Addresses) > 0 {
+		filter["address"] = bson.M{"$in": q.Addresses}
+	}
+	for i, sub := range q.Topics {
+		if len(sub) > 0 {
+			filter["topics."+strconv.Itoa(i)] = bson.M{"$in": sub}
+		}
+	}
+	if n := len(q.Topics); n > 0 && len(q.Topics[n-1]) == 0 {
+		filter["topics."+strconv.Itoa(n-1)] = bson.M{"$exists": true}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	logs, err := s.findLogs(ctx, filter, options.Find().SetLimit(int64(q.Limit)))
+	if err != nil {
+		return nil, err
+	}
+	return s.withBlooms(ctx, logs)
+}
+
+// GetBlockHeight
+func (s *mongoStore) GetBlockHeight() (int64, error) {
+	opts := options.FindOne().SetSort(bson.D{{Key: "block_number", Value: -1}})
+	bloom, err := s.findBloom(bson.M{"chain_id": s.chainID}, opts)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	return bloom.BlockNumber, err
+}
+
+// SaveLogs 批量保存logs
+func (s *mongoStore) SaveLogs(logs []ethtypes.Log) error {
+	return s.SaveBlocks(nil, logs)
+}
+
+// SaveBlocks 批量保存logs和区块bloom，按唯一键upsert保证重复写入幂等。
+// 支持事务时在一个事务中写入；单机部署不支持事务，bloom在logs之后写入，
+// 读取logs时只返回bloom已写入的区块，中途失败时同步会重新写入该区块
+func (s *mongoStore) SaveBlocks(blooms []BlockBloom, logs []ethtypes.Log) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	return s.inTransaction(ctx, func(ctx context.Context) error {
+		return s.saveBlocks(ctx, blooms, logs)
+	})
+}
+
+func (s *mongoStore) saveBlocks(ctx context.Context, blooms []BlockBloom, logs []ethtypes.Log) error {
+	if len(logs) > 0 {
+		models := make([]mongo.WriteModel, 0, len(logs))
+		for _, value := range logs {
+			topics := make([]string, len(value.Topics))
+			for i, topic := range value.Topics {
+				topics[i] = topic.String()
+			}
+			doc := mongoLog{
+				ChainID:     s.chainID,
+				Address:     strings.ToLower(value.Address.String()),
+				Topics:      topics,
+				Data:        "0x" + fmt.Sprintf("%x", value.Data),
+				BlockNumber: int64(value.BlockNumber),
+				TxHash:      value.TxHash.String(),
+				TxIndex:     hexutil.Uint64(value.TxIndex).String(),
+				BlockHash:   value.BlockHash.String(),
+				LogIndex:    int64(value.Index),
+				Removed:     value.Removed,
+			}
+			filter := bson.M{"chain_id": s.chainID, "tx_hash": doc.TxHash, "log_index": doc.LogIndex}
+			models = append(models, mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(doc).SetUpsert(true))
+		}
+		if _, err := s.logs.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+			return wrapErr(err)
+		}
+	}
+
+	if len(blooms) > 0 {
+		// 先删除区块所在section的索引，bloom写入前section不完整，不会被重新索引
+		filter := bson.M{"chain_id": s.chainID, "section": bson.M{"$in": bloomSections(blooms)}}
+		if _, err := s.bits.DeleteMany(ctx, filter); err != nil {
+			return wrapErr(err)
+		}
+		models := make([]mongo.WriteModel, 0, len(blooms))
+		for _, bloom := range blooms {
+			doc := mongoBloom{ChainID: s.chainID, BlockNumber: bloom.BlockNumber, BlockHash: bloom.BlockHash, Bloom: bloom.Bloom,
+				ParentHash: bloom.ParentHash, Timestamp: bloom.Timestamp, GasLimit: bloom.GasLimit, GasUsed: bloom.GasUsed,
+				Miner: bloom.Miner, ExtraData: bloom.ExtraData}
+			filter := bson.M{"chain_id": s.chainID, "block_number": bloom.BlockNumber}
+			models = append(models, mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(doc).SetUpsert(true))
+		}
+		if _, err := s.blooms.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+			return wrapErr(err)
+		}
+	}
+	return nil
+}
+
+// RollbackBlocks 链重组时回滚ancestor之后的区块：logs标记为removed，删除block_bloom，返回被移除的logs。
+// 支持事务时在一个事务中执行；单机部署不支持事务，中途失败时重复执行即可完成回滚
+func (s *mongoStore) RollbackBlocks(ancestor int64) (removed []Logs, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	err = s.inTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		removed, err = s.rollbackBlocks(ctx, ancestor)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Rollback blocks successful", "ancestor", ancestor, "removedLogs", len(removed))
+	return removed, nil
+}
+
+func (s *mongoStore) rollbackBlocks(ctx context.Context, ancestor int64) ([]Logs, error) {
+	filter := bson.M{"chain_id": s.chainID, "block_number": bson.M{"$gt": ancestor}, "removed": false}
+	removed, err := s.findLogs(ctx, filter)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	for i := range removed {
+		removed[i].Removed = true
+	}
+
+	if _, err = s.logs.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"removed": true}}); err != nil {
+		return nil, wrapErr(err)
+	}
+	if _, err = s.blooms.DeleteMany(ctx, bson.M{"chain_id": s.chainID, "block_number": bson.M{"$gt": ancestor}}); err != nil {
+		return nil, wrapErr(err)
+	}
+	if _, err = s.bits.DeleteMany(ctx, bson.M{"chain_id": s.chainID, "section": bson.M{"$gte": bloomBitsSection(ancestor + 1)}}); err != nil {
+		return nil, wrapErr(err)
+	}
+	return removed, nil
+}
+
+// SaveABI 保存合约ABI，地址已存在时覆盖
+func (s *mongoStore) SaveABI(address, abiJSON string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	address = strings.ToLower(address)
+	_, err := s.abis.ReplaceOne(ctx, bson.M{"chain_id": s.chainID, "address": address}, mongoABI{ChainID: s.chainID, Address: address, ABI: abiJSON},
+		options.Replace().SetUpsert(true))
+	return wrapErr(err)
+}
+
+// GetABI 获取合约ABI，未注册时返回空字符串
+func (s *mongoStore) GetABI(address string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	var doc mongoABI
+	err := s.abis.FindOne(ctx, bson.M{"chain_id": s.chainID, "address": strings.ToLower(address)}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	return doc.ABI, wrapErr(err)
+}
+
+// GetWatchList 获取监听的合约列表
+func (s *mongoStore) GetWatchList() ([]Watch, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	cursor, err := s.watches.Find(ctx, bson.M{"chain_id": s.chainID}, options.Find().SetSort(bson.D{{Key: "address", Value: 1}}))
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer cursor.Close(ctx)
+
+	var watches []Watch
+	for cursor.Next(ctx) {
+		var doc mongoWatch
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, invalidData(err)
+		}
+		watches = append(watches, Watch{Address: doc.Address, Topics: doc.Topics})
+	}
+	return watches, wrapErr(cursor.Err())
+}
+
+// SaveWatch 保存监听的合约，地址已存在时覆盖topics
+func (s *mongoStore) SaveWatch(watch Watch) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	address := strings.ToLower(watch.Address)
+	_, err := s.watches.ReplaceOne(ctx, bson.M{"chain_id": s.chainID, "address": address}, mongoWatch{ChainID: s.chainID, Address: address, Topics: watch.Topics},
+		options.Replace().SetUpsert(true))
+	return wrapErr(err)
+}
+
+// DeleteWatch 删除监听的合约，已存储的logs保留
+func (s *mongoStore) DeleteWatch(address string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := s.watches.DeleteOne(ctx, bson.M{"chain_id": s.chainID, "address": strings.ToLower(address)})
+	return wrapErr(err)
+}
@@ -0,0 +1,272 @@
+package dbdrive
+
+import (
+	"blockchain-event-plugin/logger"
+	"context"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const (
+	schemaVersionCollection = "schema_version"
+	migrationTimeout        = 10 * time.Minute
+)
+
+// mongoMigration is a MongoDB migration, the collection indexes are created when the
+// store is opened, except the unique ones that existing documents may violate.
+type mongoMigration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, db *mongo.Database) error
+	down    func(ctx context.Context, db *mongo.Database) error
+}
+
+type mongoSchemaVersion struct {
+	Version   int       `bson:"version"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+var mongoMigrations = []mongoMigration{
+	{
+		version: 1,
+		name:    "partition by chain_id",
+		up: func(ctx context.Context, db *mongo.Database) error {
+			// 单链部署的历史数据归属chain 0
+			missing := bson.M{"chain_id": bson.M{"$exists": false}}
+			for _, name := range []string{bloomCollection, logsCollection, abiCollection, watchCollection} {
+				if _, err := db.Collection(name).UpdateMany(ctx, missing, bson.M{"$set": bson.M{"chain_id": int64(0)}}); err != nil {
+					return errors.Wrapf(err, "set chain_id of %s", name)
+				}
+			}
+			// 旧版本按block_number建立的唯一索引会阻止多链写入
+			return dropIndexIfExists(ctx, db.Collection(bloomCollection), "block_number_1")
+		},
+		down: func(ctx context.Context, db *mongo.Database) error {
+			return nil
+		},
+	},
+	{
+		version: 2,
+		name:    "unique logs by tx_hash and log_index",
+		up: func(ctx context.Context, db *mongo.Database) error {
+			logs := db.Collection(logsCollection)
+			if err := dedupLogs(ctx, logs); err != nil {
+				return errors.Wrap(err, "remove duplicate logs")
+			}
+			if err := dropIndexIfExists(ctx, logs, "chain_id_1_tx_hash_1_log_index_1"); err != nil {
+				return err
+			}
+			_, err := logs.Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "chain_id", Value: 1}, {Key: "tx_hash", Value: 1}, {Key: "log_index", Value: 1}},
+				Options: options.Index().SetName("uk_logs_tx_log").SetUnique(true),
+			})
+			return err
+		},
+		down: func(ctx context.Context, db *mongo.Database) error {
+			logs := db.Collection(logsCollection)
+			if err := dropIndexIfExists(ctx, logs, "uk_logs_tx_log"); err != nil {
+				return err
+			}
+			_, err := logs.Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "chain_id", Value: 1}, {Key: "tx_hash", Value: 1}, {Key: "log_index", Value: 1}},
+			})
+			return err
+		},
+	},
+	{
+		version: 3,
+		name:    "store log_index as a number",
+		up: func(ctx context.Context, db *mongo.Database) error {
+			logs := db.Collection(logsCollection)
+			if err := convertLogIndexes(ctx, logs, "string"); err != nil {
+				return errors.Wrap(err, "convert log_index to number")
+			}
+			// 查询按block_number和log_index排序
+			return dropIndexIfExists(ctx, logs, "chain_id_1_block_number_1")
+		},
+		down: func(ctx context.Context, db *mongo.Database) error {
+			return convertLogIndexes(ctx, db.Collection(logsCollection), "long")
+		},
+	},
+}
+
+func dropIndexIfExists(ctx context.Context, coll *mongo.Collection, name string) error {
+	_, err := coll.Indexes().DropOne(ctx, name)
+	if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Name == "IndexNotFound" {
+		return nil
+	}
+	return err
+}
+
+// dedupLogs 同一log重复存储时保留未移除的一条，都未移除时保留最早的一条
+func dedupLogs(ctx context.Context, logs *mongo.Collection) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "removed", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "chain_id", Value: "$chain_id"}, {Key: "tx_hash", Value: "$tx_hash"}, {Key: "log_index", Value: "$log_index"}}},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+	}
+	cursor, err := logs.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var group struct {
+			IDs []interface{} `bson:"ids"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return err
+		}
+		if _, err := logs.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": group.IDs[1:]}}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// convertLogIndexes 将bsonType类型的log_index在十六进制字符串和数值之间转换
+func convertLogIndexes(ctx context.Context, logs *mongo.Collection, bsonType string) error {
+	cursor, err := logs.Find(ctx, bson.M{"log_index": bson.M{"$type": bsonType}},
+		options.Find().SetProjection(bson.M{"log_index": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	models := make([]mongo.WriteModel, 0, saveBatch)
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := logs.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		models = models[:0]
+		return err
+	}
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID       interface{} `bson:"_id"`
+			LogIndex interface{} `bson:"log_index"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		var value interface{}
+		switch index := doc.LogIndex.(type) {
+		case string:
+			number, err := hexutil.DecodeUint64(index)
+			if err != nil {
+				return errors.Wrapf(err, "invalid log_index %q", index)
+			}
+			value = int64(number)
+		case int64:
+			value = hexutil.Uint64(index).String()
+		default:
+			return errors.Errorf("unexpected log_index %T", doc.LogIndex)
+		}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": doc.ID}).SetUpdate(bson.M{"$set": bson.M{"log_index": value}}))
+		if len(models) == saveBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+func (s *mongoStore) appliedVersions(ctx context.Context) (map[int]time.Time, error) {
+	cursor, err := s.db.Collection(schemaVersionCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	applied := make(map[int]time.Time)
+	for cursor.Next(ctx) {
+		var doc mongoSchemaVersion
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		applied[doc.Version] = doc.AppliedAt
+	}
+	return applied, cursor.Err()
+}
+
+// MigrateUp 执行未应用的迁移直到target，target为0时执行全部
+func (s *mongoStore) MigrateUp(target int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+
+	applied, err := s.appliedVersions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range mongoMigrations {
+		if _, ok := applied[m.version]; ok || (target > 0 && m.version > target) {
+			continue
+		}
+		if err := m.up(ctx, s.db); err != nil {
+			return errors.Wrapf(err, "migration %d %s", m.version, m.name)
+		}
+		doc := mongoSchemaVersion{Version: m.version, Name: m.name, AppliedAt: time.Now().UTC()}
+		if _, err := s.db.Collection(schemaVersionCollection).InsertOne(ctx, doc); err != nil {
+			return errors.Wrapf(err, "record migration %d", m.version)
+		}
+		logger.Info("Migration applied", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+// MigrateDown 回滚target之后已应用的迁移
+func (s *mongoStore) MigrateDown(target int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+
+	applied, err := s.appliedVersions(ctx)
+	if err != nil {
+		return err
+	}
+	for i := len(mongoMigrations) - 1; i >= 0; i-- {
+		m := mongoMigrations[i]
+		if _, ok := applied[m.version]; !ok || m.version <= target {
+			continue
+		}
+		if err := m.down(ctx, s.db); err != nil {
+			return errors.Wrapf(err, "revert migration %d %s", m.version, m.name)
+		}
+		if _, err := s.db.Collection(schemaVersionCollection).DeleteOne(ctx, bson.M{"version": m.version}); err != nil {
+			return errors.Wrapf(err, "record revert of migration %d", m.version)
+		}
+		logger.Info("Migration reverted", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+// MigrationStatus 获取所有迁移的状态
+func (s *mongoStore) MigrationStatus() ([]MigrationStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	applied, err := s.appliedVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, 0, len(mongoMigrations))
+	for _, m := range mongoMigrations {
+		appliedAt, ok := applied[m.version]
+		status = append(status, MigrationStatus{Version: m.version, Name: m.name, Applied: ok, AppliedAt: appliedAt})
+	}
+	return status, nil
+}
@@ -0,0 +1,145 @@
+package dbdrive
+
+import (
+	"database/sql"
+	"strings"
+)
+
+const (
+	// MaxTopics is the number of topic columns, a log has at most 4 topics
+	MaxTopics = 4
+
+	// saveBatch is the number of rows written by a single INSERT
+	saveBatch = 500
+)
+
+// LogQuery selects the non-removed logs of a block range. Addresses and the topic
+// sets of every position are OR-ed, an empty set matches anything, following the
+// semantics of eth_getLogs.
+type LogQuery struct {
+	FromBlock int64
+	ToBlock   int64
+	Addresses []string   // lowercase hex addresses
+	Topics    [][]string // lowercase hex topics by position
+	Heights   []int64    // restricts the range to these blocks when set
+	Limit     int        // max number of logs returned, 0 for no limit
+}
+
+// Empty reports whether the query can not match any log
+func (q LogQuery) Empty() bool {
+	return q.FromBlock > q.ToBlock || len(q.Topics) > MaxTopics
+}
+
+// topicColumns 将topics拆分为topic0..topic3列的值
+func topicColumns(topics []string) [MaxTopics]string {
+	var columns [MaxTopics]string
+	copy(columns[:], topics)
+	return columns
+}
+
+// buildLogsQuery 根据LogQuery生成区间查询的SQL，地址和topic条件下推到数据库
+func buildLogsQuery(chainID int64, q LogQuery) (string, []interface{}) {
+	var b strings.Builder
+	args := []interface{}{chainID, q.FromBlock, q.ToBlock}
+	b.WriteString("SELECT address,topics,`data`,block_number,tx_hash,tx_index,block_hash,log_index,removed FROM logs " +
+		"WHERE chain_id = ? AND block_number >= ? AND block_number <= ? AND removed = 'false'")
+
+	if len(q.Heights) > 0 {
+		b.WriteString(" AND block_number IN (" + placeholders(len(q.Heights)) + ")")
+		for _, height := range q.Heights {
+			args = append(args, height)
+		}
+	}
+	if len(q.Addresses) > 0 {
+		b.WriteString(" AND address IN (" + placeholders(len(q.Addresses)) + ")")
+		for _, address := range q.Addresses {
+			args = append(args, address)
+		}
+	}
+	for i, sub := range q.Topics {
+		if len(sub) == 0 {
+			continue
+		}
+		b.WriteString(" AND topic" + string(rune('0'+i)) + " IN (" + placeholders(len(sub)) + ")")
+		for _, topic := range sub {
+			args = append(args, topic)
+		}
+	}
+	// 过滤条件的topic个数多于log的topic个数时不匹配，末位为通配时要求该位置存在topic
+	if n := len(q.Topics); n > 0 && len(q.Topics[n-1]) == 0 {
+		b.WriteString(" AND topic" + string(rune('0'+n-1)) + " <> ''")
+	}
+
+	// log_index为不带前导0的十六进制，先比较长度再比较字符串即为数值顺序
+	b.WriteString(" ORDER BY block_number, LENGTH(log_index), log_index")
+	if q.Limit > 0 {
+		b.WriteString(" LIMIT ?")
+		args = append(args, q.Limit)
+	}
+	return b.String(), args
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// valueRows returns the VALUES rows of a multi-row INSERT of n rows with the given columns
+func valueRows(n, columns int) string {
+	return strings.TrimSuffix(strings.Repeat("("+placeholders(columns)+"),", n), ",")
+}
+
+// scanLogs 读取logs查询结果
+func scanLogs(rows *sql.Rows) ([]Logs, error) {
+	var logs []Logs
+	for rows.Next() {
+		var log Logs
+		var topic string
+		var blockNumber int
+		var address string
+		if err := rows.Scan(&address, &topic, &log.Data, &blockNumber, &log.TxHash, &log.TxIndex, &log.BlockHash, &log.LogIndex, &log.Removed); err != nil {
+			return nil, invalidData(err)
+		}
+		log.Address = strings.ToLower(address)
+		log.Topics = []string{}
+		if topic != "" {
+			log.Topics = strings.Split(topic, ",")
+		}
+		log.BlockNumber = toHex(blockNumber)
+		logs = append(logs, log)
+	}
+	return logs, wrapErr(rows.Err())
+}
+
+// GetLogsByRange 区间查询logs，地址和topic条件在数据库中过滤
+func (s *mysqlStore) GetLogsByRange(q LogQuery) ([]Logs, error) {
+	if q.Empty() {
+		return nil, nil
+	}
+	query, args := buildLogsQuery(s.chainID, q)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer rows.Close()
+	return scanLogs(rows)
+}
+
+// GetBloomsByRange 获取[from, to]区间内的区块bloom，按区块高度排序
+func (s *mysqlStore) GetBloomsByRange(from, to int64) ([]BlockBloom, error) {
+	rows, err := s.db.Query("SELECT block_number,block_hash,bloom FROM block_bloom WHERE chain_id = ? AND block_number >= ? AND block_number <= ? order by block_number",
+		s.chainID, from, to)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer rows.Close()
+
+	var blooms []BlockBloom
+	for rows.Next() {
+		var bloom BlockBloom
+		if err := rows.Scan(&bloom.BlockNumber, &bloom.BlockHash, &bloom.Bloom); err != nil {
+			return nil, invalidData(err)
+		}
+		blooms = append(blooms, bloom)
+	}
+	return blooms, wrapErr(rows.Err())
+}
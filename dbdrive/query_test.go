@@ -0,0 +1,67 @@
+package dbdrive
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildLogsQuery(t *testing.T) {
+	const selectLogs = "SELECT address,topics,`data`,block_number,tx_hash,tx_index,block_hash,log_index,removed FROM logs " +
+		"WHERE chain_id = ? AND block_number >= ? AND block_number <= ? AND removed = 'false'"
+	const orderBy = " ORDER BY block_number, LENGTH(log_index), log_index"
+
+	tests := []struct {
+		name  string
+		query LogQuery
+		where string
+		args  []interface{}
+	}{
+		{
+			name:  "range",
+			query: LogQuery{FromBlock: 10, ToBlock: 20},
+			args:  []interface{}{int64(1), int64(10), int64(20)},
+		},
+		{
+			name:  "heights and addresses",
+			query: LogQuery{FromBlock: 10, ToBlock: 20, Heights: []int64{12, 15}, Addresses: []string{"0xa", "0xb"}},
+			where: " AND block_number IN (?,?) AND address IN (?,?)",
+			args:  []interface{}{int64(1), int64(10), int64(20), int64(12), int64(15), "0xa", "0xb"},
+		},
+		{
+			name:  "topics with wildcard",
+			query: LogQuery{FromBlock: 10, ToBlock: 20, Topics: [][]string{nil, {"0x1", "0x2"}, {"0x3"}}},
+			where: " AND topic1 IN (?,?) AND topic2 IN (?)",
+			args:  []interface{}{int64(1), int64(10), int64(20), "0x1", "0x2", "0x3"},
+		},
+		{
+			// 末位为通配时要求该位置存在topic
+			name:  "trailing wildcard",
+			query: LogQuery{FromBlock: 10, ToBlock: 20, Topics: [][]string{{"0x1"}, nil}},
+			where: " AND topic0 IN (?) AND topic1 <> ''",
+			args:  []interface{}{int64(1), int64(10), int64(20), "0x1"},
+		},
+		{
+			name:  "limit",
+			query: LogQuery{FromBlock: 10, ToBlock: 20, Addresses: []string{"0xa"}, Limit: 100},
+			where: " AND address IN (?)",
+			args:  []interface{}{int64(1), int64(10), int64(20), "0xa", 100},
+		},
+	}
+	for _, test := range tests {
+		query, args := buildLogsQuery(1, test.query)
+		want := selectLogs + test.where + orderBy
+		if test.query.Limit > 0 {
+			want += " LIMIT ?"
+		}
+		if query != want {
+			t.Errorf("%s: got query\n%s\nwant\n%s", test.name, query, want)
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: got args %v, want %v", test.name, args, test.args)
+		}
+		if n := strings.Count(query, "?"); n != len(args) {
+			t.Errorf("%s: %d placeholders for %d args", test.name, n, len(args))
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package dbdrive
+
+import (
+	"blockchain-event-plugin/setting"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	DriverMySQL   = "mysql"
+	DriverMongoDB = "mongodb"
+)
+
+// Store is the storage of the synced block blooms and logs of a single chain. Logs
+// marked as removed by a chain reorganization are never returned by the getters.
+// Errors are *Error values of kind ErrNotFound, ErrUnavailable or ErrInvalidData.
+type Store interface {
+	// GetBloomByBlockNumber returns the hex bloom of the block, or ErrNotFound if the block is not stored
+	GetBloomByBlockNumber(blockNum int64) (string, error)
+	// GetBlockNumAndBloomByBlockHash returns the bloom of the block, or ErrNotFound if the block is not stored
+	GetBlockNumAndBloomByBlockHash(blockHash string) (BlockBloom, error)
+	// GetBlockByNumber returns the bloom and header fields of the block, or ErrNotFound if the block is not stored
+	GetBlockByNumber(blockNum int64) (BlockBloom, error)
+	// GetBlockByHash returns the bloom and header fields of the block, or ErrNotFound if the block is not stored
+	GetBlockByHash(blockHash string) (BlockBloom, error)
+	// GetBlockHashByBlockNumber returns the hash of the block, or ErrNotFound if the block is not stored
+	GetBlockHashByBlockNumber(blockNum int64) (string, error)
+	// GetBloomsByRange returns the blooms of the blocks in [from, to] ordered by number
+	GetBloomsByRange(from, to int64) ([]BlockBloom, error)
+	// GetBlockHashesByRange returns the hashes of the blocks in (from, to] ordered by number
+	GetBlockHashesByRange(from, to int64) ([]string, error)
+	GetLogsByBlockNumber(blockNumber int64) ([]Logs, error)
+	// GetLogsByRange returns the logs matching the query ordered by block number and log index
+	GetLogsByRange(q LogQuery) ([]Logs, error)
+	// GetBlockHeight returns the highest stored block number, or 0 if nothing is stored
+	GetBlockHeight() (int64, error)
+
+	// SaveLogs stores the logs in a single transaction, a log already stored
+	// with the same tx hash and log index is overwritten
+	SaveLogs(logs []ethtypes.Log) error
+	// SaveBlocks stores the blooms and headers of the blocks and their logs in a single transaction
+	// where the database supports it, otherwise the logs are written before the blooms. The
+	// bloombits sections containing the blocks are dropped, they are indexed again with the new blooms.
+	SaveBlocks(blooms []BlockBloom, logs []ethtypes.Log) error
+
+	// GetBloomBitsSections returns the indexed bloombits sections in [from, to] in ascending order
+	GetBloomBitsSections(from, to int64) ([]int64, error)
+	// DeleteBloomBits drops the bloombits sections in [from, to], they are indexed again afterwards
+	DeleteBloomBits(from, to int64) error
+	// SaveBloomBits stores the compressed bit vectors of a section, indexed by bloom bit
+	SaveBloomBits(section int64, bits [][]byte) error
+	// GetBloomBits returns the compressed bit vectors of the section for the given bloom bits,
+	// or ErrNotFound if the section is not indexed
+	GetBloomBits(section int64, bits []uint) (map[uint][]byte, error)
+	// RollbackBlocks drops the blocks above ancestor and marks their logs as removed,
+	// the bloombits sections containing the dropped blocks are dropped as well
+	RollbackBlocks(ancestor int64) ([]Logs, error)
+
+	// SaveABI stores the ABI JSON of the contract, replacing the previous one
+	SaveABI(address, abiJSON string) error
+	// GetABI returns the ABI JSON of the contract, or "" if none is registered
+	GetABI(address string) (string, error)
+
+	// GetWatchList returns the watched contracts, an empty list means every contract is indexed
+	GetWatchList() ([]Watch, error)
+	// SaveWatch adds the contract to the watch list, replacing its topics if it is already watched
+	SaveWatch(watch Watch) error
+	DeleteWatch(address string) error
+
+	// CreateBackfillJob stores a new backfill job and sets its ID
+	CreateBackfillJob(job *BackfillJob) error
+	// UpdateBackfillJob stores the status and error of the job
+	UpdateBackfillJob(job BackfillJob) error
+	// GetBackfillJob returns the backfill job, or nil if it does not exist
+	GetBackfillJob(id int64) (*BackfillJob, error)
+	// GetBackfillJobs returns the backfill jobs with the status ordered by ID
+	GetBackfillJobs(status string) ([]BackfillJob, error)
+	// SaveBackfillChunk checkpoints the chunk of the job starting at fromBlock
+	SaveBackfillChunk(jobID, fromBlock int64) error
+	// GetBackfillChunks returns the first block of the completed chunks of the job
+	GetBackfillChunks(jobID int64) ([]int64, error)
+
+	Migrator
+
+	// Chain returns the store of the chain sharing the same connection, the store
+	// returned by Open is the one of chain 0 used by single-chain deployments
+	Chain(chainID int64) Store
+	// Ping checks that the database is reachable
+	Ping() error
+	// Close closes the connection shared by the stores of all chains
+	Close() error
+}
+
+// Watch is a watched contract, only its logs whose topic0 is in Topics are
+// indexed, or all of its logs if Topics is empty.
+type Watch struct {
+	Address string   `json:"address" mapstructure:"address"`
+	Topics  []string `json:"topics" mapstructure:"topics"`
+}
+
+// Open 根据配置的store.driver打开存储，默认MySQL，开启统计时记录查询耗时
+func Open() (Store, error) {
+	var store Store
+	var err error
+	switch driver := setting.GetString("store.driver"); driver {
+	case "", DriverMySQL:
+		store, err = NewMySQLStore()
+	case DriverMongoDB:
+		store, err = NewMongoStore()
+	default:
+		return nil, errors.Errorf("unknown store driver %q", driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return withMetrics(store), nil
+}
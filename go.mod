@@ -5,6 +5,10 @@ go 1.15
 require (
 	github.com/ethereum/go-ethereum v1.10.18
 	github.com/go-sql-driver/mysql v1.6.0
+	github.com/golang-jwt/jwt/v4 v4.3.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/viper v1.12.0
+	go.mongodb.org/mongo-driver v1.9.1
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
 )
@@ -336,6 +336,11 @@ func GetlocalLogger() *LocalLogger {
 	return defaultLogger
 }
 
+// Close flushes and closes the outputs of the defaultLogger
+func Close() {
+	defaultLogger.Close()
+}
+
 // Reset will remove all the adapter
 func Reset() {
 	defaultLogger.Reset()
@@ -1,26 +1,102 @@
 package main
 
 import (
+	"blockchain-event-plugin/dbdrive"
 	"blockchain-event-plugin/logger"
 	"blockchain-event-plugin/rpc/rpcserver"
+	"blockchain-event-plugin/setting"
+	"blockchain-event-plugin/syncer"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
 
+// defaultShutdownTimeout is the time given to the shutdown before the process is forced to exit
+const defaultShutdownTimeout = 30 * time.Second
+
 func main() {
 	// 加载日志配置
 	logger.SetLogger("config/log.json")
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := Migrate(os.Args[2:]); err != nil {
+			logger.Error("[sys] Migrate failed", "err", err)
+			fmt.Fprintln(os.Stderr, "migrate:", err)
+			os.Exit(1)
+		}
+		return
+	}
 	Run()
 }
 
-// Run 开始运行
+// Migrate 执行数据库迁移子命令：migrate up [version] | down [version] | status
+// up默认迁移到最新版本，down默认回滚最近一次迁移
+func Migrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up [version] | down [version] | status")
+	}
+	store, err := dbdrive.Open()
+	if err != nil {
+		return errors.Wrap(err, "open store")
+	}
+	defer store.Close()
+
+	status, err := store.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	current := 0
+	for _, m := range status {
+		if m.Applied {
+			current = m.Version
+		}
+	}
+	target := -1
+	if len(args) > 1 {
+		if target, err = strconv.Atoi(args[1]); err != nil || target < 0 {
+			return errors.Errorf("invalid version %q", args[1])
+		}
+	}
+
+	switch args[0] {
+	case "up":
+		if target < 0 {
+			target = 0
+		}
+		return store.MigrateUp(target)
+	case "down":
+		if target < 0 {
+			target = current - 1
+		}
+		if target < 0 {
+			return nil
+		}
+		return store.MigrateDown(target)
+	case "status":
+		for _, m := range status {
+			state := "pending"
+			if m.Applied {
+				state = "applied " + m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%3d  %-55s %s\n", m.Version, m.Name, state)
+		}
+		return nil
+	default:
+		return errors.Errorf("unknown migrate command %q", args[0])
+	}
+}
+
+// Run 开始运行，收到退出信号后优雅关闭并以关闭结果作为退出码
 func Run() {
 
-	// 监听中断信号
-	signal.Notify(make(chan os.Signal), syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	// 监听中断信号，启动前注册以免丢失启动期间的信号
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
 	// 服务开启
 	rpcPort := viper.GetString("rpc.port")
@@ -29,9 +105,98 @@ func Run() {
 		rpcPort = os.Getenv("RPC_PORT")
 		logger.Info("Command line get RPC_PORT:", rpcPort)
 	}
-	go rpcserver.StartRPC(":" + rpcPort)
+	wsPort := viper.GetString("rpc.ws_port")
+	if wsPort == "" {
+		wsPort = os.Getenv("WS_PORT")
+	}
+	wsAddr := ""
+	if wsPort != "" {
+		wsAddr = ":" + wsPort
+	}
+
+	// 打开存储
+	store, err := dbdrive.Open()
+	if err != nil {
+		logger.Fatal("[sys] Open store failed", "err", err)
+	}
+	if setting.GetBool("store.auto_migrate") {
+		if err := store.MigrateUp(0); err != nil {
+			logger.Fatal("[sys] Migrate store failed", "err", err)
+		}
+	}
+
+	// 区块同步服务开启，每条链使用独立的同步服务和存储分区
+	chains, err := syncer.Chains()
+	if err != nil {
+		logger.Fatal("[sys] Load chains failed", "err", err)
+	}
+	services := make([]rpcserver.ChainService, 0, len(chains))
+	var syncServices []*syncer.Service
+	for _, chain := range chains {
+		chainStore := store.Chain(chain.ChainID)
+		syncService, err := syncer.New(chain, chainStore)
+		if err != nil {
+			logger.Error("[sys] Sync service start failed", "chainId", chain.ChainID, "err", err)
+		} else {
+			syncService.Start()
+			syncServices = append(syncServices, syncService)
+		}
+		services = append(services, rpcserver.ChainService{Chain: chain, Store: chainStore, Sync: syncService})
+	}
+	rpcServer := rpcserver.StartRPC(":"+rpcPort, wsAddr, services)
 
 	logger.Info("[sys] CMP service start successful: ", "time", time.Now().UTC())
 
-	<-make(chan struct{})
+	code := 0
+	select {
+	case sig := <-sigs:
+		logger.Info("[sig] exit signal capture", "signal", sig)
+	case err := <-rpcServer.Err():
+		logger.Error("[sys] RPC server stopped", "err", err)
+		code = 1
+	}
+	if !shutdown(rpcServer, syncServices, store, sigs) {
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// shutdown 依次关闭RPC服务、同步服务、存储和日志，超时或再次收到信号时强制退出并返回false。
+// 同步服务等待当前区块写入完成，未完成的回填任务保留检查点，重启后继续
+func shutdown(rpcServer *rpcserver.RPC, syncServices []*syncer.Service, store dbdrive.Store, sigs <-chan os.Signal) bool {
+	defer logger.Close()
+
+	timeout := time.Duration(setting.GetInt("shutdown.timeout")) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		err := rpcServer.Shutdown(ctx)
+		for _, syncService := range syncServices {
+			syncService.Stop()
+		}
+		if closeErr := store.Close(); closeErr != nil {
+			err = errors.Wrap(closeErr, "close store")
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			logger.Error("[sys] Shutdown failed", "err", err)
+			return false
+		}
+		logger.Info("[sys] CMP service stopped")
+		return true
+	case sig := <-sigs:
+		logger.Error("[sys] Forced shutdown", "signal", sig)
+	case <-ctx.Done():
+		logger.Error("[sys] Forced shutdown", "timeout", timeout)
+	}
+	return false
 }
@@ -0,0 +1,51 @@
+// Package metrics 插件的统计指标，metrics.enabled开启时统计，rpc.metrics_endpoint开启时由HTTP端口的/metrics以Prometheus格式导出。
+// 名称以/分隔，导出时替换为_。
+package metrics
+
+import (
+	"blockchain-event-plugin/setting"
+	gethmetrics "github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/metrics/prometheus"
+	"net/http"
+)
+
+// Registry holds the metrics of the plugin, apart from the ones of go-ethereum
+var Registry = gethmetrics.NewRegistry()
+
+func init() {
+	// 指标在各包初始化时创建，未开启时创建的是空实现，因此在此处开启
+	if setting.GetBool("metrics.enabled") {
+		gethmetrics.Enabled = true
+	}
+}
+
+// Enabled reports whether the metrics are collected
+func Enabled() bool {
+	return gethmetrics.Enabled
+}
+
+// Handler returns the handler exporting the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return prometheus.Handler(Registry)
+}
+
+// NewCounter creates and registers a counter
+func NewCounter(name string) gethmetrics.Counter {
+	return gethmetrics.NewRegisteredCounter(name, Registry)
+}
+
+// GetOrRegisterCounter returns the counter of the name, registering it on first use
+func GetOrRegisterCounter(name string) gethmetrics.Counter {
+	return gethmetrics.GetOrRegisterCounter(name, Registry)
+}
+
+// GetOrRegisterTimer returns the timer of the name, registering it on first use.
+// Timers are exported as summaries in nanoseconds.
+func GetOrRegisterTimer(name string) gethmetrics.Timer {
+	return gethmetrics.GetOrRegisterTimer(name, Registry)
+}
+
+// NewFunctionalGauge registers a gauge whose value is read from f on every export
+func NewFunctionalGauge(name string, f func() int64) gethmetrics.Gauge {
+	return gethmetrics.NewRegisteredFunctionalGauge(name, Registry, f)
+}
@@ -0,0 +1,220 @@
+package decoder
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"blockchain-event-plugin/logger"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/pkg/errors"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// DecodedLog is a stored log with the event decoded by the ABI registered for its contract.
+// The event fields are empty when no ABI or no matching event is found.
+type DecodedLog struct {
+	dbdrive.Logs
+	Event     string       `json:"event,omitempty" description:"name of the event"`
+	Signature string       `json:"signature,omitempty" description:"canonical signature of the event"`
+	Args      []DecodedArg `json:"args,omitempty" description:"decoded event arguments in declaration order"`
+}
+
+// DecodedArg is a single decoded event argument. Indexed arguments of dynamic
+// types are only available as the hash stored in the topic.
+type DecodedArg struct {
+	Name    string      `json:"name"`
+	Type    string      `json:"type"`
+	Indexed bool        `json:"indexed"`
+	Value   interface{} `json:"value"`
+}
+
+// Registry keeps the contract ABIs in the store and decodes logs with them.
+type Registry struct {
+	store dbdrive.Store
+
+	mu    sync.RWMutex
+	cache map[string]*abi.ABI // address -> parsed ABI, contracts without ABI are not cached
+}
+
+// NewRegistry returns a Registry over the store
+func NewRegistry(store dbdrive.Store) *Registry {
+	return &Registry{
+		store: store,
+		cache: make(map[string]*abi.ABI),
+	}
+}
+
+// Register validates and stores the ABI JSON of the contract
+func (r *Registry) Register(address common.Address, abiJSON string) error {
+	parsed, err := abi.JSON(strings.NewReader(abiJSON))
+	if err != nil {
+		return errors.Wrap(err, "invalid abi")
+	}
+	key := strings.ToLower(address.String())
+	if err := r.store.SaveABI(key, abiJSON); err != nil {
+		return errors.Wrap(err, "save abi")
+	}
+
+	r.mu.Lock()
+	r.cache[key] = &parsed
+	r.mu.Unlock()
+	return nil
+}
+
+// ABI returns the ABI registered for the contract, or nil if there is none. Missing ABIs
+// are not cached, an ABI registered through another instance is picked up on the next call.
+func (r *Registry) ABI(address string) (*abi.ABI, error) {
+	key := strings.ToLower(address)
+	r.mu.RLock()
+	parsed, ok := r.cache[key]
+	r.mu.RUnlock()
+	if ok {
+		return parsed, nil
+	}
+
+	abiJSON, err := r.store.GetABI(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "get abi")
+	}
+	if abiJSON == "" {
+		return nil, nil
+	}
+	contractABI, err := abi.JSON(strings.NewReader(abiJSON))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid stored abi of %s", key)
+	}
+
+	r.mu.Lock()
+	r.cache[key] = &contractABI
+	r.mu.Unlock()
+	return &contractABI, nil
+}
+
+// DecodeLogs decodes the logs, logs that can not be decoded are returned as they are
+func (r *Registry) DecodeLogs(logs []dbdrive.Logs) ([]DecodedLog, error) {
+	decoded := make([]DecodedLog, 0, len(logs))
+	abis := make(map[string]*abi.ABI) // 同一次解码中每个合约只查询一次
+	for _, log := range logs {
+		contractABI, ok := abis[log.Address]
+		if !ok {
+			var err error
+			if contractABI, err = r.ABI(log.Address); err != nil {
+				return nil, err
+			}
+			abis[log.Address] = contractABI
+		}
+		decodedLog := DecodedLog{Logs: log}
+		if contractABI != nil {
+			if err := decodeLog(contractABI, &decodedLog); err != nil {
+				logger.Warn("Decode log failed", "txHash", log.TxHash, "logIndex", log.LogIndex, "err", err)
+				decodedLog = DecodedLog{Logs: log}
+			}
+		}
+		decoded = append(decoded, decodedLog)
+	}
+	return decoded, nil
+}
+
+// decodeLog fills the event fields of the log, anonymous events can not be matched and are skipped
+func decodeLog(contractABI *abi.ABI, log *DecodedLog) error {
+	if len(log.Topics) == 0 || log.Topics[0] == "" {
+		return nil
+	}
+	topics := make([]common.Hash, len(log.Topics))
+	for i, topic := range log.Topics {
+		topics[i] = common.HexToHash(topic)
+	}
+	event, err := contractABI.EventByID(topics[0])
+	if err != nil {
+		return nil
+	}
+	data, err := hexutil.Decode(log.Data)
+	if err != nil {
+		return errors.Wrap(err, "invalid data")
+	}
+
+	// 未命名的参数命名为argN，避免解码时互相覆盖
+	inputs := make(abi.Arguments, len(event.Inputs))
+	for i, input := range event.Inputs {
+		if input.Name == "" {
+			input.Name = fmt.Sprintf("arg%d", i)
+		}
+		inputs[i] = input
+	}
+	var indexed abi.Arguments
+	for _, input := range inputs {
+		if input.Indexed {
+			indexed = append(indexed, input)
+		}
+	}
+	values := make(map[string]interface{})
+	if err := abi.ParseTopicsIntoMap(values, indexed, topics[1:]); err != nil {
+		return errors.Wrap(err, "unpack topics")
+	}
+	if err := inputs.UnpackIntoMap(values, data); err != nil {
+		return errors.Wrap(err, "unpack data")
+	}
+
+	log.Event = event.Name
+	log.Signature = event.Sig
+	log.Args = make([]DecodedArg, 0, len(inputs))
+	for _, input := range inputs {
+		log.Args = append(log.Args, DecodedArg{
+			Name:    input.Name,
+			Type:    input.Type.String(),
+			Indexed: input.Indexed,
+			Value:   formatValue(values[input.Name]),
+		})
+	}
+	return nil
+}
+
+// formatValue converts the unpacked value to its JSON-RPC form: integers as
+// decimal strings and byte arrays as hex, recursing into arrays and slices.
+func formatValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case *big.Int:
+		return v.String()
+	case []byte:
+		return hexutil.Bytes(v)
+	case common.Address, common.Hash, string, bool:
+		return v
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return big.NewInt(rv.Int()).String()
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return new(big.Int).SetUint64(rv.Uint()).String()
+	case reflect.Array, reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			byts := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(byts), rv)
+			return hexutil.Bytes(byts)
+		}
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = formatValue(rv.Index(i).Interface())
+		}
+		return list
+	case reflect.Struct:
+		fields := make(map[string]interface{}, rv.NumField())
+		for i := 0; i < rv.NumField(); i++ {
+			field := rv.Type().Field(i)
+			name := field.Tag.Get("json")
+			if name == "" {
+				name = field.Name
+			}
+			fields[name] = formatValue(rv.Field(i).Interface())
+		}
+		return fields
+	}
+	return value
+}
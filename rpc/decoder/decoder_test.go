@@ -0,0 +1,103 @@
+package decoder
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"github.com/ethereum/go-ethereum/common"
+	"reflect"
+	"testing"
+)
+
+// abiStore is a Store holding only ABIs, it counts the GetABI queries
+type abiStore struct {
+	dbdrive.Store
+	abis    map[string]string
+	queries int
+}
+
+func (s *abiStore) SaveABI(address, abiJSON string) error {
+	s.abis[address] = abiJSON
+	return nil
+}
+
+func (s *abiStore) GetABI(address string) (string, error) {
+	s.queries++
+	return s.abis[address], nil
+}
+
+const unnamedABI = `[{"type":"event","name":"Transfer","inputs":[
+	{"type":"address","indexed":true},{"type":"address","indexed":true},{"type":"uint256"},{"name":"memo","type":"string"}]}]`
+
+var (
+	contract = "0x000000000000000000000000000000000000000a"
+	from     = common.HexToAddress("0x01")
+	to       = common.HexToAddress("0x02")
+)
+
+// transferLog returns a Transfer(from, to, 7, "hi") log with the event ID
+func transferLog(id common.Hash) dbdrive.Logs {
+	return dbdrive.Logs{
+		Address: contract,
+		Topics: []string{
+			id.String(),
+			common.BytesToHash(from.Bytes()).String(),
+			common.BytesToHash(to.Bytes()).String(),
+		},
+		Data: "0x" +
+			"0000000000000000000000000000000000000000000000000000000000000007" +
+			"0000000000000000000000000000000000000000000000000000000000000040" +
+			"0000000000000000000000000000000000000000000000000000000000000002" +
+			"6869000000000000000000000000000000000000000000000000000000000000",
+	}
+}
+
+func TestDecodeLogsUnnamedArgs(t *testing.T) {
+	store := &abiStore{abis: make(map[string]string)}
+	registry := NewRegistry(store)
+	if err := registry.Register(common.HexToAddress(contract), unnamedABI); err != nil {
+		t.Fatal(err)
+	}
+	contractABI, err := registry.ABI(contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := transferLog(contractABI.Events["Transfer"].ID)
+	decoded, err := registry.DecodeLogs([]dbdrive.Logs{log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DecodedArg{
+		{Name: "arg0", Type: "address", Indexed: true, Value: from},
+		{Name: "arg1", Type: "address", Indexed: true, Value: to},
+		{Name: "arg2", Type: "uint256", Value: "7"},
+		{Name: "memo", Type: "string", Value: "hi"},
+	}
+	if len(decoded) != 1 || decoded[0].Event != "Transfer" || !reflect.DeepEqual(decoded[0].Args, want) {
+		t.Errorf("got %+v, want args %+v", decoded, want)
+	}
+}
+
+func TestRegistryMissingABINotCached(t *testing.T) {
+	store := &abiStore{abis: make(map[string]string)}
+	registry := NewRegistry(store)
+
+	// 同一次解码中未注册ABI的合约只查询一次
+	id := common.HexToHash("0x01")
+	logs := []dbdrive.Logs{transferLog(id), transferLog(id), transferLog(id)}
+	decoded, err := registry.DecodeLogs(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 3 || decoded[0].Event != "" || store.queries != 1 {
+		t.Errorf("got %d logs, event %q after %d queries", len(decoded), decoded[0].Event, store.queries)
+	}
+
+	// 其他实例注册的ABI在下一次查询时生效
+	store.abis[contract] = unnamedABI
+	contractABI, err := registry.ABI(contract)
+	if err != nil || contractABI == nil {
+		t.Fatalf("got abi %v, error %v after it was registered", contractABI, err)
+	}
+	if _, err := registry.ABI(contract); err != nil || store.queries != 2 {
+		t.Errorf("registered abi was not cached: %d queries, error %v", store.queries, err)
+	}
+}
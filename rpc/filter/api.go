@@ -3,6 +3,7 @@ package filter
 import (
 	"blockchain-event-plugin/dbdrive"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	ethtypes "github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/eth/filters"
 	"github.com/ethereum/go-ethereum/rpc"
@@ -19,6 +20,8 @@ const (
 	DefaultBlockRangeCap int32 = 10000
 )
 
+var errFilterNotFound = errors.New("filter not found")
+
 // filter is a helper struct that holds meta information over the filter type
 // and associated subscription in the event system.
 type filter struct {
@@ -26,28 +29,60 @@ type filter struct {
 	deadline *time.Timer // filter is inactive when deadline triggers
 	hashes   []common.Hash
 	crit     filters.FilterCriteria
-	logs     []*ethtypes.Log
+	logs     []dbdrive.Logs // removed logs waiting to be delivered
+	cursor   int64          // last block height delivered to the client
 }
 
 // Backend defines the methods requided by the PublicFilterAPI backend
 type Backend interface {
-	GetLogs(blockHash common.Hash) ([][]*ethtypes.Log, error)
+	// BlockHeight returns the highest stored block number
+	BlockHeight() (int64, error)
+	// BloomByNumber returns the bloom of the block, found is false if the block is not stored
+	BloomByNumber(height int64) (bloom ethtypes.Bloom, found bool, err error)
+	// BloomByHash returns the number and bloom of the block with the given hash
+	BloomByHash(blockHash common.Hash) (height int64, bloom ethtypes.Bloom, found bool, err error)
+	// BlockHashes returns the hashes of the blocks in (from, to] ordered by number
+	BlockHashes(from, to int64) ([]common.Hash, error)
+	// GetLogs returns the logs of the block at the given height
+	GetLogs(height int64) ([]dbdrive.Logs, error)
+	// BloomsByRange returns the blooms of the blocks in [from, to] ordered by number
+	BloomsByRange(from, to int64) ([]BlockBloom, error)
+	// RangeLogs returns at most limit logs in [from, to] matching the addresses and topics,
+	// only the blocks in heights are searched when it is not empty
+	RangeLogs(from, to int64, heights []int64, addresses []common.Address, topics [][]common.Hash, limit int) ([]dbdrive.Logs, error)
+	// BloomBitsSections returns the indexed bloombits sections in [from, to] in ascending order
+	BloomBitsSections(from, to int64) ([]int64, error)
+	// BloomBits returns the decompressed bit vectors of the section for the given bloom bits
+	BloomBits(section int64, bits []uint) (map[uint][]byte, error)
 	RPCLogsCap() int32
 	RPCBlockRangeCap() int32
 }
 
+// BlockBloom is the decoded bloom of a stored block
+type BlockBloom struct {
+	Height int64
+	Bloom  ethtypes.Bloom
+}
+
 // PublicFilterAPI offers support to create and manage filter. This will allow external clients to retrieve various
 // information related to the Ethereum protocol such as blocks, transactions and logs.
 type PublicFilterAPI struct {
 	backend   Backend
 	filtersMu sync.Mutex
 	filters   map[rpc.ID]*filter
+
+	stopOnce sync.Once
+	quit     chan struct{} // closed by Stop to end the timeout loop
 }
 
-// NewPublicAPI returns a new PublicFilterAPI instance.
-func NewPublicAPI() *PublicFilterAPI {
+// NewPublicAPI returns a new PublicFilterAPI instance. A single instance is
+// expected to live as long as the RPC server, as it owns the installed filters.
+// Stop must be called when the RPC server is shut down.
+func NewPublicAPI(backend Backend) *PublicFilterAPI {
 	api := &PublicFilterAPI{
+		backend: backend,
 		filters: make(map[rpc.ID]*filter),
+		quit:    make(chan struct{}),
 	}
 
 	go api.timeoutLoop()
@@ -55,14 +90,23 @@ func NewPublicAPI() *PublicFilterAPI {
 	return api
 }
 
-// timeoutLoop runs every 5 minutes and deletes filters that have not been recently used.
-// Tt is started when the api is created.
+// Stop ends the timeout loop, it can be called more than once
+func (api *PublicFilterAPI) Stop() {
+	api.stopOnce.Do(func() { close(api.quit) })
+}
+
+// timeoutLoop runs every deadline (10 minutes) and deletes filters that have not been recently used.
+// It is started when the api is created and returns when the api is stopped.
 func (api *PublicFilterAPI) timeoutLoop() {
 	ticker := time.NewTicker(deadline)
 	defer ticker.Stop()
 
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-api.quit:
+			return
+		}
 		api.filtersMu.Lock()
 		for id, f := range api.filters {
 			select {
@@ -76,6 +120,7 @@ func (api *PublicFilterAPI) timeoutLoop() {
 	}
 }
 
+// HandleGetLogs returns the logs matching the given argument that are stored in the database.
 func (api *PublicFilterAPI) HandleGetLogs(crit filters.FilterCriteria) ([]dbdrive.Logs, error) {
 	var filter *Filter
 	if crit.BlockHash != nil {
@@ -83,14 +128,14 @@ func (api *PublicFilterAPI) HandleGetLogs(crit filters.FilterCriteria) ([]dbdriv
 		filter = NewBlockFilter(api.backend, crit)
 	} else {
 		// Convert the RPC block numbers into internal representations
-		begin, err := dbdrive.GetBlockHeight()
+		begin, err := api.backend.BlockHeight()
 		if err != nil {
 			return nil, errors.Wrap(err, "HandleGetLogs getBlockHeight for FromBlock error")
 		}
 		if crit.FromBlock != nil {
 			begin = crit.FromBlock.Int64()
 		}
-		end, err := dbdrive.GetBlockHeight()
+		end, err := api.backend.BlockHeight()
 		if err != nil {
 			return nil, errors.Wrap(err, "HandleGetLogs getBlockHeight for toBlock error")
 		}
@@ -102,10 +147,176 @@ func (api *PublicFilterAPI) HandleGetLogs(crit filters.FilterCriteria) ([]dbdriv
 	}
 
 	// Run the filter and return all the logs
-	logs, err := filter.Logs(int(DefaultLogsCap), int64(DefaultBlockRangeCap))
+	logs, err := filter.Logs(int(api.backend.RPCLogsCap()), int64(api.backend.RPCBlockRangeCap()))
 	if err != nil {
 		return nil, err
 	}
 
 	return returnLogs(logs), err
 }
+
+// NewBlockFilter creates a filter that fetches the hashes of blocks stored after its creation.
+// To check if the state has changed, call GetFilterChanges.
+func (api *PublicFilterAPI) NewBlockFilter() (rpc.ID, error) {
+	head, err := api.backend.BlockHeight()
+	if err != nil {
+		return "", errors.Wrap(err, "NewBlockFilter getBlockHeight error")
+	}
+	return api.install(filters.BlocksSubscription, filters.FilterCriteria{}, head), nil
+}
+
+// NewFilter creates a new filter and returns the filter id. It can be used to retrieve
+// logs stored after its creation; logs that are already stored are returned by GetFilterLogs.
+func (api *PublicFilterAPI) NewFilter(crit filters.FilterCriteria) (rpc.ID, error) {
+	if crit.BlockHash != nil {
+		return "", errors.New("blockHash is not supported by filters")
+	}
+	head, err := api.backend.BlockHeight()
+	if err != nil {
+		return "", errors.Wrap(err, "NewFilter getBlockHeight error")
+	}
+	return api.install(filters.LogsSubscription, crit, head), nil
+}
+
+// install registers a filter starting after the cursor block.
+func (api *PublicFilterAPI) install(typ filters.Type, crit filters.FilterCriteria, cursor int64) rpc.ID {
+	id := rpc.NewID()
+	api.filtersMu.Lock()
+	api.filters[id] = &filter{
+		typ:      typ,
+		deadline: time.NewTimer(deadline),
+		crit:     crit,
+		cursor:   cursor,
+	}
+	api.filtersMu.Unlock()
+	return id
+}
+
+// GetFilterLogs returns the logs for the filter with the given id.
+// If the filter could not be found an empty array of logs is returned.
+func (api *PublicFilterAPI) GetFilterLogs(id rpc.ID) ([]dbdrive.Logs, error) {
+	api.filtersMu.Lock()
+	f, found := api.filters[id]
+	api.filtersMu.Unlock()
+
+	if !found || f.typ != filters.LogsSubscription {
+		return nil, errFilterNotFound
+	}
+	return api.HandleGetLogs(f.crit)
+}
+
+// GetFilterChanges returns the logs or block hashes stored since the last poll for
+// the filter with the given id, starting after the cursor of the filter.
+func (api *PublicFilterAPI) GetFilterChanges(id rpc.ID) (interface{}, error) {
+	api.filtersMu.Lock()
+	f, found := api.filters[id]
+	if !found {
+		api.filtersMu.Unlock()
+		return nil, errFilterNotFound
+	}
+	if !f.deadline.Stop() {
+		// timer expired but filter is not yet removed in timeout loop
+		// receive timer value and reset timer
+		<-f.deadline.C
+	}
+	f.deadline.Reset(deadline)
+	typ, crit, cursor, removed := f.typ, f.crit, f.cursor, f.logs
+	f.logs = nil
+	api.filtersMu.Unlock()
+
+	head, err := api.backend.BlockHeight()
+	if err != nil {
+		return nil, errors.Wrap(err, "GetFilterChanges getBlockHeight error")
+	}
+
+	switch typ {
+	case filters.BlocksSubscription:
+		end := head
+		if blockLimit := int64(api.backend.RPCBlockRangeCap()); end-cursor > blockLimit {
+			end = cursor + blockLimit
+		}
+		hashes, err := api.backend.BlockHashes(cursor, end)
+		if err != nil {
+			return nil, errors.Wrap(err, "GetFilterChanges getBlockHashes error")
+		}
+		api.advance(id, cursor, end)
+		return returnHashes(hashes), nil
+
+	case filters.LogsSubscription:
+		begin := cursor + 1
+		if crit.FromBlock != nil && crit.FromBlock.Int64() > begin {
+			begin = crit.FromBlock.Int64()
+		}
+		end := head
+		if crit.ToBlock != nil && crit.ToBlock.Int64() >= 0 && crit.ToBlock.Int64() < end {
+			end = crit.ToBlock.Int64()
+		}
+		if blockLimit := int64(api.backend.RPCBlockRangeCap()); end-begin >= blockLimit {
+			end = begin + blockLimit - 1
+		}
+
+		logs := removed
+		if begin <= end {
+			filter := NewRangeFilter(api.backend, begin, end, crit.Addresses, crit.Topics)
+			filtered, err := filter.Logs(int(api.backend.RPCLogsCap()), int64(api.backend.RPCBlockRangeCap()))
+			if err != nil {
+				return nil, err
+			}
+			logs = append(logs, filtered...)
+			api.advance(id, cursor, end)
+		}
+		return returnLogs(logs), nil
+	}
+
+	return []interface{}{}, nil
+}
+
+// advance moves the cursor of the filter to end, unless the filter was uninstalled
+// or rewound by a chain reorganization while its changes were being collected.
+func (api *PublicFilterAPI) advance(id rpc.ID, cursor, end int64) {
+	api.filtersMu.Lock()
+	defer api.filtersMu.Unlock()
+
+	if f, found := api.filters[id]; found && f.cursor == cursor {
+		f.cursor = end
+	}
+}
+
+// UninstallFilter removes the filter with the given filter id.
+func (api *PublicFilterAPI) UninstallFilter(id rpc.ID) bool {
+	api.filtersMu.Lock()
+	f, found := api.filters[id]
+	if found {
+		delete(api.filters, id)
+	}
+	api.filtersMu.Unlock()
+	if found {
+		f.deadline.Stop()
+	}
+
+	return found
+}
+
+// HandleRemovedLogs rewinds the filters to the common ancestor of a chain reorganization,
+// queueing the removed logs that were already delivered so the client sees them as removed.
+func (api *PublicFilterAPI) HandleRemovedLogs(ancestor int64, removed []dbdrive.Logs) {
+	api.filtersMu.Lock()
+	defer api.filtersMu.Unlock()
+
+	for _, f := range api.filters {
+		if f.cursor <= ancestor {
+			continue
+		}
+		if f.typ == filters.LogsSubscription {
+			var delivered []dbdrive.Logs
+			for _, log := range removed {
+				number, err := hexutil.DecodeUint64(log.BlockNumber)
+				if err == nil && int64(number) <= f.cursor {
+					delivered = append(delivered, log)
+				}
+			}
+			f.logs = append(f.logs, FilterLogs(delivered, nil, nil, f.crit.Addresses, f.crit.Topics)...)
+		}
+		f.cursor = ancestor
+	}
+}
@@ -0,0 +1,118 @@
+package filter
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/eth/filters"
+	"github.com/ethereum/go-ethereum/rpc"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func TestGetFilterChangesBlocks(t *testing.T) {
+	backend := newTestBackend()
+	api := NewPublicAPI(backend)
+	defer api.Stop()
+	id, err := api.NewBlockFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := api.GetFilterChanges(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashes := changes.([]common.Hash); len(hashes) != 0 {
+		t.Errorf("got %d hashes before any new block", len(hashes))
+	}
+
+	backend.addBlocks(2)
+	if changes, err = api.GetFilterChanges(id); err != nil {
+		t.Fatal(err)
+	}
+	want := []common.Hash{backend.blocks[21].hash, backend.blocks[22].hash}
+	if hashes := changes.([]common.Hash); !reflect.DeepEqual(hashes, want) {
+		t.Errorf("got hashes %v, want %v", hashes, want)
+	}
+	if changes, _ = api.GetFilterChanges(id); len(changes.([]common.Hash)) != 0 {
+		t.Errorf("got hashes %v again", changes)
+	}
+
+	if !api.UninstallFilter(id) {
+		t.Error("filter was not uninstalled")
+	}
+	if _, err := api.GetFilterChanges(id); err != errFilterNotFound {
+		t.Errorf("uninstalled filter: got error %v", err)
+	}
+}
+
+func TestGetFilterChangesLogs(t *testing.T) {
+	backend := newTestBackend()
+	api := NewPublicAPI(backend)
+	defer api.Stop()
+	id, err := api.NewFilter(filters.FilterCriteria{Addresses: []common.Address{addrA}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend.addBlock(newLog(addrA, topic1)) // 21
+	backend.addBlock(newLog(addrB, topic1)) // 22
+	backend.addBlock(newLog(addrA, topic2)) // 23
+	if got := filterChanges(t, api, id); !reflect.DeepEqual(got, []int64{21, 23}) {
+		t.Errorf("got logs of blocks %v, want [21 23]", got)
+	}
+	if got := filterChanges(t, api, id); len(got) != 0 {
+		t.Errorf("got logs of blocks %v again", got)
+	}
+
+	// 重组回退到21后，已返回的23的logs标记为removed，新的区块从22开始返回
+	removed := backend.blocks[23].logs
+	for i := range removed {
+		removed[i].Removed = true
+	}
+	delete(backend.blocks, 23)
+	delete(backend.blocks, 22)
+	backend.height = 21
+	api.HandleRemovedLogs(21, removed)
+	backend.addBlock(newLog(addrA, topic3)) // 22
+
+	changes, err := api.GetFilterChanges(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := changes.([]dbdrive.Logs)
+	if got := logHeights(t, logs); !reflect.DeepEqual(got, []int64{23, 22}) || !logs[0].Removed || logs[1].Removed {
+		t.Errorf("got logs %+v, want the removed log of block 23 then the log of block 22", logs)
+	}
+}
+
+func TestGetFilterChangesRange(t *testing.T) {
+	backend := newTestBackend()
+	backend.blockRangeCap = 2
+	api := NewPublicAPI(backend)
+	defer api.Stop()
+
+	// toBlock限制返回的区间，每次最多返回blockRangeCap个区块
+	id, err := api.NewFilter(filters.FilterCriteria{ToBlock: big.NewInt(25)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		backend.addBlock(newLog(addrA)) // 21-30
+	}
+	for _, want := range [][]int64{{21, 22}, {23, 24}, {25}, nil} {
+		if got := filterChanges(t, api, id); len(got) != len(want) || (len(got) > 0 && !reflect.DeepEqual(got, want)) {
+			t.Errorf("got logs of blocks %v, want %v", got, want)
+		}
+	}
+}
+
+func filterChanges(t *testing.T, api *PublicFilterAPI, id rpc.ID) []int64 {
+	t.Helper()
+	changes, err := api.GetFilterChanges(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logHeights(t, changes.([]dbdrive.Logs))
+}
@@ -0,0 +1,151 @@
+package filter
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"blockchain-event-plugin/setting"
+	"encoding/hex"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/bitutil"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// storeBackend is the Backend serving the filters from the block blooms and logs in the store.
+type storeBackend struct {
+	store         dbdrive.Store
+	logsCap       int32
+	blockRangeCap int32
+}
+
+// NewBackend returns a Backend over the store, the caps are read from
+// filter.logs_cap and filter.block_range_cap and default to DefaultLogsCap
+// and DefaultBlockRangeCap.
+func NewBackend(store dbdrive.Store) Backend {
+	b := &storeBackend{
+		store:         store,
+		logsCap:       int32(setting.GetInt("filter.logs_cap")),
+		blockRangeCap: int32(setting.GetInt("filter.block_range_cap")),
+	}
+	if b.logsCap <= 0 {
+		b.logsCap = DefaultLogsCap
+	}
+	if b.blockRangeCap <= 0 {
+		b.blockRangeCap = DefaultBlockRangeCap
+	}
+	return b
+}
+
+func (b *storeBackend) BlockHeight() (int64, error) {
+	return b.store.GetBlockHeight()
+}
+
+func (b *storeBackend) BloomByNumber(height int64) (ethtypes.Bloom, bool, error) {
+	bloom, err := b.store.GetBloomByBlockNumber(height)
+	if errors.Is(err, dbdrive.ErrNotFound) {
+		return ethtypes.Bloom{}, false, nil
+	}
+	if err != nil {
+		return ethtypes.Bloom{}, false, err
+	}
+	return decodeBloom(bloom)
+}
+
+func (b *storeBackend) BloomByHash(blockHash common.Hash) (int64, ethtypes.Bloom, bool, error) {
+	blockBloom, err := b.store.GetBlockNumAndBloomByBlockHash(blockHash.String())
+	if errors.Is(err, dbdrive.ErrNotFound) {
+		return 0, ethtypes.Bloom{}, false, nil
+	}
+	if err != nil {
+		return 0, ethtypes.Bloom{}, false, err
+	}
+	bloom, found, err := decodeBloom(blockBloom.Bloom)
+	return blockBloom.BlockNumber, bloom, found, err
+}
+
+func (b *storeBackend) BlockHashes(from, to int64) ([]common.Hash, error) {
+	blockHashes, err := b.store.GetBlockHashesByRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]common.Hash, 0, len(blockHashes))
+	for _, blockHash := range blockHashes {
+		hashes = append(hashes, common.HexToHash(blockHash))
+	}
+	return hashes, nil
+}
+
+func (b *storeBackend) GetLogs(height int64) ([]dbdrive.Logs, error) {
+	return b.store.GetLogsByBlockNumber(height)
+}
+
+func (b *storeBackend) BloomsByRange(from, to int64) ([]BlockBloom, error) {
+	blockBlooms, err := b.store.GetBloomsByRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+	blooms := make([]BlockBloom, 0, len(blockBlooms))
+	for _, blockBloom := range blockBlooms {
+		bloom, _, err := decodeBloom(blockBloom.Bloom)
+		if err != nil {
+			return nil, errors.Wrapf(err, "block %d", blockBloom.BlockNumber)
+		}
+		blooms = append(blooms, BlockBloom{Height: blockBloom.BlockNumber, Bloom: bloom})
+	}
+	return blooms, nil
+}
+
+func (b *storeBackend) RangeLogs(from, to int64, heights []int64, addresses []common.Address, topics [][]common.Hash, limit int) ([]dbdrive.Logs, error) {
+	q := dbdrive.LogQuery{FromBlock: from, ToBlock: to, Heights: heights, Limit: limit}
+	for _, address := range addresses {
+		q.Addresses = append(q.Addresses, strings.ToLower(address.String()))
+	}
+	for _, sub := range topics {
+		hexes := make([]string, 0, len(sub))
+		for _, topic := range sub {
+			hexes = append(hexes, topic.String())
+		}
+		q.Topics = append(q.Topics, hexes)
+	}
+	return b.store.GetLogsByRange(q)
+}
+
+func (b *storeBackend) BloomBitsSections(from, to int64) ([]int64, error) {
+	return b.store.GetBloomBitsSections(from, to)
+}
+
+func (b *storeBackend) BloomBits(section int64, bits []uint) (map[uint][]byte, error) {
+	compressed, err := b.store.GetBloomBits(section, bits)
+	if err != nil {
+		return nil, err
+	}
+	vectors := make(map[uint][]byte, len(compressed))
+	for bit, data := range compressed {
+		vector, err := bitutil.DecompressBytes(data, dbdrive.BloomBitsSectionSize/8)
+		if err != nil {
+			return nil, errors.Wrapf(dbdrive.ErrInvalidData, "decompress bit %d of section %d: %v", bit, section, err)
+		}
+		vectors[bit] = vector
+	}
+	return vectors, nil
+}
+
+func (b *storeBackend) RPCLogsCap() int32 {
+	return b.logsCap
+}
+
+func (b *storeBackend) RPCBlockRangeCap() int32 {
+	return b.blockRangeCap
+}
+
+// decodeBloom parses a stored hex bloom, with or without the 0x prefix.
+func decodeBloom(str string) (ethtypes.Bloom, bool, error) {
+	byteBloom, err := hex.DecodeString(strings.TrimPrefix(str, "0x"))
+	if err != nil {
+		return ethtypes.Bloom{}, false, errors.Wrapf(dbdrive.ErrInvalidData, "block bloom: %v", err)
+	}
+	if len(byteBloom) != ethtypes.BloomByteLength {
+		return ethtypes.Bloom{}, false, errors.Wrapf(dbdrive.ErrInvalidData, "block bloom length %d", len(byteBloom))
+	}
+	return ethtypes.BytesToBloom(byteBloom), true, nil
+}
@@ -0,0 +1,211 @@
+package filter
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/bloombits"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"math/big"
+	"testing"
+)
+
+// memBackend is an in-memory Backend holding the blocks 1 to height. It counts the
+// calls reaching the storage, each of them would be a query against the database.
+type memBackend struct {
+	blocks   map[int64]*memBlock
+	height   int64
+	sections map[int64][][]byte // indexed bloombits sections, decompressed vectors by bit
+
+	logsCap       int32
+	blockRangeCap int32
+	queries       int
+}
+
+type memBlock struct {
+	hash  common.Hash
+	bloom ethtypes.Bloom
+	logs  []dbdrive.Logs
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{
+		blocks:        make(map[int64]*memBlock),
+		sections:      make(map[int64][][]byte),
+		logsCap:       DefaultLogsCap,
+		blockRangeCap: DefaultBlockRangeCap,
+	}
+}
+
+// addBlock appends a block with the logs, their block fields and log indexes are filled in
+func (b *memBackend) addBlock(logs ...ethtypes.Log) int64 {
+	b.height++
+	block := &memBlock{hash: common.BigToHash(big.NewInt(b.height))}
+	for i := range logs {
+		logs[i].BlockNumber = uint64(b.height)
+		logs[i].BlockHash = block.hash
+		logs[i].Index = uint(i)
+		block.bloom.Add(logs[i].Address.Bytes())
+		for _, topic := range logs[i].Topics {
+			block.bloom.Add(topic.Bytes())
+		}
+	}
+	block.logs = dbdrive.ToLogs(logs)
+	b.blocks[b.height] = block
+	return b.height
+}
+
+// addBlocks appends n blocks without logs
+func (b *memBackend) addBlocks(n int) {
+	for i := 0; i < n; i++ {
+		b.addBlock()
+	}
+}
+
+// index builds the bloombits of the section from the stored blooms
+func (b *memBackend) index(t testing.TB, section int64) {
+	gen, err := bloombits.NewGenerator(dbdrive.BloomBitsSectionSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := section * dbdrive.BloomBitsSectionSize
+	for i := int64(0); i < dbdrive.BloomBitsSectionSize; i++ {
+		var bloom ethtypes.Bloom
+		if block, ok := b.blocks[from+i]; ok {
+			bloom = block.bloom
+		}
+		if err := gen.AddBloom(uint(i), bloom); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vectors := make([][]byte, ethtypes.BloomBitLength)
+	for bit := range vectors {
+		if vectors[bit], err = gen.Bitset(uint(bit)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.sections[section] = vectors
+}
+
+func (b *memBackend) BlockHeight() (int64, error) {
+	b.queries++
+	return b.height, nil
+}
+
+func (b *memBackend) BloomByNumber(height int64) (ethtypes.Bloom, bool, error) {
+	b.queries++
+	block, ok := b.blocks[height]
+	if !ok {
+		return ethtypes.Bloom{}, false, nil
+	}
+	return block.bloom, true, nil
+}
+
+func (b *memBackend) BloomByHash(blockHash common.Hash) (int64, ethtypes.Bloom, bool, error) {
+	b.queries++
+	for height, block := range b.blocks {
+		if block.hash == blockHash {
+			return height, block.bloom, true, nil
+		}
+	}
+	return 0, ethtypes.Bloom{}, false, nil
+}
+
+func (b *memBackend) BlockHashes(from, to int64) ([]common.Hash, error) {
+	b.queries++
+	var hashes []common.Hash
+	for height := from + 1; height <= to; height++ {
+		if block, ok := b.blocks[height]; ok {
+			hashes = append(hashes, block.hash)
+		}
+	}
+	return hashes, nil
+}
+
+func (b *memBackend) GetLogs(height int64) ([]dbdrive.Logs, error) {
+	b.queries++
+	if block, ok := b.blocks[height]; ok {
+		return block.logs, nil
+	}
+	return nil, nil
+}
+
+func (b *memBackend) BloomsByRange(from, to int64) ([]BlockBloom, error) {
+	b.queries++
+	var blooms []BlockBloom
+	for height := from; height <= to; height++ {
+		if block, ok := b.blocks[height]; ok {
+			blooms = append(blooms, BlockBloom{Height: height, Bloom: block.bloom})
+		}
+	}
+	return blooms, nil
+}
+
+func (b *memBackend) RangeLogs(from, to int64, heights []int64, addresses []common.Address, topics [][]common.Hash, limit int) ([]dbdrive.Logs, error) {
+	b.queries++
+	if len(heights) == 0 {
+		for height := from; height <= to; height++ {
+			heights = append(heights, height)
+		}
+	}
+	var logs []dbdrive.Logs
+	for _, height := range heights {
+		if block, ok := b.blocks[height]; ok && height >= from && height <= to {
+			logs = append(logs, FilterLogs(block.logs, nil, nil, addresses, topics)...)
+		}
+		if limit > 0 && len(logs) >= limit {
+			return logs[:limit], nil
+		}
+	}
+	return logs, nil
+}
+
+func (b *memBackend) BloomBitsSections(from, to int64) ([]int64, error) {
+	b.queries++
+	var sections []int64
+	for section := from; section <= to; section++ {
+		if b.sections[section] != nil {
+			sections = append(sections, section)
+		}
+	}
+	return sections, nil
+}
+
+func (b *memBackend) BloomBits(section int64, bits []uint) (map[uint][]byte, error) {
+	b.queries++
+	vectors, ok := b.sections[section]
+	if !ok {
+		return nil, dbdrive.ErrNotFound
+	}
+	ret := make(map[uint][]byte, len(bits))
+	for _, bit := range bits {
+		ret[bit] = vectors[bit]
+	}
+	return ret, nil
+}
+
+func (b *memBackend) RPCLogsCap() int32 {
+	return b.logsCap
+}
+
+func (b *memBackend) RPCBlockRangeCap() int32 {
+	return b.blockRangeCap
+}
+
+// newLog returns a log of the contract with the topics
+func newLog(address common.Address, topics ...common.Hash) ethtypes.Log {
+	return ethtypes.Log{Address: address, Topics: topics, Data: []byte{0x01}}
+}
+
+// logHeights returns the block number of every log
+func logHeights(t testing.TB, logs []dbdrive.Logs) []int64 {
+	heights := make([]int64, 0, len(logs))
+	for _, log := range logs {
+		number, err := hexutil.DecodeUint64(log.BlockNumber)
+		if err != nil {
+			t.Fatalf("invalid block number %q: %v", log.BlockNumber, err)
+		}
+		heights = append(heights, int64(number))
+	}
+	return heights
+}
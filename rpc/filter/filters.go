@@ -3,8 +3,8 @@ package filter
 import (
 	"blockchain-event-plugin/dbdrive"
 	"blockchain-event-plugin/logger"
+	"blockchain-event-plugin/metrics"
 	"encoding/binary"
-	"encoding/hex"
 	"github.com/ethereum/go-ethereum/common"
 	ethtypes "github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -15,6 +15,17 @@ import (
 
 const (
 	maxToOverhang = 600
+
+	// bloomChunkSize is the number of blooms read at once when scanning a block range
+	bloomChunkSize = 1000
+)
+
+var (
+	// 区间查询检查的区块数、其中由bloombits索引检查的区块数、bloom匹配的区块数和返回的logs数
+	blocksScannedCounter = metrics.NewCounter("filter/blocks/scanned")
+	blocksIndexedCounter = metrics.NewCounter("filter/blocks/indexed")
+	bloomHitsCounter     = metrics.NewCounter("filter/blocks/matched")
+	logsReturnedCounter  = metrics.NewCounter("filter/logs/returned")
 )
 
 // Filter can be used to retrieve and filter logs.
@@ -150,23 +161,19 @@ func (f *Filter) Logs(logLimit int, blockLimit int64) ([]dbdrive.Logs, error) {
 	// If we're doing singleton block filtering, execute and return
 	if f.criteria.BlockHash != nil && *f.criteria.BlockHash != (common.Hash{}) {
 		// get bloom
-		blockBloom, err := dbdrive.GetBlockNumAndBloomByBlockHash(f.criteria.BlockHash.String())
+		height, bloom, found, err := f.backend.BloomByHash(*f.criteria.BlockHash)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to fetch header by hash")
 		}
-		if &blockBloom == nil {
-			return nil, errors.Errorf("unknown bloom %s", f.criteria.BlockHash.String())
+		if !found {
+			return nil, errors.Wrapf(dbdrive.ErrNotFound, "unknown block %s", f.criteria.BlockHash.String())
 		}
 
-		//处理bloom
-		byteBloom, err := hex.DecodeString(blockBloom.Bloom)
-		bloom := ethtypes.BytesToBloom(byteBloom)
-
-		return f.blockLogs(blockBloom.BlockNumber, bloom)
+		return f.blockLogs(height, bloom)
 	}
 
 	// Figure out the limits of the filter range
-	blockHeight, err := dbdrive.GetBlockHeight()
+	blockHeight, err := f.backend.BlockHeight()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to fetch block height")
 	}
@@ -196,43 +203,124 @@ func (f *Filter) Logs(logLimit int, blockLimit int64) ([]dbdrive.Logs, error) {
 	from := f.criteria.FromBlock.Int64()
 	to := f.criteria.ToBlock.Int64()
 
-	for height := from; height <= to; height++ {
-		// 根据区块高度获取bloom
-		blockBloom, err := dbdrive.GetBloomByBlockNumber(height)
+	// 没有地址和topic条件时每个区块都匹配，整个区间一次查询，多取一条用于判断是否超过logLimit
+	if len(f.bloomFilters) == 0 {
+		logs, err = f.backend.RangeLogs(from, to, nil, f.criteria.Addresses, f.criteria.Topics, logLimit+1)
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrapf(err, "failed to fetch logs in [%d, %d]", from, to)
 		}
-		if blockBloom == "" {
-			logger.Debug("Block bloom not found or has no number")
-			return nil, nil
+		if len(logs) > logLimit {
+			return nil, errors.Errorf("query returned more than %d results", logLimit)
 		}
-		logger.Debug("api logs", " get block bloom ", blockBloom)
+		blocksScannedCounter.Inc(to - from + 1)
+		logsReturnedCounter.Inc(int64(len(logs)))
+		return logs, nil
+	}
 
-		byteBloom, err := hex.DecodeString(blockBloom)
-		bloom := ethtypes.BytesToBloom(byteBloom)
-		filtered, err := f.blockLogs(height, bloom)
+	// 已建立bloombits索引的section按位向量匹配，每个section只读取规则所需的bit位，
+	// 其余区间分段批量读取bloom
+	sections, err := f.backend.BloomBitsSections(from/dbdrive.BloomBitsSectionSize, to/dbdrive.BloomBitsSectionSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch bloombits sections")
+	}
+	for _, section := range sections {
+		begin := section * dbdrive.BloomBitsSectionSize
+		if begin < from {
+			begin = from
+		}
+		end := (section+1)*dbdrive.BloomBitsSectionSize - 1
+		if end > to {
+			end = to
+		}
+		if logs, err = f.scanBlooms(logs, from, begin-1, logLimit); err != nil {
+			return nil, err
+		}
+		heights, err := f.indexedHeights(section, begin, end)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to fetch block by number %d", height)
+			return nil, err
 		}
-		logger.Debug("api logs ", "filtered logs ", filtered)
+		blocksIndexedCounter.Inc(end - begin + 1)
+		if logs, err = f.appendLogs(logs, begin, end, heights, logLimit); err != nil {
+			return nil, err
+		}
+		from = end + 1
+	}
+	return f.scanBlooms(logs, from, to, logLimit)
+}
 
-		// check logs limit
-		if len(logs)+len(filtered) > logLimit {
-			return nil, errors.Errorf("query returned more than %d results", logLimit)
+// scanBlooms appends the logs of the unindexed range [from, to], the blooms are read in
+// chunks and checked in memory, then only the logs of the matching blocks are queried.
+func (f *Filter) scanBlooms(logs []dbdrive.Logs, from, to int64, logLimit int) ([]dbdrive.Logs, error) {
+	for begin := from; begin <= to; begin += bloomChunkSize {
+		end := begin + bloomChunkSize - 1
+		if end > to {
+			end = to
+		}
+		blooms, err := f.backend.BloomsByRange(begin, end)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to fetch blooms in [%d, %d]", begin, end)
+		}
+		var heights []int64
+		for _, bloom := range blooms {
+			if matchBloom(bloom.Bloom, f.bloomFilters) {
+				heights = append(heights, bloom.Height)
+			}
+		}
+		if logs, err = f.appendLogs(logs, begin, end, heights, logLimit); err != nil {
+			return nil, err
 		}
-		logs = append(logs, filtered...)
 	}
 	return logs, nil
 }
 
+// appendLogs appends the logs of the candidate blocks in [begin, end] matching the criteria,
+// failing once more than logLimit logs are found.
+func (f *Filter) appendLogs(logs []dbdrive.Logs, begin, end int64, heights []int64, logLimit int) ([]dbdrive.Logs, error) {
+	blocksScannedCounter.Inc(end - begin + 1)
+	bloomHitsCounter.Inc(int64(len(heights)))
+	if len(heights) == 0 {
+		return logs, nil
+	}
+	filtered, err := f.backend.RangeLogs(begin, end, heights, f.criteria.Addresses, f.criteria.Topics, logLimit-len(logs)+1)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch logs in [%d, %d]", begin, end)
+	}
+	// check logs limit
+	if len(logs)+len(filtered) > logLimit {
+		return nil, errors.Errorf("query returned more than %d results", logLimit)
+	}
+	logsReturnedCounter.Inc(int64(len(filtered)))
+	return append(logs, filtered...), nil
+}
+
+// matchBloom checks the bloom against the precomputed bit indexes of the filter rules,
+// every rule must have one of its clauses fully present in the bloom.
+func matchBloom(bloom ethtypes.Bloom, bloomFilters [][]BloomIV) bool {
+	for _, filter := range bloomFilters {
+		match := false
+		for _, iv := range filter {
+			if bloom[iv.I[0]]&iv.V[0] != 0 && bloom[iv.I[1]]&iv.V[1] != 0 && bloom[iv.I[2]]&iv.V[2] != 0 {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
 // blockLogs returns the logs matching the filter criteria within a single block.
 func (f *Filter) blockLogs(height int64, bloom ethtypes.Bloom) ([]dbdrive.Logs, error) {
+	blocksScannedCounter.Inc(1)
 	if !bloomFilter(bloom, f.criteria.Addresses, f.criteria.Topics) {
 		return []dbdrive.Logs{}, nil
 	}
+	bloomHitsCounter.Inc(1)
 
 	var logsList []dbdrive.Logs
-	logsList, err := dbdrive.GetLogsByBlockNumber(height)
+	logsList, err := f.backend.GetLogs(height)
 	if err != nil {
 		return []dbdrive.Logs{}, errors.Wrapf(err, "failed to fetch logs by block number %d", height)
 	}
@@ -242,6 +330,7 @@ func (f *Filter) blockLogs(height int64, bloom ethtypes.Bloom) ([]dbdrive.Logs,
 		unfiltered = append(unfiltered, logs)
 	}
 	logs := FilterLogs(unfiltered, nil, nil, f.criteria.Addresses, f.criteria.Topics)
+	logsReturnedCounter.Inc(int64(len(logs)))
 	if len(logs) == 0 {
 		return []dbdrive.Logs{}, nil
 	}
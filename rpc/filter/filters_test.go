@@ -0,0 +1,210 @@
+package filter
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/eth/filters"
+	"github.com/pkg/errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var (
+	addrA  = common.HexToAddress("0x000000000000000000000000000000000000000a")
+	addrB  = common.HexToAddress("0x000000000000000000000000000000000000000b")
+	topic1 = common.HexToHash("0x01")
+	topic2 = common.HexToHash("0x02")
+	topic3 = common.HexToHash("0x03")
+)
+
+// newTestBackend stores 20 blocks: A logs at 5 and 15, a B log at 10 and
+// a block 12 with both, the other blocks have no logs
+func newTestBackend() *memBackend {
+	b := newMemBackend()
+	b.addBlocks(4)
+	b.addBlock(newLog(addrA, topic1, topic2))                // 5
+	b.addBlocks(4)                                           // 6-9
+	b.addBlock(newLog(addrB, topic1))                        // 10
+	b.addBlocks(1)                                           // 11
+	b.addBlock(newLog(addrA, topic3), newLog(addrB, topic2)) // 12
+	b.addBlocks(2)                                           // 13-14
+	b.addBlock(newLog(addrA, topic2, topic1), newLog(addrA)) // 15
+	b.addBlocks(5)                                           // 16-20
+	return b
+}
+
+func TestFilterLogs(t *testing.T) {
+	tests := []struct {
+		name      string
+		from, to  int64
+		addresses []common.Address
+		topics    [][]common.Hash
+		want      []int64
+	}{
+		{name: "all", from: 1, to: 20, want: []int64{5, 10, 12, 12, 15, 15}},
+		{name: "range", from: 6, to: 12, want: []int64{10, 12, 12}},
+		{name: "single block", from: 12, to: 12, want: []int64{12, 12}},
+		{name: "latest", from: -1, to: -1},
+		{name: "beyond head", from: 21, to: 30},
+		{name: "address", from: 1, to: 20, addresses: []common.Address{addrA}, want: []int64{5, 12, 15, 15}},
+		{name: "addresses", from: 1, to: 11, addresses: []common.Address{addrA, addrB}, want: []int64{5, 10}},
+		{name: "topic0", from: 1, to: 20, topics: [][]common.Hash{{topic1}}, want: []int64{5, 10}},
+		{name: "topic0 or", from: 1, to: 20, topics: [][]common.Hash{{topic1, topic3}}, want: []int64{5, 10, 12}},
+		{name: "topic1 wildcard topic0", from: 1, to: 20, topics: [][]common.Hash{nil, {topic1}}, want: []int64{15}},
+		{name: "wildcard requires topic", from: 1, to: 20, addresses: []common.Address{addrA}, topics: [][]common.Hash{nil}, want: []int64{5, 12, 15}},
+		{name: "address and topic", from: 1, to: 20, addresses: []common.Address{addrB}, topics: [][]common.Hash{{topic2}}, want: []int64{12}},
+		{name: "no match", from: 1, to: 20, addresses: []common.Address{addrB}, topics: [][]common.Hash{{topic3}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newTestBackend()
+			filter := NewRangeFilter(backend, test.from, test.to, test.addresses, test.topics)
+			logs, err := filter.Logs(int(backend.logsCap), int64(backend.blockRangeCap))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := logHeights(t, logs); len(got) != len(test.want) || (len(got) > 0 && !reflect.DeepEqual(got, test.want)) {
+				t.Errorf("got logs of blocks %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterLogsIndexed(t *testing.T) {
+	backend := newMemBackend()
+	backend.addBlocks(dbdrive.BloomBitsSectionSize - 2)
+	backend.addBlock(newLog(addrA, topic1))             // last block of section 0
+	backend.addBlock(newLog(addrA, topic2))             // first block of section 1
+	backend.addBlocks(dbdrive.BloomBitsSectionSize - 1) // rest of section 1
+	backend.addBlock(newLog(addrA, topic1))             // section 2, not indexed
+	backend.index(t, 0)
+	backend.index(t, 1)
+
+	filter := NewRangeFilter(backend, 1, backend.height, []common.Address{addrA}, nil)
+	logs, err := filter.Logs(int(backend.logsCap), int64(backend.blockRangeCap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{dbdrive.BloomBitsSectionSize - 1, dbdrive.BloomBitsSectionSize, 2 * dbdrive.BloomBitsSectionSize}
+	if got := logHeights(t, logs); !reflect.DeepEqual(got, want) {
+		t.Errorf("got logs of blocks %v, want %v", got, want)
+	}
+
+	filter = NewRangeFilter(backend, 1, backend.height, nil, [][]common.Hash{{topic1}})
+	if logs, err = filter.Logs(int(backend.logsCap), int64(backend.blockRangeCap)); err != nil {
+		t.Fatal(err)
+	}
+	want = []int64{dbdrive.BloomBitsSectionSize - 1, 2 * dbdrive.BloomBitsSectionSize}
+	if got := logHeights(t, logs); !reflect.DeepEqual(got, want) {
+		t.Errorf("got logs of blocks %v, want %v", got, want)
+	}
+
+	// section 0被标记为失效后，其区间回退为扫描bloom
+	delete(backend.sections, 0)
+	filter = NewRangeFilter(backend, 1, backend.height, nil, [][]common.Hash{{topic1}})
+	if logs, err = filter.Logs(int(backend.logsCap), int64(backend.blockRangeCap)); err != nil {
+		t.Fatal(err)
+	}
+	if got := logHeights(t, logs); !reflect.DeepEqual(got, want) {
+		t.Errorf("section 1 indexed only: got logs of blocks %v, want %v", got, want)
+	}
+}
+
+func TestFilterLogsLimits(t *testing.T) {
+	backend := newTestBackend()
+	backend.logsCap = 3
+
+	// 无过滤条件和有过滤条件的查询都不能超过logs上限
+	_, err := NewRangeFilter(backend, 1, 20, nil, nil).Logs(int(backend.logsCap), int64(backend.blockRangeCap))
+	if err == nil || !strings.Contains(err.Error(), "more than 3 results") {
+		t.Errorf("unfiltered query over the logs cap: got error %v", err)
+	}
+	_, err = NewRangeFilter(backend, 1, 20, []common.Address{addrA}, nil).Logs(int(backend.logsCap), int64(backend.blockRangeCap))
+	if err == nil || !strings.Contains(err.Error(), "more than 3 results") {
+		t.Errorf("filtered query over the logs cap: got error %v", err)
+	}
+	logs, err := NewRangeFilter(backend, 6, 12, []common.Address{addrA, addrB}, nil).Logs(int(backend.logsCap), int64(backend.blockRangeCap))
+	if err != nil || len(logs) != 3 {
+		t.Errorf("query at the logs cap: got %d logs, error %v", len(logs), err)
+	}
+
+	_, err = NewRangeFilter(backend, 1, 20, nil, nil).Logs(int(backend.logsCap), 10)
+	if err == nil || !strings.Contains(err.Error(), "maximum [from, to] blocks distance") {
+		t.Errorf("query over the block range cap: got error %v", err)
+	}
+}
+
+func TestFilterLogsByHash(t *testing.T) {
+	backend := newTestBackend()
+	hash := backend.blocks[12].hash
+	filter := NewBlockFilter(backend, filters.FilterCriteria{BlockHash: &hash, Addresses: []common.Address{addrB}})
+	logs, err := filter.Logs(int(backend.logsCap), int64(backend.blockRangeCap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].Address != strings.ToLower(addrB.String()) || logs[0].LogIndex != "0x1" {
+		t.Errorf("got logs %+v, want the B log of block 12", logs)
+	}
+
+	unknown := common.HexToHash("0xff")
+	filter = NewBlockFilter(backend, filters.FilterCriteria{BlockHash: &unknown})
+	if _, err := filter.Logs(int(backend.logsCap), int64(backend.blockRangeCap)); !errors.Is(err, dbdrive.ErrNotFound) {
+		t.Errorf("unknown block: got error %v, want not found", err)
+	}
+}
+
+// perBlockLogs is the scan used before the blooms were read in chunks: the bloom
+// of every block is read on its own, then the logs of the matching blocks
+func perBlockLogs(f *Filter, from, to int64) ([]dbdrive.Logs, error) {
+	var logs []dbdrive.Logs
+	for height := from; height <= to; height++ {
+		bloom, found, err := f.backend.BloomByNumber(height)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		blockLogs, err := f.blockLogs(height, bloom)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, blockLogs...)
+	}
+	return logs, nil
+}
+
+// BenchmarkFilterLogsUnindexed compares the chunked bloom scan of the unindexed range with
+// the per-block loop over 10000 blocks with a log every 100 blocks. queries/op is the number
+// of calls reaching the storage, each of them a database round trip in production.
+func BenchmarkFilterLogsUnindexed(b *testing.B) {
+	const blocks = 10000
+	backend := newMemBackend()
+	for backend.height < blocks {
+		backend.addBlocks(99)
+		backend.addBlock(newLog(addrA, topic1))
+	}
+	want := blocks / 100
+
+	b.Run("chunked", func(b *testing.B) {
+		backend.queries = 0
+		for i := 0; i < b.N; i++ {
+			logs, err := NewRangeFilter(backend, 1, blocks, []common.Address{addrA}, nil).Logs(want, blocks)
+			if err != nil || len(logs) != want {
+				b.Fatalf("got %d logs, error %v", len(logs), err)
+			}
+		}
+		b.ReportMetric(float64(backend.queries)/float64(b.N), "queries/op")
+	})
+	b.Run("per-block", func(b *testing.B) {
+		backend.queries = 0
+		for i := 0; i < b.N; i++ {
+			logs, err := perBlockLogs(NewRangeFilter(backend, 1, blocks, []common.Address{addrA}, nil), 1, blocks)
+			if err != nil || len(logs) != want {
+				b.Fatalf("got %d logs, error %v", len(logs), err)
+			}
+		}
+		b.ReportMetric(float64(backend.queries)/float64(b.N), "queries/op")
+	})
+}
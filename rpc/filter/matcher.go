@@ -0,0 +1,86 @@
+package filter
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"github.com/ethereum/go-ethereum/common/bitutil"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+	"math/bits"
+)
+
+// bloomBit returns the index of the bloom bit set by the i-th byte index and value of the IV,
+// bit vectors are numbered like the bloombits generator, from the last byte of the bloom.
+func bloomBit(iv BloomIV, i int) uint {
+	return 8*(ethtypes.BloomByteLength-1-iv.I[i]) + uint(bits.TrailingZeros8(iv.V[i]))
+}
+
+// bloomBits returns the distinct bloom bits needed to match the filter rules
+func bloomBits(bloomFilters [][]BloomIV) []uint {
+	seen := make(map[uint]bool)
+	var needed []uint
+	for _, filter := range bloomFilters {
+		for _, iv := range filter {
+			for i := range iv.I {
+				if bit := bloomBit(iv, i); !seen[bit] {
+					seen[bit] = true
+					needed = append(needed, bit)
+				}
+			}
+		}
+	}
+	return needed
+}
+
+// matchSection matches the filter rules against the bit vectors of a section, the
+// returned vector has the bit of every candidate block set, most significant bit first.
+func matchSection(vectors map[uint][]byte, bloomFilters [][]BloomIV) []byte {
+	var matches []byte
+	for _, filter := range bloomFilters {
+		// 同一规则的clause之间为或，每个clause的3个bit为与
+		clauses := make([]byte, dbdrive.BloomBitsSectionSize/8)
+		for _, iv := range filter {
+			clause := make([]byte, len(clauses))
+			copy(clause, vectors[bloomBit(iv, 0)])
+			bitutil.ANDBytes(clause, clause, vectors[bloomBit(iv, 1)])
+			bitutil.ANDBytes(clause, clause, vectors[bloomBit(iv, 2)])
+			bitutil.ORBytes(clauses, clauses, clause)
+		}
+		// 规则之间为与
+		if matches == nil {
+			matches = clauses
+		} else {
+			bitutil.ANDBytes(matches, matches, clauses)
+		}
+		if !bitutil.TestBytes(matches) {
+			break
+		}
+	}
+	return matches
+}
+
+// sectionHeights returns the heights in [from, to] whose bit is set in the matches of the section
+func sectionHeights(section int64, matches []byte, from, to int64) []int64 {
+	var heights []int64
+	base := section * dbdrive.BloomBitsSectionSize
+	for i, b := range matches {
+		for b != 0 {
+			bit := bits.LeadingZeros8(b)
+			b &^= 0x80 >> uint(bit)
+			height := base + int64(8*i+bit)
+			if height >= from && height <= to {
+				heights = append(heights, height)
+			}
+		}
+	}
+	return heights
+}
+
+// indexedHeights returns the candidate blocks of a section in [from, to] using the
+// bloombits index, only the bit vectors of the filter rules are read.
+func (f *Filter) indexedHeights(section, from, to int64) ([]int64, error) {
+	vectors, err := f.backend.BloomBits(section, bloomBits(f.bloomFilters))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch bloombits of section %d", section)
+	}
+	return sectionHeights(section, matchSection(vectors, f.bloomFilters), from, to), nil
+}
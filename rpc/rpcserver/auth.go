@@ -0,0 +1,89 @@
+package rpcserver
+
+import (
+	"blockchain-event-plugin/logger"
+	"blockchain-event-plugin/rpc/rpcutil"
+	"blockchain-event-plugin/setting"
+	"net/http"
+)
+
+// defaultAuthMethods are the methods requiring a role when auth.methods is not configured,
+// the admin namespace and the backfill jobs write to the store
+var defaultAuthMethods = map[string]string{
+	"admin":                 "admin",
+	"plugin_startBackfill":  "admin",
+	"plugin_cancelBackfill": "admin",
+}
+
+// newAuthenticator 按auth配置创建各链共用的认证器，未开启时返回nil。
+// 配置错误时退出，避免管理接口在未认证的情况下开放
+func newAuthenticator() *rpcutil.Authenticator {
+	if !setting.GetBool("auth.enabled") {
+		return nil
+	}
+	var config rpcutil.AuthConfig
+	if err := setting.UnmarshalKey("auth", &config); err != nil {
+		logger.Fatal("[sys] Parse auth failed", "err", err)
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = defaultAuthMethods
+	}
+	auth, err := rpcutil.NewAuthenticator(config)
+	if err != nil {
+		logger.Fatal("[sys] Invalid auth config", "err", err)
+	}
+	return auth
+}
+
+// checkUnauthenticated 未开启auth时，开放admin命名空间、回填任务的写方法、/metrics或要求/status认证则退出
+func checkUnauthenticated(auth *rpcutil.Authenticator) {
+	if auth != nil {
+		return
+	}
+	if namespaceExposed("admin") {
+		logger.Fatal("[sys] The admin namespace requires auth.enabled")
+	}
+	if setting.GetBool("backfill.rpc_enabled") && namespaceExposed("plugin") {
+		logger.Fatal("[sys] backfill.rpc_enabled requires auth.enabled")
+	}
+	if setting.GetBool("rpc.metrics_endpoint") {
+		logger.Fatal("[sys] rpc.metrics_endpoint requires auth.enabled")
+	}
+	if setting.GetBool("rpc.status_auth") {
+		logger.Fatal("[sys] rpc.status_auth requires auth.enabled")
+	}
+}
+
+// namespaceExposed 命名空间是否由HTTP或WebSocket开放，模块列表为空时开放全部
+func namespaceExposed(namespace string) bool {
+	for _, key := range []string{"rpc.http_modules", "rpc.ws_modules"} {
+		modules := setting.GetStringSlice(key)
+		if len(modules) == 0 {
+			return true
+		}
+		for _, module := range modules {
+			if module == namespace {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requireAdmin 要求请求的客户端具有admin命名空间需要的角色
+func requireAdmin(auth *rpcutil.Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, role, err := auth.Authenticate(req)
+		required := auth.Required("admin")
+		switch {
+		case err != nil:
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		case role >= required:
+			next.ServeHTTP(w, req)
+		case role == rpcutil.RolePublic:
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "authentication required"})
+		default:
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "requires the " + required.String() + " role"})
+		}
+	})
+}
@@ -0,0 +1,20 @@
+package rpcserver
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"blockchain-event-plugin/types"
+	"github.com/pkg/errors"
+)
+
+// errorMsg maps the store errors to their JSON-RPC errors, other errors are reported as fallback
+func errorMsg(err error, fallback *types.Error) *types.Error {
+	switch {
+	case errors.Is(err, dbdrive.ErrNotFound):
+		return types.ErrorMsg(types.ResourceNotFound.Code, types.ResourceNotFound.Message, err.Error())
+	case errors.Is(err, dbdrive.ErrUnavailable):
+		return types.ErrorMsg(types.ResourceUnavailable.Code, types.ResourceUnavailable.Message, err.Error())
+	case errors.Is(err, dbdrive.ErrInvalidData):
+		return types.ErrorMsg(types.SystemError.Code, types.SystemError.Message, err.Error())
+	}
+	return types.ErrorMsg(fallback.Code, fallback.Message, err.Error())
+}
@@ -0,0 +1,154 @@
+package rpcserver
+
+import (
+	"blockchain-event-plugin/logger"
+	"blockchain-event-plugin/metrics"
+	"blockchain-event-plugin/rpc/rpcutil"
+	"blockchain-event-plugin/setting"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// probeTimeout bounds the upstream node check of /readyz
+const probeTimeout = 5 * time.Second
+
+// readiness is the /readyz document, a check is "ok", "error" or why it is not ready
+type readiness struct {
+	Ready  bool             `json:"ready"`
+	Server string           `json:"server"`
+	Store  string           `json:"store"`
+	Chains []chainReadiness `json:"chains"`
+}
+
+type chainReadiness struct {
+	ChainID  int64  `json:"chainId"`
+	Upstream string `json:"upstream"`
+}
+
+// chainStatus is the ingestion progress of a chain reported by /status
+type chainStatus struct {
+	ChainID       int64      `json:"chainId"`
+	IndexedHead   int64      `json:"indexedHead"`
+	UpstreamHead  int64      `json:"upstreamHead"`
+	LagBlocks     int64      `json:"lagBlocks"`
+	LagSeconds    *int64     `json:"lagSeconds"` // null until the timestamp of the indexed head is known
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+	Error         string     `json:"error,omitempty"` // why the status is incomplete
+}
+
+// handleEndpoints serves /healthz, /readyz, /status, and /metrics when rpc.metrics_endpoint is on.
+// /status requires the role of the admin namespace when rpc.status_auth is on, /metrics always does.
+// Other requests go to next.
+func (r *RPC) handleEndpoints(next http.Handler, auth *rpcutil.Authenticator) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", next)
+	if setting.GetBool("rpc.metrics_endpoint") && metrics.Enabled() {
+		mux.Handle("/metrics", requireAdmin(auth, metrics.Handler()))
+	}
+	var status http.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"chains": r.status()})
+	})
+	if setting.GetBool("rpc.status_auth") {
+		status = requireAdmin(auth, status)
+	}
+	mux.Handle("/status", status)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		ready := r.readiness(req.Context())
+		code := http.StatusOK
+		if !ready.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, ready)
+	})
+	return mux
+}
+
+// readiness 检查服务未在关闭、数据库可用且每条链的上游节点可访问，
+// 检查失败时只返回error，错误详情记录到日志
+func (r *RPC) readiness(ctx context.Context) readiness {
+	ready := readiness{Ready: true, Server: "ok", Store: "ok", Chains: []chainReadiness{}}
+	for _, server := range r.servers {
+		if server.GetState() == 1 {
+			ready.Ready, ready.Server = false, "closing"
+		}
+	}
+	// 各链的存储共用同一连接
+	if len(r.chains) > 0 {
+		if err := r.chains[0].Store.Ping(); err != nil {
+			logger.Error("Readiness ping store error", "err", err)
+			ready.Ready, ready.Store = false, "error"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	for _, chain := range r.chains {
+		check := chainReadiness{ChainID: chain.Chain.ChainID, Upstream: "ok"}
+		if chain.Sync == nil {
+			check.Upstream = "sync service not started"
+		} else if err := chain.Sync.Ping(ctx); err != nil {
+			logger.Error("Readiness ping upstream error", "chainId", chain.Chain.ChainID, "err", err)
+			check.Upstream = "error"
+		}
+		if check.Upstream != "ok" {
+			ready.Ready = false
+		}
+		ready.Chains = append(ready.Chains, check)
+	}
+	return ready
+}
+
+// status 获取每条链的已索引高度、上游高度、落后的区块数和秒数以及最近的同步错误
+func (r *RPC) status() []chainStatus {
+	chains := make([]chainStatus, 0, len(r.chains))
+	for _, chain := range r.chains {
+		status := chainStatus{ChainID: chain.Chain.ChainID}
+		height, err := chain.Store.GetBlockHeight()
+		if err != nil {
+			logger.Error("Status get block height error", "chainId", chain.Chain.ChainID, "err", err)
+			status.Error = "get block height error"
+		}
+		status.IndexedHead = height
+
+		if chain.Sync == nil {
+			status.Error = "sync service not started"
+			chains = append(chains, status)
+			continue
+		}
+		progress := chain.Sync.Status()
+		status.UpstreamHead = progress.UpstreamHead
+		if progress.IndexedHead == height {
+			blocks, seconds := progress.Lag()
+			status.LagBlocks = blocks
+			if seconds >= 0 {
+				status.LagSeconds = &seconds
+			}
+		} else if lag := progress.UpstreamHead - height; lag > 0 && err == nil {
+			// 同步服务尚未记录存储的高度时只计算落后的区块数
+			status.LagBlocks = lag
+		}
+		if progress.LastError != "" {
+			status.LastError = progress.LastError
+			status.LastErrorTime = &progress.LastErrorTime
+		}
+		chains = append(chains, status)
+	}
+	return chains
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	byts, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(byts)
+}
@@ -3,43 +3,278 @@ package rpcserver
 import (
 	"blockchain-event-plugin/dbdrive"
 	"blockchain-event-plugin/logger"
+	"blockchain-event-plugin/rpc/decoder"
 	"blockchain-event-plugin/rpc/filter"
 	"blockchain-event-plugin/rpc/rpcutil"
+	"blockchain-event-plugin/setting"
+	"blockchain-event-plugin/syncer"
 	"blockchain-event-plugin/types"
 	"context"
-	"encoding/json"
-	"github.com/ethereum/go-ethereum"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/eth/filters"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/rpc"
-	"math/big"
-	"os"
-	"strconv"
+	"github.com/pkg/errors"
+	"net/http"
+	"sync"
 	"time"
 )
 
-// 启动HTTP RPC
-func StartRPC(addr string) {
+// ChainService is the store and sync service of a chain served over RPC,
+// Sync is nil when the sync service of the chain failed to start
+type ChainService struct {
+	Chain syncer.Chain
+	Store dbdrive.Store
+	Sync  *syncer.Service
+}
+
+// RPC is the running HTTP and WebSocket RPC listeners of the chains
+type RPC struct {
+	chains  []ChainService
+	servers []*rpcutil.Server
+	filters []*filter.PublicFilterAPI
+	http    *http.Server
+	ws      *http.Server
+	errc    chan error
+
+	stopOnce sync.Once
+	quit     chan struct{} // closed by Shutdown to stop the removed logs handlers
+}
+
+// 启动HTTP RPC，wsAddr不为空时同时启动WebSocket RPC。
+// 请求通过/chain/{id}路径或X-Chain-Id请求头选择链，未指定时使用第一条链，
+// HTTP端口同时提供/healthz、/readyz、/status，rpc.metrics_endpoint开启时提供需要admin角色的/metrics。
+// 未开启auth时开放admin命名空间、回填任务的写方法、/metrics或要求/status认证则退出
+func StartRPC(addr, wsAddr string, chains []ChainService) *RPC {
+	httpRouter := rpcutil.NewChainRouter()
+	wsRouter := rpcutil.NewChainRouter()
+	r := &RPC{chains: chains, errc: make(chan error, 2), quit: make(chan struct{})}
+	auth, limiter := newAuthenticator(), newRateLimiter()
+	checkUnauthenticated(auth)
+	for _, chain := range chains {
+		server, filterAPI := newServer(chain, auth, limiter, r.quit)
+		r.servers = append(r.servers, server)
+		r.filters = append(r.filters, filterAPI)
+		httpRouter.Handle(chain.Chain.ChainID, server.HTTPHandler(setting.GetStringSlice("rpc.http_modules")))
+		wsRouter.Handle(chain.Chain.ChainID, server.WSHandler(setting.GetStringSlice("rpc.ws_modules")))
+	}
+
+	if wsAddr != "" {
+		logger.Info("[sys] Listen WebSocket RPC on", wsAddr)
+		r.ws = rpcutil.NewWSServer(wsAddr, wsRouter)
+		go r.serve(r.ws, "WebSocket")
+	}
+
+	logger.Info("[sys] Listen HTTP RPC on", addr)
+	r.http = rpcutil.NewHTTPServer(addr, r.handleEndpoints(httpRouter, auth))
+	go r.serve(r.http, "HTTP")
+	return r
+}
+
+func (r *RPC) serve(server *http.Server, name string) {
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		r.errc <- errors.Wrapf(err, "RPC server over %s", name)
+	}
+}
+
+// Err returns the channel receiving the error of a listener that stopped unexpectedly
+func (r *RPC) Err() <-chan error {
+	return r.errc
+}
+
+// Shutdown 拒绝新请求并关闭WebSocket连接，停止过滤器的后台任务，等待进行中的HTTP请求完成，ctx到期时返回错误
+func (r *RPC) Shutdown(ctx context.Context) error {
+	for _, server := range r.servers {
+		server.Close()
+	}
+	r.stopOnce.Do(func() { close(r.quit) })
+	for _, filterAPI := range r.filters {
+		filterAPI.Stop()
+	}
+	var err error
+	if r.ws != nil {
+		err = r.ws.Shutdown(ctx)
+	}
+	if httpErr := r.http.Shutdown(ctx); httpErr != nil {
+		err = httpErr
+	}
+	return err
+}
+
+// newServer 创建链的RPC服务并注册API，auth不为nil时校验请求的权限，limiter不为nil时按客户端限流。
+// 返回的过滤器API需要在关闭时停止，quit关闭时停止处理回退的logs
+func newServer(chain ChainService, auth *rpcutil.Authenticator, limiter *rpcutil.RateLimiter,
+	quit <-chan struct{}) (*rpcutil.Server, *filter.PublicFilterAPI) {
+	store, syncService := chain.Store, chain.Sync
+	filterAPI := filter.NewPublicAPI(filter.NewBackend(store))
+	if syncService != nil {
+		go handleRemovedLogs(filterAPI, syncService, quit)
+	}
+
 	server := rpcutil.NewServer()
-	err := server.Register(new(PublicRPCAPI))
+	server.SetBatchLimit(setting.GetInt("rpc.batch_limit"), setting.GetInt("rpc.batch_concurrency"))
+	server.SetOrigins(setting.GetStringSlice("rpc.ws_origins"))
+	if auth != nil {
+		server.SetAuthenticator(auth)
+	}
+	if limiter != nil {
+		server.SetRateLimiter(limiter)
+		server.SetWeight("eth_getLogs", logsWeight(store))
+		server.SetWeight("plugin_getDecodedLogs", logsWeight(store))
+	}
+	err := server.Register("eth", &PublicRPCAPI{store: store, filterAPI: filterAPI, syncService: syncService})
+	if err != nil {
+		logger.Error("StartRPC Register err", err)
+	}
+	registry := decoder.NewRegistry(store)
+	err = server.Register("admin", &PrivateAdminAPI{store: store, registry: registry, syncService: syncService})
+	if err != nil {
+		logger.Error("StartRPC Register err", err)
+	}
+	err = server.Register("plugin", &PluginAPI{filterAPI: filterAPI, registry: registry, syncService: syncService,
+		backfill: setting.GetBool("backfill.rpc_enabled")})
 	if err != nil {
 		logger.Error("StartRPC Register err", err)
 	}
+	if err := registerSubscriptions(server, syncService); err != nil {
+		logger.Error("StartRPC RegisterSubscription err", err)
+	}
+	return server, filterAPI
+}
 
-	go func() {
-		// 监听退出信号
-		s := <-make(chan os.Signal)
-		// 关闭网络服务
-		server.SetState(1)
-		logger.Debug("[sig] exit signal capture", "signal", s)
-	}()
+// handleRemovedLogs 链重组时通知过滤器回退，订阅因处理过慢被丢弃时重新订阅，quit关闭时退出
+func handleRemovedLogs(filterAPI *filter.PublicFilterAPI, syncService *syncer.Service, quit <-chan struct{}) {
+	removedCh := make(chan syncer.RemovedLogsEvent, 16)
+	sub := syncService.SubscribeRemovedLogsEvent(removedCh)
+	defer func() { sub.Unsubscribe() }()
 
-	logger.Info("[sys] Listen HTTP RPC on", addr)
-	server.ListenHTTPServe(addr)
+	for {
+		select {
+		case ev := <-removedCh:
+			filterAPI.HandleRemovedLogs(ev.Ancestor, ev.Logs)
+		case err := <-sub.Err():
+			if err == nil {
+				return
+			}
+			logger.Warn("Removed logs subscription dropped, resubscribe", "err", err)
+			sub = syncService.SubscribeRemovedLogsEvent(removedCh)
+		case <-quit:
+			return
+		}
+	}
 }
 
 type PublicRPCAPI struct {
+	store       dbdrive.Store
+	filterAPI   *filter.PublicFilterAPI
+	syncService *syncer.Service
+}
+
+// BlockNumber returns the highest stored block number
+func (i *PublicRPCAPI) BlockNumber(reply *interface{}) error {
+	height, err := i.store.GetBlockHeight()
+	if err != nil {
+		logger.Error("BlockNumber error", "err", err)
+		return errorMsg(err, types.SystemError)
+	}
+	*reply = hexutil.Uint64(height)
+	return nil
+}
+
+// ChainId returns the chain id of the synced chain
+func (i *PublicRPCAPI) ChainId(reply *interface{}) error {
+	if i.syncService == nil {
+		return types.ErrorMsg(types.SystemError.Code, types.SystemError.Message, "sync service is not running")
+	}
+	chainID, err := i.syncService.ChainID()
+	if err != nil {
+		logger.Error("ChainId error", "err", err)
+		return errorMsg(err, types.SystemError)
+	}
+	*reply = (*hexutil.Big)(chainID)
+	return nil
+}
+
+// GetBlockByNumber returns the stored header fields of the block, or null if it is not stored.
+// Transactions are not indexed, so fullTx is ignored and transactions is always empty.
+func (i *PublicRPCAPI) GetBlockByNumber(number rpc.BlockNumber, fullTx bool, reply *interface{}) error {
+	height := number.Int64()
+	if number == rpc.LatestBlockNumber || number == rpc.PendingBlockNumber {
+		var err error
+		if height, err = i.store.GetBlockHeight(); err != nil {
+			logger.Error("GetBlockByNumber error", "number", number, "err", err)
+			return errorMsg(err, types.SystemError)
+		}
+	}
+	block, err := i.store.GetBlockByNumber(height)
+	if errors.Is(err, dbdrive.ErrNotFound) {
+		*reply = nil
+		return nil
+	}
+	if err != nil {
+		logger.Error("GetBlockByNumber error", "number", number, "err", err)
+		return errorMsg(err, types.SystemError)
+	}
+	rpcBlock, err := storedBlock(block)
+	if err != nil {
+		return err
+	}
+	*reply = rpcBlock
+	return nil
+}
+
+// GetBlockByHash returns the stored header fields of the block, or null if it is not stored.
+// Transactions are not indexed, so fullTx is ignored and transactions is always empty.
+func (i *PublicRPCAPI) GetBlockByHash(hash common.Hash, fullTx bool, reply *interface{}) error {
+	block, err := i.store.GetBlockByHash(hash.String())
+	if errors.Is(err, dbdrive.ErrNotFound) {
+		*reply = nil
+		return nil
+	}
+	if err != nil {
+		logger.Error("GetBlockByHash error", "hash", hash, "err", err)
+		return errorMsg(err, types.SystemError)
+	}
+	rpcBlock, err := storedBlock(block)
+	if err != nil {
+		return err
+	}
+	*reply = rpcBlock
+	return nil
+}
+
+// rpcBlock is a block returned by eth_getBlockBy*
+type rpcBlock struct {
+	types.Block
+	Transactions []string `json:"transactions"`
+}
+
+// storedBlock builds the block from the stored bloom and header fields. Blocks stored
+// before the header fields were indexed have no parent hash and are reported as such.
+func storedBlock(block dbdrive.BlockBloom) (*rpcBlock, error) {
+	if block.ParentHash == "" {
+		return nil, types.ErrorMsg(types.ResourceNotFound.Code, types.ResourceNotFound.Message,
+			fmt.Sprintf("header of block %d is not stored", block.BlockNumber))
+	}
+	extraData := block.ExtraData
+	if extraData == "" {
+		extraData = "0x"
+	}
+	return &rpcBlock{
+		Block: types.Block{
+			Number:     hexutil.Uint64(block.BlockNumber),
+			Hash:       block.BlockHash,
+			ParentHash: block.ParentHash,
+			LogsBloom:  block.Bloom,
+			Timestamp:  hexutil.Uint64(block.Timestamp),
+			GasLimit:   hexutil.Uint64(block.GasLimit),
+			GasUsed:    hexutil.Uint64(block.GasUsed),
+			Miner:      block.Miner,
+			ExtraData:  extraData,
+		},
+		Transactions: []string{},
+	}, nil
 }
 
 // GetLogs
@@ -48,18 +283,13 @@ func (i *PublicRPCAPI) GetLogs(crit filters.FilterCriteria, reply *interface{})
 	start := time.Now()
 
 	if len(crit.Addresses) == 0 && len(crit.Topics) == 0 && crit.BlockHash == nil {
-		types.InvalidParams.Data = "Parameters is empty"
-		*reply = types.Responses("000000", types.InvalidParams, nil)
-		return nil
+		return types.ErrorMsg(types.InvalidParams.Code, types.InvalidParams.Message, "Parameters is empty")
 	}
 
-	publicFilterAPI := filter.NewPublicAPI()
-	logs, err := publicFilterAPI.HandleGetLogs(crit)
+	logs, err := i.filterAPI.HandleGetLogs(crit)
 	if err != nil {
 		logger.Error("GetLogs error", "args", crit, "err", err)
-		types.InvalidParams.Data = err.Error()
-		*reply = types.Responses("000000", types.InvalidParams, nil)
-		return nil
+		return errorMsg(err, types.InvalidParams)
 	}
 	if logs == nil || len(logs) == 0 {
 		*reply = []dbdrive.Logs{}
@@ -70,101 +300,156 @@ func (i *PublicRPCAPI) GetLogs(crit filters.FilterCriteria, reply *interface{})
 	return nil
 }
 
-//Save logs
-func (i *PublicRPCAPI) SyncBlockAndLogs(crit filters.FilterCriteria, reply *interface{}) error {
-
-	url := os.Getenv("SyncRpcAddr")
-	//url := "https://mainnet.block.caduceus.foundation"
+// NewFilter
+func (i *PublicRPCAPI) NewFilter(crit filters.FilterCriteria, reply *interface{}) error {
+	id, err := i.filterAPI.NewFilter(crit)
+	if err != nil {
+		logger.Error("NewFilter error", "args", crit, "err", err)
+		return errorMsg(err, types.InvalidParams)
+	}
+	*reply = id
+	return nil
+}
 
-	//-------------------- 从链上查指定高度的区块信息并存储 --------------------
-	rpcclient, err := rpc.Dial(url)
-	if rpcclient == nil {
-		logger.Error("SyncBlockAndLogs rpcclient dial url failed.", "args:", crit, "err:", err)
-		types.SystemError.Data = err.Error()
-		*reply = types.Responses("000000", types.SystemError, nil)
-		return nil
+// NewBlockFilter
+func (i *PublicRPCAPI) NewBlockFilter(reply *interface{}) error {
+	id, err := i.filterAPI.NewBlockFilter()
+	if err != nil {
+		logger.Error("NewBlockFilter error", "err", err)
+		return errorMsg(err, types.SystemError)
 	}
+	*reply = id
+	return nil
+}
 
-	fromBlockStr := crit.FromBlock.String()
-	toBlockStr := crit.ToBlock.String()
-	fromBlockInt, err := strconv.ParseInt(fromBlockStr, 10, 64)
+// GetFilterChanges
+func (i *PublicRPCAPI) GetFilterChanges(id rpc.ID, reply *interface{}) error {
+	changes, err := i.filterAPI.GetFilterChanges(id)
 	if err != nil {
-		logger.Error("SyncBlockAndLogs Parse FromBlock error.", "args:", crit, "err:", err)
-		types.InvalidParams.Data = err.Error()
-		*reply = types.Responses("000000", types.InvalidParams, nil)
-		return nil
+		logger.Error("GetFilterChanges error", "id", id, "err", err)
+		return errorMsg(err, types.InvalidParams)
 	}
-	toBlockInt, err := strconv.ParseInt(toBlockStr, 10, 64)
+	*reply = changes
+	return nil
+}
+
+// GetFilterLogs
+func (i *PublicRPCAPI) GetFilterLogs(id rpc.ID, reply *interface{}) error {
+	logs, err := i.filterAPI.GetFilterLogs(id)
 	if err != nil {
-		logger.Error("SyncBlockAndLogs Parse ToBlock error.", "args:", crit, "err:", err)
-		types.InvalidParams.Data = err.Error()
-		*reply = types.Responses("000000", types.InvalidParams, nil)
-		return nil
+		logger.Error("GetFilterLogs error", "id", id, "err", err)
+		return errorMsg(err, types.InvalidParams)
 	}
+	*reply = logs
+	return nil
+}
 
-	var raw json.RawMessage
-	for i := fromBlockInt; i <= toBlockInt; i++ {
-		//先查库 没有再存
-		bloom, err := dbdrive.GetBloomByBlockNumber(i)
-		if err != nil {
-			logger.Error("SyncBlockAndLogs GetBloomByBlockNumber before save block_bloom error.", "args:", crit, "err:", err)
-			types.SystemError.Data = err.Error()
-			*reply = types.Responses("000000", types.SystemError, nil)
-			return nil
-		}
-		if len(bloom) > 0 {
-			continue
-		}
-		//链上获取block相关信息
-		err = rpcclient.Call(&raw, "eth_getBlockByNumber", hexutil.EncodeBig(big.NewInt(i)), false)
-		if err != nil {
-			logger.Error("SyncBlockAndLogs rpcclient.Call error.", "args:", crit, "err:", err)
-			types.SystemError.Data = err.Error()
-			*reply = types.Responses("000000", types.SystemError, nil)
-			return nil
-		}
-		//处理数据
-		var block types.Block
-		json.Unmarshal(raw, &block)
+// UninstallFilter
+func (i *PublicRPCAPI) UninstallFilter(id rpc.ID, reply *interface{}) error {
+	*reply = i.filterAPI.UninstallFilter(id)
+	return nil
+}
+
+// PrivateAdminAPI offers the ingestion methods of the admin namespace
+type PrivateAdminAPI struct {
+	store       dbdrive.Store
+	registry    *decoder.Registry
+	syncService *syncer.Service
+}
 
-		//save block_blomm
-		dbdrive.SaveBloom(int64(block.Number), block.Hash, block.LogsBloom)
+// AddWatch adds the contract to the watch list, only the logs whose topic0 is in topics are
+// indexed when topics is given. A new contract is backfilled from fromBlock in the background.
+func (i *PrivateAdminAPI) AddWatch(address common.Address, topics *[]common.Hash, fromBlock *hexutil.Uint64, reply *interface{}) error {
+	if i.syncService == nil {
+		return types.ErrorMsg(types.SystemError.Code, types.SystemError.Message, "sync service is not running")
 	}
+	var topic0s []common.Hash
+	if topics != nil {
+		topic0s = *topics
+	}
+	var from int64
+	if fromBlock != nil {
+		from = int64(*fromBlock)
+	}
+	if err := i.syncService.AddWatch(address, topic0s, from); err != nil {
+		logger.Error("AddWatch error", "address", address, "err", err)
+		return errorMsg(err, types.SystemError)
+	}
+	*reply = true
+	return nil
+}
 
-	//---------------- 从链上根据区块高度查询logs并存储 --------------------
-	client, err := ethclient.Dial(url)
-	if err != nil {
-		logger.Error("SyncBlockAndLogs ethclient dial url failed.", "args:", crit, "err:", err)
-		types.SystemError.Data = err.Error()
-		*reply = types.Responses("000000", types.SystemError, nil)
-		return nil
+// RemoveWatch removes the contract from the watch list, its stored logs are kept
+func (i *PrivateAdminAPI) RemoveWatch(address common.Address, reply *interface{}) error {
+	if i.syncService == nil {
+		return types.ErrorMsg(types.SystemError.Code, types.SystemError.Message, "sync service is not running")
 	}
-	ctx := context.Background()
-	queryParam := ethereum.FilterQuery{
-		FromBlock: crit.FromBlock,
-		ToBlock:   crit.ToBlock,
+	if err := i.syncService.RemoveWatch(address); err != nil {
+		logger.Error("RemoveWatch error", "address", address, "err", err)
+		return errorMsg(err, types.SystemError)
 	}
-	ethlogs, err := client.FilterLogs(ctx, queryParam)
-	if err != nil {
-		logger.Error("SyncBlockAndLogs FilterLogs failed.", "args:", crit, "err:", err)
-		types.SystemError.Data = err.Error()
-		*reply = types.Responses("000000", types.SystemError, nil)
+	*reply = true
+	return nil
+}
+
+// WatchList returns the watched contracts, an empty list means every contract is indexed
+func (i *PrivateAdminAPI) WatchList(reply *interface{}) error {
+	if i.syncService == nil {
+		*reply = []dbdrive.Watch{}
 		return nil
 	}
+	*reply = i.syncService.WatchList().List()
+	return nil
+}
+
+// InvalidateBloomBits drops the bloombits index of the section, it is rebuilt from the stored blooms
+func (i *PrivateAdminAPI) InvalidateBloomBits(section hexutil.Uint64, reply *interface{}) error {
+	if i.syncService == nil {
+		return types.ErrorMsg(types.SystemError.Code, types.SystemError.Message, "sync service is not running")
+	}
+	if err := i.syncService.InvalidateBloomBits(int64(section)); err != nil {
+		logger.Error("InvalidateBloomBits error", "section", section, "err", err)
+		return errorMsg(err, types.SystemError)
+	}
+	*reply = true
+	return nil
+}
+
+// RegisterABI stores the ABI JSON of the contract, used by plugin_getDecodedLogs
+func (i *PrivateAdminAPI) RegisterABI(address common.Address, abiJSON string, reply *interface{}) error {
+	if err := i.registry.Register(address, abiJSON); err != nil {
+		logger.Error("RegisterABI error", "address", address, "err", err)
+		return errorMsg(err, types.InvalidParams)
+	}
+	*reply = true
+	return nil
+}
+
+// SyncBlockAndLogs stores the missing blocks and logs of the range with a backfill job
+// and waits until the job is finished, see plugin_startBackfill for a background job.
+func (i *PrivateAdminAPI) SyncBlockAndLogs(crit filters.FilterCriteria, reply *interface{}) error {
+	if i.syncService == nil {
+		return types.ErrorMsg(types.SystemError.Code, types.SystemError.Message, "sync service is not running")
+	}
+	if crit.FromBlock == nil || crit.ToBlock == nil {
+		return types.ErrorMsg(types.InvalidParams.Code, types.InvalidParams.Message, "fromBlock and toBlock are required")
+	}
 
-	//将查到的ethlogs遍历对比，如果库中没有 存储logs
-	for j := 0; j < len(ethlogs); j++ {
-		logs, err := dbdrive.GetLogByTxhashAndLogIndex(ethlogs[j])
+	status, err := i.syncService.StartBackfill(crit.FromBlock.Int64(), crit.ToBlock.Int64(), nil)
+	if err != nil {
+		logger.Error("SyncBlockAndLogs error", "args", crit, "err", err)
+		return backfillError(err)
+	}
+	final, err := i.syncService.WaitBackfill(int64(status.ID))
+	if err != nil || final == nil || final.Status != dbdrive.BackfillDone {
+		msg := "backfill job is still running"
 		if err != nil {
-			logger.Error("SyncBlockAndLogs GetLogByTxhashAndLogIndex before save logs error.", "args:", crit, "err:", err)
-			types.SystemError.Data = err.Error()
-			*reply = types.Responses("000000", types.SystemError, nil)
-			return nil
-		}
-		if logs == nil {
-			//save logs
-			dbdrive.SaveLogs(ethlogs)
+			msg = err.Error()
+		} else if final != nil && final.Error != "" {
+			msg = final.Error
 		}
+		logger.Error("SyncBlockAndLogs error", "args", crit, "job", status.ID, "err", msg)
+		return types.ErrorMsg(types.SystemError.Code, types.SystemError.Message, msg)
 	}
 
 	*reply = "Sync successful!"
@@ -0,0 +1,101 @@
+package rpcserver
+
+import (
+	"blockchain-event-plugin/logger"
+	"blockchain-event-plugin/rpc/decoder"
+	"blockchain-event-plugin/rpc/filter"
+	"blockchain-event-plugin/syncer"
+	"blockchain-event-plugin/types"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/eth/filters"
+	"github.com/pkg/errors"
+)
+
+// PluginAPI offers the plugin namespace methods built on top of the stored logs
+type PluginAPI struct {
+	filterAPI   *filter.PublicFilterAPI
+	registry    *decoder.Registry
+	syncService *syncer.Service
+	backfill    bool // 开放回填任务的写方法
+}
+
+// GetDecodedLogs returns the logs matching the criteria like eth_getLogs, with the
+// event name, signature and arguments decoded by the ABI registered for the contract.
+func (i *PluginAPI) GetDecodedLogs(crit filters.FilterCriteria, reply *interface{}) error {
+	if len(crit.Addresses) == 0 && len(crit.Topics) == 0 && crit.BlockHash == nil {
+		return types.ErrorMsg(types.InvalidParams.Code, types.InvalidParams.Message, "Parameters is empty")
+	}
+
+	logs, err := i.filterAPI.HandleGetLogs(crit)
+	if err != nil {
+		logger.Error("GetDecodedLogs error", "args", crit, "err", err)
+		return errorMsg(err, types.InvalidParams)
+	}
+	decoded, err := i.registry.DecodeLogs(logs)
+	if err != nil {
+		logger.Error("GetDecodedLogs error", "args", crit, "err", err)
+		return errorMsg(err, types.SystemError)
+	}
+	*reply = decoded
+	return nil
+}
+
+// StartBackfill starts a background job storing the missing blocks and logs of
+// [fromBlock, toBlock], the range is split into chunks processed by a worker pool.
+func (i *PluginAPI) StartBackfill(fromBlock, toBlock hexutil.Uint64, reply *interface{}) error {
+	if !i.backfill {
+		return types.ErrorMsg(types.MethodNotFound.Code, types.MethodNotFound.Message, "backfill.rpc_enabled is off")
+	}
+	if i.syncService == nil {
+		return types.ErrorMsg(types.SystemError.Code, types.SystemError.Message, "sync service is not running")
+	}
+	status, err := i.syncService.StartBackfill(int64(fromBlock), int64(toBlock), nil)
+	if err != nil {
+		logger.Error("StartBackfill error", "fromBlock", fromBlock, "toBlock", toBlock, "err", err)
+		return backfillError(err)
+	}
+	*reply = status
+	return nil
+}
+
+// BackfillStatus returns the progress of the backfill job
+func (i *PluginAPI) BackfillStatus(id hexutil.Uint64, reply *interface{}) error {
+	if i.syncService == nil {
+		return types.ErrorMsg(types.SystemError.Code, types.SystemError.Message, "sync service is not running")
+	}
+	status, err := i.syncService.Backfill(int64(id))
+	if err != nil {
+		logger.Error("BackfillStatus error", "id", id, "err", err)
+		return errorMsg(err, types.SystemError)
+	}
+	if status == nil {
+		return types.ErrorMsg(types.InvalidParams.Code, types.InvalidParams.Message, "backfill job not found")
+	}
+	*reply = status
+	return nil
+}
+
+// CancelBackfill cancels the running backfill job, it returns false if the job is not running
+func (i *PluginAPI) CancelBackfill(id hexutil.Uint64, reply *interface{}) error {
+	if !i.backfill {
+		return types.ErrorMsg(types.MethodNotFound.Code, types.MethodNotFound.Message, "backfill.rpc_enabled is off")
+	}
+	if i.syncService == nil {
+		return types.ErrorMsg(types.SystemError.Code, types.SystemError.Message, "sync service is not running")
+	}
+	cancelled, err := i.syncService.CancelBackfill(int64(id))
+	if err != nil {
+		logger.Error("CancelBackfill error", "id", id, "err", err)
+		return errorMsg(err, types.SystemError)
+	}
+	*reply = cancelled
+	return nil
+}
+
+// backfillError 回填范围错误返回参数错误，其余按存储错误处理
+func backfillError(err error) *types.Error {
+	if errors.Is(err, syncer.ErrInvalidBackfill) {
+		return errorMsg(err, types.InvalidParams)
+	}
+	return errorMsg(err, types.SystemError)
+}
@@ -0,0 +1,68 @@
+package rpcserver
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"blockchain-event-plugin/logger"
+	"blockchain-event-plugin/rpc/rpcutil"
+	"blockchain-event-plugin/setting"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/eth/filters"
+	"math/big"
+)
+
+// logsBlocksPerToken is the number of blocks of a logs query that take one rate limit token
+const logsBlocksPerToken = 1000
+
+// newRateLimiter 按ratelimit配置创建各链共用的限流器，未开启时返回nil。
+// 配置错误时退出，避免在未限流的情况下开放接口
+func newRateLimiter() *rpcutil.RateLimiter {
+	if !setting.GetBool("ratelimit.enabled") {
+		return nil
+	}
+	var config rpcutil.RateLimitConfig
+	if err := setting.UnmarshalKey("ratelimit", &config); err != nil {
+		logger.Fatal("[sys] Parse ratelimit failed", "err", err)
+	}
+	limiter, err := rpcutil.NewRateLimiter(config)
+	if err != nil {
+		logger.Fatal("[sys] Invalid ratelimit config", "err", err)
+	}
+	return limiter
+}
+
+// logsWeight 按logs查询的区块范围计算令牌数，每logsBlocksPerToken个区块一个令牌，
+// 未指定或latest等标签的区块按存储的高度计算
+func logsWeight(store dbdrive.Store) rpcutil.WeightFunc {
+	return func(params []json.RawMessage) int {
+		if len(params) == 0 {
+			return 1
+		}
+		var crit filters.FilterCriteria
+		if err := json.Unmarshal(params[0], &crit); err != nil || crit.BlockHash != nil {
+			return 1
+		}
+		var height int64
+		if isTag(crit.FromBlock) || isTag(crit.ToBlock) {
+			var err error
+			if height, err = store.GetBlockHeight(); err != nil {
+				return 1
+			}
+		}
+		from, to := height, height
+		if !isTag(crit.FromBlock) {
+			from = crit.FromBlock.Int64()
+		}
+		if !isTag(crit.ToBlock) {
+			to = crit.ToBlock.Int64()
+		}
+		if to < from {
+			return 1
+		}
+		return int((to-from)/logsBlocksPerToken) + 1
+	}
+}
+
+// isTag reports whether the block number is unset or a tag such as latest or pending
+func isTag(number *big.Int) bool {
+	return number == nil || number.Sign() < 0
+}
@@ -0,0 +1,101 @@
+package rpcserver
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"blockchain-event-plugin/rpc/filter"
+	"blockchain-event-plugin/rpc/rpcutil"
+	"blockchain-event-plugin/syncer"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/eth/filters"
+	"github.com/pkg/errors"
+)
+
+var errSyncNotRunning = errors.New("sync service is not running")
+
+// registerSubscriptions 注册WebSocket订阅：logs和newHeads
+func registerSubscriptions(server *rpcutil.Server, syncService *syncer.Service) error {
+	if err := server.RegisterSubscription("eth", "logs", logsSubscription(syncService)); err != nil {
+		return err
+	}
+	return server.RegisterSubscription("eth", "newHeads", newHeadsSubscription(syncService))
+}
+
+// logsSubscription pushes the stored logs matching the criteria, and the logs
+// removed by a chain reorganization with removed set to true. The subscription is
+// closed when the subscriber falls too far behind the ingestion.
+func logsSubscription(syncService *syncer.Service) rpcutil.SubscriptionFunc {
+	return func(notifier *rpcutil.Notifier, params []json.RawMessage) error {
+		if syncService == nil {
+			return errSyncNotRunning
+		}
+		var crit filters.FilterCriteria
+		if len(params) > 0 {
+			if err := json.Unmarshal(params[0], &crit); err != nil {
+				return err
+			}
+		}
+
+		// 回滚和新区块通过同一个有序的订阅推送，removed的logs先于新链的logs
+		eventCh := make(chan syncer.SyncEvent, 64)
+		sub := syncService.SubscribeSyncEvent(eventCh)
+
+		go func() {
+			defer sub.Unsubscribe()
+
+			for {
+				select {
+				case ev := <-eventCh:
+					var logs []dbdrive.Logs
+					if ev.Chain != nil {
+						logs = ev.Chain.Logs
+					} else {
+						logs = ev.Removed.Logs
+					}
+					for _, log := range filter.FilterLogs(logs, nil, nil, crit.Addresses, crit.Topics) {
+						if err := notifier.Notify(log); err != nil {
+							return
+						}
+					}
+				case <-notifier.Closed():
+					return
+				case <-sub.Err():
+					notifier.Close()
+					return
+				}
+			}
+		}()
+		return nil
+	}
+}
+
+// newHeadsSubscription pushes the header of every stored block, the subscription is
+// closed when the subscriber falls too far behind the ingestion.
+func newHeadsSubscription(syncService *syncer.Service) rpcutil.SubscriptionFunc {
+	return func(notifier *rpcutil.Notifier, params []json.RawMessage) error {
+		if syncService == nil {
+			return errSyncNotRunning
+		}
+
+		chainCh := make(chan syncer.ChainEvent, 64)
+		chainSub := syncService.SubscribeChainEvent(chainCh)
+
+		go func() {
+			defer chainSub.Unsubscribe()
+
+			for {
+				select {
+				case ev := <-chainCh:
+					if err := notifier.Notify(ev.Header); err != nil {
+						return
+					}
+				case <-notifier.Closed():
+					return
+				case <-chainSub.Err():
+					notifier.Close()
+					return
+				}
+			}
+		}()
+		return nil
+	}
+}
@@ -0,0 +1,264 @@
+package rpcutil
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/golang-jwt/jwt/v4"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// APIKeyHeader carries the API key of a request
+	APIKeyHeader = "X-Api-Key"
+
+	// unauthorizedCode is the JSON-RPC error of a request whose credentials are missing
+	// or invalid, forbiddenCode of a request whose role may not call the method
+	unauthorizedCode = -32040
+	forbiddenCode    = -32041
+
+	// jwtClockDrift is the tolerated drift of the issued-at time of a token
+	jwtClockDrift = 5 * time.Second
+)
+
+// Role is the access level of a client, a role may call the methods of the lower ones
+type Role int
+
+const (
+	RolePublic Role = iota // unauthenticated clients
+	RoleRead
+	RoleAdmin
+)
+
+var roleNames = map[string]Role{"public": RolePublic, "read": RoleRead, "admin": RoleAdmin}
+
+// ParseRole parses public, read or admin
+func ParseRole(name string) (Role, error) {
+	role, ok := roleNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown role %q", name)
+	}
+	return role, nil
+}
+
+func (r Role) String() string {
+	for name, role := range roleNames {
+		if role == r {
+			return name
+		}
+	}
+	return fmt.Sprintf("role(%d)", int(r))
+}
+
+// APIKey is a static API key, Name identifies its client in the logs and rate limits
+type APIKey struct {
+	Name string `mapstructure:"name"`
+	Key  string `mapstructure:"key"`
+	Role string `mapstructure:"role"`
+}
+
+// AuthConfig is the configuration of an Authenticator
+type AuthConfig struct {
+	APIKeys []APIKey `mapstructure:"api_keys"`
+	// JWTSecret is the HS256 secret of the bearer tokens, 0x prefixed hex or plain text,
+	// tokens are not accepted when it is empty
+	JWTSecret string `mapstructure:"jwt_secret"`
+	// JWTMaxAge rejects the tokens issued more than JWTMaxAge seconds ago when it is positive
+	JWTMaxAge int `mapstructure:"jwt_max_age"`
+	// Methods is the role required by a method or by all the methods of a namespace,
+	// the other methods are public. Names are matched case-insensitively.
+	Methods map[string]string `mapstructure:"methods"`
+}
+
+// Authenticator authenticates the clients by their API key in the X-Api-Key header or
+// the HS256 JWT in the Authorization: Bearer header, whose role claim is the role of the
+// client, and tells which role a method requires.
+type Authenticator struct {
+	keys    []apiKey
+	secret  []byte
+	maxAge  time.Duration
+	methods map[string]Role
+}
+
+type apiKey struct {
+	name string
+	key  []byte
+	role Role
+}
+
+// jwtClaims are the claims of a bearer token, a token without role has the read role
+type jwtClaims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		maxAge:  time.Duration(config.JWTMaxAge) * time.Second,
+		methods: make(map[string]Role, len(config.Methods)),
+	}
+	for i, key := range config.APIKeys {
+		if key.Key == "" {
+			return nil, fmt.Errorf("api key %d is empty", i)
+		}
+		role, err := ParseRole(key.Role)
+		if err != nil {
+			return nil, fmt.Errorf("api key %q: %v", key.Name, err)
+		}
+		name := key.Name
+		if name == "" {
+			name = fmt.Sprint(i)
+		}
+		a.keys = append(a.keys, apiKey{name: name, key: []byte(key.Key), role: role})
+	}
+	if strings.HasPrefix(config.JWTSecret, "0x") {
+		secret, err := hexutil.Decode(config.JWTSecret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwt secret: %v", err)
+		}
+		a.secret = secret
+	} else if config.JWTSecret != "" {
+		a.secret = []byte(config.JWTSecret)
+	}
+	for method, name := range config.Methods {
+		role, err := ParseRole(name)
+		if err != nil {
+			return nil, fmt.Errorf("method %s: %v", method, err)
+		}
+		a.methods[strings.ToLower(method)] = role
+	}
+	return a, nil
+}
+
+// Authenticate returns the identity and role of the client of the request, requests
+// without credentials are public with an empty identity
+func (a *Authenticator) Authenticate(req *http.Request) (string, Role, error) {
+	if key := req.Header.Get(APIKeyHeader); key != "" {
+		return a.authenticateKey(key)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return "", RolePublic, errors.New("unsupported authorization scheme")
+		}
+		return a.authenticateToken(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return "", RolePublic, nil
+}
+
+func (a *Authenticator) authenticateKey(key string) (string, Role, error) {
+	// 逐个比较所有密钥，耗时与匹配的密钥无关
+	var found *apiKey
+	for i := range a.keys {
+		if subtle.ConstantTimeCompare(a.keys[i].key, []byte(key)) == 1 {
+			found = &a.keys[i]
+		}
+	}
+	if found == nil {
+		return "", RolePublic, errors.New("invalid api key")
+	}
+	return "key:" + found.name, found.role, nil
+}
+
+func (a *Authenticator) authenticateToken(strToken string) (string, Role, error) {
+	if len(a.secret) == 0 {
+		return "", RolePublic, errors.New("bearer tokens are not accepted")
+	}
+	// 只允许HS256，签发时间允许少量时钟偏差，因此不使用默认的声明校验
+	var claims jwtClaims
+	token, err := jwt.ParseWithClaims(strToken, &claims, func(*jwt.Token) (interface{}, error) {
+		return a.secret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithoutClaimsValidation())
+	now := time.Now()
+	switch {
+	case err != nil:
+		return "", RolePublic, fmt.Errorf("invalid token: %v", err)
+	case !token.Valid:
+		return "", RolePublic, errors.New("invalid token")
+	case !claims.VerifyExpiresAt(now, false):
+		return "", RolePublic, errors.New("token is expired")
+	case !claims.VerifyNotBefore(now, false):
+		return "", RolePublic, errors.New("token is not valid yet")
+	case claims.IssuedAt != nil && claims.IssuedAt.Sub(now) > jwtClockDrift:
+		return "", RolePublic, errors.New("future token")
+	case a.maxAge > 0 && claims.IssuedAt == nil:
+		return "", RolePublic, errors.New("missing issued-at")
+	case a.maxAge > 0 && now.Sub(claims.IssuedAt.Time) > a.maxAge+jwtClockDrift:
+		return "", RolePublic, errors.New("stale token")
+	}
+
+	role := RoleRead
+	if claims.Role != "" {
+		if role, err = ParseRole(claims.Role); err != nil {
+			return "", RolePublic, fmt.Errorf("invalid token: %v", err)
+		}
+	}
+	id := ""
+	if claims.Subject != "" {
+		id = "jwt:" + claims.Subject
+	}
+	return id, role, nil
+}
+
+// Required returns the role required by the method, set for the method itself or its namespace
+func (a *Authenticator) Required(method string) Role {
+	method = strings.ToLower(method)
+	if role, ok := a.methods[method]; ok {
+		return role
+	}
+	if i := strings.Index(method, "_"); i > 0 {
+		if role, ok := a.methods[method[:i]]; ok {
+			return role
+		}
+	}
+	return RolePublic
+}
+
+// SetAuthenticator requires the requests to be authorized by the authenticator
+func (s *Server) SetAuthenticator(auth *Authenticator) {
+	s.auth = auth
+}
+
+// caller is the client of a request
+type caller struct {
+	id   string // authenticated identity or client IP, the key of its rate limits
+	role Role
+	err  error // why the credentials of the request were rejected
+}
+
+// newCaller authenticates the client of the request, a client without
+// authenticated identity is identified by its IP
+func (s *Server) newCaller(req *http.Request) caller {
+	var c caller
+	if s.auth != nil {
+		c.id, c.role, c.err = s.auth.Authenticate(req)
+	}
+	if c.id == "" && s.limiter != nil {
+		c.id = s.limiter.ClientKey(req)
+	}
+	return c
+}
+
+// authorize checks that the caller may call the method of the request
+func (s *Server) authorize(c caller, req *jsonRequest) *jsonResponse {
+	if s.auth == nil {
+		return nil
+	}
+	var jsonErr *jsonError
+	required := s.auth.Required(req.Method())
+	switch {
+	case c.err != nil:
+		jsonErr = new(jsonError).Error(unauthorizedCode, "Unauthorized", c.err.Error())
+	case c.role >= required:
+		return nil
+	case c.role == RolePublic:
+		jsonErr = new(jsonError).Error(unauthorizedCode, "Unauthorized", "authentication required")
+	default:
+		jsonErr = new(jsonError).Error(forbiddenCode, "Forbidden", "method requires the "+required.String()+" role")
+	}
+	resp := s.codec.NewResponse(nil, jsonErr)
+	resp.SetReqIdent(req.Ident())
+	return resp
+}
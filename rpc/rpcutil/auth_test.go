@@ -0,0 +1,168 @@
+package rpcutil
+
+import (
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v4"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "secret"
+
+func newTestAuthenticator(t *testing.T, maxAge int) *Authenticator {
+	auth, err := NewAuthenticator(AuthConfig{
+		APIKeys:   []APIKey{{Name: "ops", Key: "admin-key", Role: "admin"}, {Key: "read-key", Role: "read"}},
+		JWTSecret: testSecret,
+		JWTMaxAge: maxAge,
+		Methods:   map[string]string{"admin": "admin", "eth_getLogs": "read"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwtClaims) string {
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *jwt.NumericDate { return jwt.NewNumericDate(now.Add(d)) }
+	hs256 := func(claims jwtClaims) string { return signToken(t, jwt.SigningMethodHS256, []byte(testSecret), claims) }
+
+	tests := []struct {
+		name   string
+		token  string
+		maxAge int
+		id     string
+		role   Role
+		valid  bool
+	}{
+		{name: "no claims", token: hs256(jwtClaims{}), role: RoleRead, valid: true},
+		{name: "role and subject", token: hs256(jwtClaims{Role: "admin", RegisteredClaims: jwt.RegisteredClaims{Subject: "ops"}}),
+			id: "jwt:ops", role: RoleAdmin, valid: true},
+		{name: "unknown role", token: hs256(jwtClaims{Role: "root"})},
+		{name: "wrong secret", token: signToken(t, jwt.SigningMethodHS256, []byte("other"), jwtClaims{})},
+		{name: "HS512", token: signToken(t, jwt.SigningMethodHS512, []byte(testSecret), jwtClaims{})},
+		{name: "none", token: signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, jwtClaims{})},
+		{name: "expired", token: hs256(jwtClaims{RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: at(-time.Minute)}})},
+		{name: "not expired", token: hs256(jwtClaims{RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: at(time.Minute)}}),
+			role: RoleRead, valid: true},
+		{name: "not valid yet", token: hs256(jwtClaims{RegisteredClaims: jwt.RegisteredClaims{NotBefore: at(time.Minute)}})},
+		{name: "valid since", token: hs256(jwtClaims{RegisteredClaims: jwt.RegisteredClaims{NotBefore: at(-time.Minute)}}),
+			role: RoleRead, valid: true},
+		// 签发时间允许少量时钟偏差
+		{name: "issued within drift", token: hs256(jwtClaims{RegisteredClaims: jwt.RegisteredClaims{IssuedAt: at(2 * time.Second)}}),
+			role: RoleRead, valid: true},
+		{name: "future token", token: hs256(jwtClaims{RegisteredClaims: jwt.RegisteredClaims{IssuedAt: at(time.Minute)}})},
+		{name: "missing issued-at", token: hs256(jwtClaims{}), maxAge: 60},
+		{name: "fresh token", token: hs256(jwtClaims{RegisteredClaims: jwt.RegisteredClaims{IssuedAt: at(-30 * time.Second)}}),
+			maxAge: 60, role: RoleRead, valid: true},
+		{name: "stale token", token: hs256(jwtClaims{RegisteredClaims: jwt.RegisteredClaims{IssuedAt: at(-2 * time.Minute)}}), maxAge: 60},
+	}
+	for _, test := range tests {
+		auth := newTestAuthenticator(t, test.maxAge)
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		id, role, err := auth.Authenticate(req)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got error %v, want valid %v", test.name, err, test.valid)
+			continue
+		}
+		if test.valid && (id != test.id || role != test.role) {
+			t.Errorf("%s: got id %q role %v, want id %q role %v", test.name, id, role, test.id, test.role)
+		}
+		if !test.valid && role != RolePublic {
+			t.Errorf("%s: rejected token has the %v role", test.name, role)
+		}
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	auth := newTestAuthenticator(t, 0)
+	tests := []struct {
+		header, value string
+		id            string
+		role          Role
+		valid         bool
+	}{
+		{valid: true},
+		{header: APIKeyHeader, value: "admin-key", id: "key:ops", role: RoleAdmin, valid: true},
+		{header: APIKeyHeader, value: "read-key", id: "key:1", role: RoleRead, valid: true},
+		{header: APIKeyHeader, value: "admin-ke"},
+		{header: "Authorization", value: "Basic YTpi"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/", nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		id, role, err := auth.Authenticate(req)
+		if (err == nil) != test.valid || id != test.id || role != test.role {
+			t.Errorf("%s %q: got id %q role %v error %v, want id %q role %v valid %v",
+				test.header, test.value, id, role, err, test.id, test.role, test.valid)
+		}
+	}
+}
+
+func TestAuthenticatorRequired(t *testing.T) {
+	auth := newTestAuthenticator(t, 0)
+	tests := map[string]Role{
+		"admin_addWatch": RoleAdmin,
+		"ETH_GETLOGS":    RoleRead,
+		"eth_chainId":    RolePublic,
+		"adminx_call":    RolePublic,
+	}
+	for method, want := range tests {
+		if got := auth.Required(method); got != want {
+			t.Errorf("%s: got role %v, want %v", method, got, want)
+		}
+	}
+}
+
+func TestServeHTTPAuthorize(t *testing.T) {
+	server := NewServer()
+	server.SetAuthenticator(newTestAuthenticator(t, 0))
+	if err := server.Register("admin", &TestAPI{}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key  string
+		code int64
+	}{
+		{key: "", code: unauthorizedCode},
+		{key: "wrong", code: unauthorizedCode},
+		{key: "read-key", code: forbiddenCode},
+		{key: "admin-key", code: 0},
+	}
+	for _, test := range tests {
+		body := `{"jsonrpc":"2.0","id":1,"method":"admin_echo","params":["x"]}`
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		if test.key != "" {
+			req.Header.Set(APIKeyHeader, test.key)
+		}
+		w := httptest.NewRecorder()
+		server.HTTPHandler(nil).ServeHTTP(w, req)
+
+		var resp struct {
+			Error *jsonError `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode %s: %v", w.Body.String(), err)
+		}
+		code := int64(0)
+		if resp.Error != nil {
+			code = resp.Error.Code
+		}
+		if code != test.code {
+			t.Errorf("key %q: got error code %d, want %d", test.key, code, test.code)
+		}
+	}
+}
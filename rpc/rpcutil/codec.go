@@ -1,8 +1,10 @@
 package rpcutil
 
+import "encoding/json"
+
 type ClientCodec interface {
 	// generate a single NewRequest with needed params
-	NewRequest(id, method string, argv []string) *jsonRequest
+	NewRequest(id json.RawMessage, method string, argv []json.RawMessage) *jsonRequest
 	// EncodeRequests .
 	EncodeRequests(v interface{}) ([]byte, error)
 	// parse encoded data into a Response
@@ -14,6 +16,8 @@ type ClientCodec interface {
 type ServerCodec interface {
 	// parse encoded data into a Request
 	ReadRequest(data []byte) (*jsonRequest, error)
+	// split encoded data into the messages of a batch, batch is false for a single Request
+	ReadBatchRequest(data []byte) (msgs []json.RawMessage, batch bool, err error)
 	// ReadRequestBody parse params
 	ReadRequestBody(reqBody []byte, rcvr interface{}) error
 	// generate a single Response with needed params
@@ -3,7 +3,7 @@ package rpcutil
 import (
 	"bytes"
 	"encoding/json"
-	"github.com/ethereum/go-ethereum/eth/filters"
+	"errors"
 	"strings"
 )
 
@@ -14,6 +14,11 @@ type jsonCodec struct {
 	enc    *json.Encoder
 }
 
+var (
+	_ ClientCodec = (*jsonCodec)(nil)
+	_ ServerCodec = (*jsonCodec)(nil)
+)
+
 // NewJSONCodec
 func NewJSONCodec() *jsonCodec {
 	decbuf := bytes.NewBuffer(nil)
@@ -38,6 +43,8 @@ func (j *jsonCodec) decode(data []byte, out interface{}) error {
 	return d.Decode(&out)
 }
 
+// NewResponse returns the response of a method, the reply is sent as the result
+// as is, errors are returned by the methods as an Error
 func (j *jsonCodec) NewResponse(reply interface{}, err *jsonError) *jsonResponse {
 	if err != nil {
 		return &jsonResponse{
@@ -45,30 +52,13 @@ func (j *jsonCodec) NewResponse(reply interface{}, err *jsonError) *jsonResponse
 			Version: "2.0",
 		}
 	}
-
-	jsonRes := new(jsonResponse)
-	jsonB, _ := json.Marshal(reply)
-	json.Unmarshal(jsonB, &jsonRes)
-	if jsonRes.Err != nil {
-		return &jsonResponse{
-			Version: "2.0",
-			Err:     jsonRes.Err,
-		}
-	}
-	if jsonRes.Result != nil {
-		return &jsonResponse{
-			Version: "2.0",
-			Result:  jsonRes.Result,
-		}
-	}
-	response := &jsonResponse{
+	return &jsonResponse{
 		Version: "2.0",
 		Result:  reply,
 	}
-	return response
 }
 
-func (j *jsonCodec) NewRequest(id int, method string, argv []filters.FilterCriteria) *jsonRequest {
+func (j *jsonCodec) NewRequest(id json.RawMessage, method string, argv []json.RawMessage) *jsonRequest {
 	req := &jsonRequest{
 		ID:      id,
 		Mthd:    method,
@@ -101,9 +91,42 @@ func (j *jsonCodec) ReadRequest(data []byte) (reqs *jsonRequest, err error) {
 	if err := j.decode(data, req); err != nil {
 		return nil, err
 	}
+	if !isValidID(req.ID) {
+		return nil, errors.New("invalid request id " + string(req.ID))
+	}
 	return req, nil
 }
 
+// isValidID reports whether the request id is missing, null, a number or a string
+func isValidID(id json.RawMessage) bool {
+	if len(id) == 0 || string(id) == "null" {
+		return true
+	}
+	return id[0] == '"' || id[0] == '-' || (id[0] >= '0' && id[0] <= '9')
+}
+
+func (j *jsonCodec) ReadBatchRequest(data []byte) (msgs []json.RawMessage, batch bool, err error) {
+	if !isBatch(data) {
+		return []json.RawMessage{data}, false, nil
+	}
+	if err := json.Unmarshal(data, &msgs); err != nil {
+		return nil, true, err
+	}
+	return msgs, true, nil
+}
+
+// isBatch returns true when the first non-whitespace character is '['
+func isBatch(data []byte) bool {
+	for _, c := range data {
+		// skip insignificant whitespace (http://www.ietf.org/rfc/rfc4627.txt)
+		if c == 0x20 || c == 0x09 || c == 0x0a || c == 0x0d {
+			continue
+		}
+		return c == '['
+	}
+	return false
+}
+
 func (j *jsonCodec) ReadRequestBody(data []byte, rcvr interface{}) error {
 	return j.decode(data, rcvr)
 }
@@ -2,34 +2,49 @@ package rpcutil
 
 import (
 	"encoding/json"
-	"github.com/ethereum/go-ethereum/eth/filters"
+	"time"
 )
 
+// Error is an error returned by a method with its JSON-RPC code and data, it is sent
+// to the client as is, any other error is reported as an internal error
+type Error interface {
+	error
+	ErrorCode() int64
+	ErrorData() interface{}
+}
+
+// invalidParamsCode is the JSON-RPC error of a request whose params can not be decoded
+const invalidParamsCode = -32602
+
 type jsonError struct {
-	Code    int64  `json:"code"`
-	Message string `json:"message"`
-	Data    string `json:"data,omitempty"`
+	Code    int64       `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
 }
 
 func (j *jsonError) Error(code int64, errMsg, errData string) *jsonError {
-	return &jsonError{
+	jsonErr := &jsonError{
 		Code:    code,
 		Message: errMsg,
-		Data:    errData,
 	}
+	if errData != "" {
+		jsonErr.Data = errData
+	}
+	return jsonErr
 }
 
 // jsonRequest is jsonCodec response data struct
-// and implement the inerface named 'rpc.Request'
+// and implement the inerface named 'rpc.Request'.
+// ID is kept raw, a number, string or null, and echoed back as is in the response.
 type jsonRequest struct {
-	ID      int                      `json:"id"`
-	Mthd    string                   `json:"method"`
-	Args    []filters.FilterCriteria `json:"params"`
-	Version string                   `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Mthd    string            `json:"method"`
+	Args    []json.RawMessage `json:"params"`
+	Version string            `json:"jsonrpc"`
 }
 
-func (j *jsonRequest) Ident() int     { return j.ID }
-func (j *jsonRequest) Method() string { return j.Mthd }
+func (j *jsonRequest) Ident() json.RawMessage { return j.ID }
+func (j *jsonRequest) Method() string         { return j.Mthd }
 func (j *jsonRequest) Params() []byte {
 	byts, err := json.Marshal(j.Args)
 	if err != nil {
@@ -41,14 +56,16 @@ func (j *jsonRequest) Params() []byte {
 // jsonResponse is jsonCodec response data struct
 // and implement the inerface named 'rpc.Response'
 type jsonResponse struct {
-	ID      int         `json:"id"`
-	Version string      `json:"jsonrpc"`
-	Err     *jsonError  `json:"error,omitempty"`
-	Result  interface{} `json:"result,omitempty"`
+	ID      json.RawMessage `json:"id"`
+	Version string          `json:"jsonrpc"`
+	Err     *jsonError      `json:"error,omitempty"`
+	Result  interface{}     `json:"result,omitempty"`
+
+	retryAfter time.Duration // set when the request was rejected by the rate limiter
 }
 
-func (j *jsonResponse) SetReqIdent(ident int) { j.ID = ident }
-func (j *jsonResponse) Error() *jsonError     { return j.Err }
+func (j *jsonResponse) SetReqIdent(ident json.RawMessage) { j.ID = ident }
+func (j *jsonResponse) Error() *jsonError                 { return j.Err }
 func (j *jsonResponse) Reply() []byte {
 	byts, err := json.Marshal(j)
 	if err != nil {
@@ -62,3 +79,15 @@ func (j *jsonResponse) ErrCode() int64 {
 	}
 	return -1
 }
+
+// jsonNotification is the message pushed to a WebSocket subscriber
+type jsonNotification struct {
+	Version string                 `json:"jsonrpc"`
+	Method  string                 `json:"method"`
+	Params  jsonSubscriptionResult `json:"params"`
+}
+
+type jsonSubscriptionResult struct {
+	Subscription string      `json:"subscription"`
+	Result       interface{} `json:"result"`
+}
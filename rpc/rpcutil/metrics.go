@@ -0,0 +1,26 @@
+package rpcutil
+
+import (
+	"blockchain-event-plugin/metrics"
+	"strconv"
+	"time"
+)
+
+// unknownMethod is the name the requests of unknown or unparsable methods are counted under
+const unknownMethod = "unknown"
+
+// observeCall 统计方法的请求数、耗时和错误数，错误包括方法返回的错误和调用前的拒绝，同时按JSON-RPC错误码统计
+func observeCall(method string, reply *jsonResponse, start time.Time) {
+	metrics.GetOrRegisterCounter("rpc/requests/" + method).Inc(1)
+	metrics.GetOrRegisterTimer("rpc/duration/" + method).UpdateSince(start)
+	if reply == nil || reply.Err == nil {
+		return
+	}
+	metrics.GetOrRegisterCounter("rpc/failures/" + method).Inc(1)
+	// 指标名称不能包含负号，错误码取绝对值
+	code := reply.Err.Code
+	if code < 0 {
+		code = -code
+	}
+	metrics.GetOrRegisterCounter("rpc/errors/" + strconv.FormatInt(code, 10)).Inc(1)
+}
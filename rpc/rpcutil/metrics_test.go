@@ -0,0 +1,40 @@
+package rpcutil
+
+import (
+	"blockchain-event-plugin/metrics"
+	gethmetrics "github.com/ethereum/go-ethereum/metrics"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Count returns the error returned by Fail, it is only used by the metrics test so
+// that its counters are not registered by the other tests while metrics are disabled
+func (t *TestAPI) Count(code int64, reply *interface{}) error {
+	return t.Fail(code, reply)
+}
+
+func TestObserveCallCountsMethodErrors(t *testing.T) {
+	enabled := gethmetrics.Enabled
+	gethmetrics.Enabled = true
+	defer func() { gethmetrics.Enabled = enabled }()
+
+	server := NewServer()
+	if err := server.Register("test", &TestAPI{}); err != nil {
+		t.Fatal(err)
+	}
+	body := `[{"jsonrpc":"2.0","id":1,"method":"test_count","params":[-32099]},
+		{"jsonrpc":"2.0","id":2,"method":"test_count","params":[0]},
+		{"jsonrpc":"2.0","id":3,"method":"test_echo","params":["x"]}]`
+	server.HTTPHandler(nil).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(body)))
+
+	for name, want := range map[string]int64{
+		"rpc/requests/test_count": 2,
+		"rpc/failures/test_count": 2,
+		"rpc/errors/32099":        1,
+	} {
+		if got := metrics.GetOrRegisterCounter(name).Count(); got != want {
+			t.Errorf("%s: got %d, want %d", name, got, want)
+		}
+	}
+}
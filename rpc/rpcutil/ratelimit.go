@@ -0,0 +1,203 @@
+package rpcutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/time/rate"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// limitExceededCode is the JSON-RPC error of a rate limited request, following EIP-1474
+	limitExceededCode = -32005
+
+	// idle buckets are dropped after bucketIdleTime, they have refilled by then
+	bucketIdleTime = 10 * time.Minute
+	sweepInterval  = time.Minute
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second up to Burst tokens,
+// a Rate of 0 does not limit
+type RateLimit struct {
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+}
+
+// RateLimitConfig is the configuration of a RateLimiter. Method names are matched
+// case-insensitively.
+type RateLimitConfig struct {
+	Default    RateLimit            `mapstructure:"default"`     // shared by the methods without their own limit
+	Methods    map[string]RateLimit `mapstructure:"methods"`     // separate budget of a method
+	TrustProxy bool                 `mapstructure:"trust_proxy"` // take the client IP from X-Forwarded-For
+}
+
+// WeightFunc returns how many tokens a request of the method takes from its params
+type WeightFunc func(params []json.RawMessage) int
+
+// RateLimiter limits the requests of every client with token buckets. A client is identified
+// by its authenticated identity, or by its IP when it has none. A method configured with its own
+// limit has a separate bucket per client, the other methods share the default bucket of the client.
+type RateLimiter struct {
+	config RateLimitConfig
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewRateLimiter validates the configuration and returns the limiter, rates and bursts must not be negative
+func NewRateLimiter(config RateLimitConfig) (*RateLimiter, error) {
+	if err := config.Default.validate(); err != nil {
+		return nil, fmt.Errorf("default: %v", err)
+	}
+	methods := make(map[string]RateLimit, len(config.Methods))
+	for method, limit := range config.Methods {
+		if err := limit.validate(); err != nil {
+			return nil, fmt.Errorf("method %s: %v", method, err)
+		}
+		methods[strings.ToLower(method)] = limit
+	}
+	config.Methods = methods
+	return &RateLimiter{
+		config:    config,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}, nil
+}
+
+func (l RateLimit) validate() error {
+	if l.Rate < 0 || math.IsNaN(l.Rate) || math.IsInf(l.Rate, 0) {
+		return fmt.Errorf("invalid rate %v", l.Rate)
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("invalid burst %d", l.Burst)
+	}
+	return nil
+}
+
+// ClientKey returns the key the requests of an unauthenticated client are limited under,
+// the IP of the client
+func (l *RateLimiter) ClientKey(req *http.Request) string {
+	if l.config.TrustProxy {
+		if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return "ip:" + strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Allow takes n tokens from the bucket of the client for the method. When the bucket
+// lacks them nothing is taken and the time to wait before retrying is returned.
+// A request weighing more than the burst takes the whole bucket.
+func (l *RateLimiter) Allow(client, method string, n int) (time.Duration, bool) {
+	limit, key := l.config.Default, client
+	if methodLimit, ok := l.config.Methods[strings.ToLower(method)]; ok {
+		limit, key = methodLimit, client+" "+strings.ToLower(method)
+	}
+	if limit.Rate <= 0 {
+		return 0, true
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		burst := limit.Burst
+		if burst < 1 {
+			burst = int(math.Ceil(limit.Rate))
+		}
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+	l.mu.Unlock()
+
+	if n > b.limiter.Burst() {
+		n = b.limiter.Burst()
+	}
+	r := b.limiter.ReserveN(now, n)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return delay, false
+	}
+	return 0, true
+}
+
+// sweep drops the buckets that have not been used for bucketIdleTime
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) > bucketIdleTime {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// SetRateLimiter limits the requests of the clients with the limiter, which may be
+// shared by several servers
+func (s *Server) SetRateLimiter(limiter *RateLimiter) {
+	s.limiter = limiter
+}
+
+// SetWeight sets how many tokens a request of the method takes, 1 by default
+func (s *Server) SetWeight(method string, weight WeightFunc) {
+	if s.weights == nil {
+		s.weights = make(map[string]WeightFunc)
+	}
+	s.weights[strings.ToLower(method)] = weight
+}
+
+// allow checks the rate limit of the caller for the request
+func (s *Server) allow(c caller, req *jsonRequest) *jsonResponse {
+	if s.limiter == nil {
+		return nil
+	}
+	n := 1
+	if weight, ok := s.weights[strings.ToLower(req.Method())]; ok {
+		if n = weight(req.Args); n < 1 {
+			n = 1
+		}
+	}
+	wait, ok := s.limiter.Allow(c.id, req.Method(), n)
+	if ok {
+		return nil
+	}
+	seconds := int64(math.Ceil(wait.Seconds()))
+	jsonErr := &jsonError{
+		Code:    limitExceededCode,
+		Message: "Limit exceeded",
+		Data:    map[string]interface{}{"method": req.Method(), "retryAfter": seconds},
+	}
+	resp := s.codec.NewResponse(nil, jsonErr)
+	resp.SetReqIdent(req.Ident())
+	resp.retryAfter = wait
+	return resp
+}
+
+// retryAfter returns the longest wait of the rate limited responses
+func retryAfter(resps ...*jsonResponse) time.Duration {
+	var wait time.Duration
+	for _, resp := range resps {
+		if resp != nil && resp.retryAfter > wait {
+			wait = resp.retryAfter
+		}
+	}
+	return wait
+}
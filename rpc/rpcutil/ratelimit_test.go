@@ -0,0 +1,155 @@
+package rpcutil
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewRateLimiterValidates(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RateLimitConfig
+		valid  bool
+	}{
+		{name: "empty", valid: true},
+		{name: "limits", config: RateLimitConfig{Default: RateLimit{Rate: 10, Burst: 20}, Methods: map[string]RateLimit{"eth_getLogs": {Rate: 0.5}}}, valid: true},
+		{name: "negative rate", config: RateLimitConfig{Default: RateLimit{Rate: -1}}},
+		{name: "NaN rate", config: RateLimitConfig{Default: RateLimit{Rate: math.NaN()}}},
+		{name: "infinite method rate", config: RateLimitConfig{Methods: map[string]RateLimit{"eth_call": {Rate: math.Inf(1)}}}},
+		{name: "negative burst", config: RateLimitConfig{Methods: map[string]RateLimit{"eth_call": {Rate: 1, Burst: -1}}}},
+	}
+	for _, test := range tests {
+		if _, err := NewRateLimiter(test.config); (err == nil) != test.valid {
+			t.Errorf("%s: got error %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter, err := NewRateLimiter(RateLimitConfig{
+		Default: RateLimit{Rate: 1, Burst: 2},
+		Methods: map[string]RateLimit{"eth_getLogs": {Rate: 1, Burst: 3}, "eth_free": {}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow := func(client, method string, n int) bool {
+		_, ok := limiter.Allow(client, method, n)
+		return ok
+	}
+
+	// 未单独配置的方法共用默认的令牌桶
+	if !allow("a", "eth_blockNumber", 1) || !allow("a", "eth_chainId", 1) {
+		t.Fatal("requests within the default burst were limited")
+	}
+	wait, ok := limiter.Allow("a", "eth_blockNumber", 1)
+	if ok || wait <= 0 {
+		t.Errorf("request over the default burst: got allowed %v, wait %v", ok, wait)
+	}
+	if !allow("b", "eth_blockNumber", 1) {
+		t.Error("another client was limited by the bucket of a")
+	}
+
+	// 单独配置的方法有独立的令牌桶，方法名不区分大小写
+	if !allow("a", "ETH_GETLOGS", 2) || allow("a", "eth_getLogs", 2) {
+		t.Error("eth_getLogs did not use its own bucket of 3 tokens")
+	}
+	// 超过burst的请求取走整个令牌桶
+	if !allow("c", "eth_getLogs", 10) || allow("c", "eth_getLogs", 1) {
+		t.Error("a request over the burst did not take the whole bucket")
+	}
+	// rate为0时不限流
+	for i := 0; i < 10; i++ {
+		if !allow("a", "eth_free", 1) {
+			t.Fatal("a method with a rate of 0 was limited")
+		}
+	}
+}
+
+func TestServeHTTPRateLimited(t *testing.T) {
+	limiter, err := NewRateLimiter(RateLimitConfig{Default: RateLimit{Rate: 0.01, Burst: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	server.SetRateLimiter(limiter)
+	if err := server.Register("test", &TestAPI{}); err != nil {
+		t.Fatal(err)
+	}
+	body := `[{"jsonrpc":"2.0","id":1,"method":"test_echo","params":["x"]},
+		{"jsonrpc":"2.0","id":2,"method":"test_echo","params":["y"]}]`
+	w := httptest.NewRecorder()
+	server.HTTPHandler(nil).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+
+	var resps []struct {
+		Error *jsonError `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resps); err != nil {
+		t.Fatalf("decode %s: %v", w.Body.String(), err)
+	}
+	// 批量请求并发执行，其中一个请求被限流
+	limited := 0
+	for _, resp := range resps {
+		if resp.Error != nil && resp.Error.Code == limitExceededCode {
+			limited++
+		}
+	}
+	if len(resps) != 2 || limited != 1 {
+		t.Errorf("got responses %s, want one of them limited", w.Body.String())
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "100" {
+		t.Errorf("got Retry-After %q, want 100", retry)
+	}
+}
+
+func TestWSSubscribeRateLimited(t *testing.T) {
+	limiter, err := NewRateLimiter(RateLimitConfig{Default: RateLimit{Rate: 0.01, Burst: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	server.SetRateLimiter(limiter)
+	err = server.RegisterSubscription("test", "ticks", func(notifier *Notifier, params []json.RawMessage) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server.WSHandler(nil))
+	defer httpServer.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 订阅和取消订阅与方法调用共用令牌桶
+	var codes []int64
+	for _, req := range []string{
+		`{"jsonrpc":"2.0","id":1,"method":"test_subscribe","params":["ticks"]}`,
+		`{"jsonrpc":"2.0","id":2,"method":"test_unsubscribe","params":["0x1"]}`,
+		`{"jsonrpc":"2.0","id":3,"method":"test_subscribe","params":["ticks"]}`,
+		`{"jsonrpc":"2.0","id":4,"method":"test_unsubscribe","params":["0x1"]}`,
+	} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		var resp struct {
+			Error *jsonError `json:"error"`
+		}
+		if err := conn.ReadJSON(&resp); err != nil {
+			t.Fatal(err)
+		}
+		code := int64(0)
+		if resp.Error != nil {
+			code = resp.Error.Code
+		}
+		codes = append(codes, code)
+	}
+	if want := []int64{0, 0, limitExceededCode, limitExceededCode}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("got error codes %v, want %v", codes, want)
+	}
+}
@@ -0,0 +1,85 @@
+package rpcutil
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ChainHeader selects the chain of a request whose path is not /chain/{id}
+	ChainHeader = "X-Chain-Id"
+
+	chainPathPrefix = "/chain/"
+)
+
+// ChainRouter routes requests to the handler of the chain selected by the /chain/{id}
+// path or the X-Chain-Id header, requests selecting no chain go to the default chain.
+// Chain ids are accepted in decimal or 0x prefixed hex.
+type ChainRouter struct {
+	handlers     map[int64]http.Handler
+	defaultChain int64
+	hasDefault   bool
+	codec        ServerCodec
+}
+
+func NewChainRouter() *ChainRouter {
+	return &ChainRouter{
+		handlers: make(map[int64]http.Handler),
+		codec:    NewJSONCodec(),
+	}
+}
+
+// Handle sets the handler of the chain, the first chain handled is the default one
+func (r *ChainRouter) Handle(chainID int64, handler http.Handler) {
+	r.handlers[chainID] = handler
+	if !r.hasDefault {
+		r.defaultChain, r.hasDefault = chainID, true
+	}
+}
+
+// ListenHTTPServe serves the chains over HTTP on addr
+func (r *ChainRouter) ListenHTTPServe(addr string) {
+	listenHTTPServe(addr, r)
+}
+
+// ListenWSServe serves the chains over WebSocket on addr
+func (r *ChainRouter) ListenWSServe(addr string) {
+	listenWSServe(addr, r)
+}
+
+func (r *ChainRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	chainID, ok := r.defaultChain, r.hasDefault
+	selected := req.Header.Get(ChainHeader)
+	if strings.HasPrefix(req.URL.Path, chainPathPrefix) {
+		selected = strings.Trim(strings.TrimPrefix(req.URL.Path, chainPathPrefix), "/")
+	}
+	if selected != "" {
+		id, err := parseChainID(selected)
+		if err != nil {
+			r.notFound(w, "invalid chain id "+selected)
+			return
+		}
+		chainID, ok = id, true
+	}
+
+	handler, found := r.handlers[chainID]
+	if !ok || !found {
+		r.notFound(w, "unknown chain "+selected)
+		return
+	}
+	handler.ServeHTTP(w, req)
+}
+
+func parseChainID(str string) (int64, error) {
+	if strings.HasPrefix(str, "0x") || strings.HasPrefix(str, "0X") {
+		return strconv.ParseInt(str[2:], 16, 64)
+	}
+	return strconv.ParseInt(str, 10, 64)
+}
+
+func (r *ChainRouter) notFound(w http.ResponseWriter, msg string) {
+	jsonErr := new(jsonError).Error(-32601, "Method not found", msg)
+	byts, _ := r.codec.EncodeResponses(r.codec.NewResponse(nil, jsonErr))
+	String(w, http.StatusNotFound, byts)
+}
@@ -2,44 +2,118 @@ package rpcutil
 
 import (
 	"blockchain-event-plugin/logger"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	DefaultBatchLimit       = 100
+	DefaultBatchConcurrency = 4
+)
+
 type Server struct {
 	status int
 	l      sync.Mutex
+	conns  sync.Map    // map[*wsConn]struct{}, the open WebSocket connections
 	m      sync.Map    // map[string]*service
+	subs   sync.Map    // map[string]SubscriptionFunc
 	codec  ServerCodec // codec to read request and writeResponse
+
+	batchLimit       int // max number of requests in a batch
+	batchConcurrency int // max number of requests of a batch executed at the same time
+
+	auth    *Authenticator        // nil when the requests are not authenticated
+	limiter *RateLimiter          // nil when the requests are not rate limited
+	weights map[string]WeightFunc // tokens taken by the requests of a method, by lowercase method
+	origins []string              // origins allowed to open a WebSocket connection
 }
 
 func NewServer() *Server {
 	codec := NewJSONCodec()
 	return &Server{
-		status: 0,
-		codec:  codec,
+		status:           0,
+		codec:            codec,
+		batchLimit:       DefaultBatchLimit,
+		batchConcurrency: DefaultBatchConcurrency,
+	}
+}
+
+// SetBatchLimit sets the max size of a batch and how many of its requests are executed concurrently,
+// values less than 1 keep the current setting
+func (s *Server) SetBatchLimit(limit, concurrency int) {
+	if limit > 0 {
+		s.batchLimit = limit
+	}
+	if concurrency > 0 {
+		s.batchConcurrency = concurrency
 	}
 }
 
-// ListenHTTPServe open http support can serve http request
-func (s *Server) ListenHTTPServe(addr string) {
-	if err := http.ListenAndServe(
-		addr,
-		http.TimeoutHandler(s, 300*time.Second, "Network request timeout"),
-	); err != nil {
+// namespaces is the set of namespaces enabled on a listener, nil enables all of them
+type namespaces map[string]bool
+
+func newNamespaces(names []string) namespaces {
+	if len(names) == 0 {
+		return nil
+	}
+	ns := make(namespaces, len(names))
+	for _, name := range names {
+		ns[name] = true
+	}
+	return ns
+}
+
+func (n namespaces) enabled(name string) bool {
+	return n == nil || n[name]
+}
+
+// ListenHTTPServe open http support can serve http request,
+// only the given namespaces are served, or all of them if modules is empty
+func (s *Server) ListenHTTPServe(addr string, modules []string) {
+	listenHTTPServe(addr, s.HTTPHandler(modules))
+}
+
+// HTTPHandler returns the handler serving JSON-RPC over HTTP for the given namespaces,
+// or all of them if modules is empty
+func (s *Server) HTTPHandler(modules []string) http.Handler {
+	ns := newNamespaces(modules)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.serveHTTP(w, req, ns)
+	})
+}
+
+// NewHTTPServer returns the HTTP server serving handler on addr, requests are timed out
+// after 300 seconds. It is stopped by Shutdown, which lets the in-flight requests finish.
+func NewHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:    addr,
+		Handler: http.TimeoutHandler(handler, 300*time.Second, "Network request timeout"),
+	}
+}
+
+func listenHTTPServe(addr string, handler http.Handler) {
+	if err := NewHTTPServer(addr, handler).ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		logger.Fatal("RPC server over HTTP is error: ", err)
 	}
 }
 
-// ServeHTTP handle request over HTTP,
+// ServeHTTP handle request over HTTP for all namespaces,
 // it also implement the interface of http.Handler
 func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.serveHTTP(w, req, nil)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request, ns namespaces) {
 	defer func() {
 		if err, ok := recover().(error); ok && err != nil {
 			logger.Error("ServeHTTP recover:", "err", err)
@@ -80,7 +154,10 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	rpcReq, err := s.codec.ReadRequest(data)
+	msgs, batch, err := s.codec.ReadBatchRequest(data)
+	if err == nil && batch {
+		err = s.checkBatch(msgs)
+	}
 	if err != nil {
 		jsonErr := new(jsonError).Error(-32600, "Invalid Request", err.Error())
 		resp := s.codec.NewResponse(nil, jsonErr)
@@ -91,12 +168,78 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		String(w, http.StatusOK, byts)
 		return
 	}
-	resps := s.call(rpcReq)
-	byts, _ := s.codec.EncodeResponses(resps)
+
+	c := s.newCaller(req)
+	var byts []byte
+	if batch {
+		resps := s.callBatch(msgs, ns, c)
+		setRetryAfter(w, retryAfter(resps...))
+		byts, _ = s.codec.EncodeResponses(resps)
+	} else {
+		resp := s.callMsg(msgs[0], ns, c)
+		setRetryAfter(w, retryAfter(resp))
+		byts, _ = s.codec.EncodeResponses(resp)
+	}
 	String(w, http.StatusOK, byts)
 	return
 }
 
+// setRetryAfter sets the Retry-After header in seconds when a request was rate limited
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+	}
+}
+
+// checkBatch validates the size of a batch
+func (s *Server) checkBatch(msgs []json.RawMessage) error {
+	if len(msgs) == 0 {
+		return errors.New("empty batch")
+	}
+	if len(msgs) > s.batchLimit {
+		return fmt.Errorf("batch too large: %d requests, max %d", len(msgs), s.batchLimit)
+	}
+	return nil
+}
+
+// callBatch executes the requests of a batch with bounded concurrency,
+// the responses keep the order of the requests
+func (s *Server) callBatch(msgs []json.RawMessage, ns namespaces, c caller) []*jsonResponse {
+	resps := make([]*jsonResponse, len(msgs))
+	sem := make(chan struct{}, s.batchConcurrency)
+	var wg sync.WaitGroup
+	for i, msg := range msgs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, msg json.RawMessage) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer func() {
+				if err := recover(); err != nil {
+					logger.Error("callBatch recover:", "err", err)
+					jsonErr := new(jsonError).Error(-32603, "Internal error", fmt.Sprint(err))
+					resps[i] = s.codec.NewResponse(nil, jsonErr)
+				}
+			}()
+			resps[i] = s.callMsg(msg, ns, c)
+		}(i, msg)
+	}
+	wg.Wait()
+	return resps
+}
+
+// callMsg parses and executes a single request of the caller
+func (s *Server) callMsg(msg json.RawMessage, ns namespaces, c caller) *jsonResponse {
+	rpcReq, err := s.codec.ReadRequest(msg)
+	if err != nil {
+		jsonErr := new(jsonError).Error(-32600, "Invalid Request", err.Error())
+		resp := s.codec.NewResponse(nil, jsonErr)
+		observeCall(unknownMethod, resp, time.Now())
+		return resp
+	}
+	return s.call(rpcReq, ns, c)
+}
+
 func (s *Server) SetState(sta int) {
 	s.l.Lock()
 	s.status = sta
@@ -109,13 +252,22 @@ func (s *Server) GetState() int {
 	return s.status
 }
 
+// Close rejects the new requests and closes the open WebSocket connections with their
+// subscriptions, the in-flight HTTP requests are left to finish.
+func (s *Server) Close() {
+	s.SetState(1)
+	s.conns.Range(func(key, _ interface{}) bool {
+		key.(*wsConn).shutdown()
+		return true
+	})
+}
+
+// parseFromRPCMethod splits namespace_method into the namespace and the Go method name
 func parseFromRPCMethod(reqMethod string) (serviceName, methodName string) {
 	if strings.Count(reqMethod, "_") != 1 {
 		return "", ""
 	}
-	serviceName, methodName = StrFirstToUpper(reqMethod)
-	serviceName = "PublicRPCAPI"
-	return serviceName, methodName
+	return StrFirstToUpper(reqMethod)
 }
 
 // String
@@ -1,9 +1,13 @@
 package rpcutil
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"reflect"
+	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
@@ -21,11 +25,13 @@ type service struct {
 
 type methodType struct {
 	method    reflect.Method
-	ArgType   reflect.Type
+	ArgTypes  []reflect.Type // positional params, in order
 	ReplyType reflect.Type
 }
 
-func (s *Server) Register(rcvr interface{}) error {
+// Register publishes the methods of rcvr under the namespace,
+// the method GetLogs of the namespace eth is called as eth_getLogs
+func (s *Server) Register(namespace string, rcvr interface{}) error {
 	srvic := new(service)
 	srvic.typ = reflect.TypeOf(rcvr)
 	srvic.rcvr = reflect.ValueOf(rcvr)
@@ -37,22 +43,28 @@ func (s *Server) Register(rcvr interface{}) error {
 	if !isExported(sname) {
 		return errors.New("rpc.Register: type " + sname + " is not exported")
 	}
-	srvic.name = sname
+	if namespace == "" || strings.Contains(namespace, "_") {
+		return errors.New("rpc.Register: invalid namespace " + namespace)
+	}
+	srvic.name = namespace
 	srvic.method = suitableMethods(srvic.typ)
 
-	if _, dup := s.m.LoadOrStore(sname, srvic); dup {
-		return errors.New("rpc: service already defined: " + sname)
+	if _, dup := s.m.LoadOrStore(namespace, srvic); dup {
+		return errors.New("rpc: service already defined: " + namespace)
 	}
 	return nil
 }
 
 // Before Call must parse and decode param into reflect.Value
 // after Call must encode and response
-func (s *Server) call(req *jsonRequest) (reply *jsonResponse) {
+func (s *Server) call(req *jsonRequest, ns namespaces, c caller) (reply *jsonResponse) {
+	method, start := unknownMethod, time.Now()
+	defer func() { observeCall(method, reply, start) }()
+
 	serviceName, methodName := parseFromRPCMethod(req.Method())
 	// method existed or not
 	svci, ok := s.m.Load(serviceName)
-	if !ok {
+	if !ok || !ns.enabled(serviceName) {
 		err := errors.New("rpc: can't find service " + serviceName)
 		jsonErr := new(jsonError).Error(-32601, "Method not found", err.Error())
 		reply = s.codec.NewResponse(nil, jsonErr)
@@ -69,13 +81,30 @@ func (s *Server) call(req *jsonRequest) (reply *jsonResponse) {
 		reply.SetReqIdent(req.Ident())
 		return
 	}
+	method = req.Method()
+	if reply = s.authorize(c, req); reply != nil {
+		return
+	}
+	if reply = s.allow(c, req); reply != nil {
+		return
+	}
 
-	argv := reflect.ValueOf(req.Args[0])
+	argvs, err := s.parseArgs(req.Args, mtype.ArgTypes)
+	if err != nil {
+		jsonErr := new(jsonError).Error(invalidParamsCode, "Invalid params", err.Error())
+		reply = s.codec.NewResponse(nil, jsonErr)
+		reply.SetReqIdent(req.Ident())
+		return
+	}
 	var replyv reflect.Value
 	replyv = reflect.New(mtype.ReplyType.Elem())
 
-	if err := svc.call(mtype, argv, replyv); err != nil {
+	if err := svc.call(mtype, argvs, replyv); err != nil {
 		jsonErr := new(jsonError).Error(-32603, "Internal error", err.Error())
+		var rpcErr Error
+		if errors.As(err, &rpcErr) {
+			jsonErr = &jsonError{Code: rpcErr.ErrorCode(), Message: rpcErr.Error(), Data: rpcErr.ErrorData()}
+		}
 		reply = s.codec.NewResponse(nil, jsonErr)
 		reply.SetReqIdent(req.Ident())
 	} else {
@@ -85,9 +114,34 @@ func (s *Server) call(req *jsonRequest) (reply *jsonResponse) {
 	return
 }
 
-func (s *service) call(mtype *methodType, argv reflect.Value, replyv reflect.Value) error {
+// parseArgs decodes the positional params into values of the argument types.
+// Missing trailing params are only allowed for pointer and interface arguments.
+func (s *Server) parseArgs(params []json.RawMessage, types []reflect.Type) ([]reflect.Value, error) {
+	if len(params) > len(types) {
+		return nil, fmt.Errorf("too many arguments, want at most %d", len(types))
+	}
+	argvs := make([]reflect.Value, 0, len(types))
+	for i, typ := range types {
+		argv := reflect.New(typ)
+		if i < len(params) {
+			if err := s.codec.ReadRequestBody(params[i], argv.Interface()); err != nil {
+				return nil, fmt.Errorf("invalid argument %d: %v", i, err)
+			}
+		} else if typ.Kind() != reflect.Ptr && typ.Kind() != reflect.Interface {
+			return nil, fmt.Errorf("missing value for required argument %d", i)
+		}
+		argvs = append(argvs, argv.Elem())
+	}
+	return argvs, nil
+}
+
+func (s *service) call(mtype *methodType, argvs []reflect.Value, replyv reflect.Value) error {
 	function := mtype.method.Func
-	returnValues := function.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := make([]reflect.Value, 0, len(argvs)+2)
+	in = append(in, s.rcvr)
+	in = append(in, argvs...)
+	in = append(in, replyv)
+	returnValues := function.Call(in)
 	if i := returnValues[0].Interface(); i != nil {
 		return i.(error)
 	}
@@ -118,19 +172,23 @@ func suitableMethod(method reflect.Method) *methodType {
 	if method.PkgPath != "" {
 		return nil
 	}
-	// Method needs three ins: receiver, *args, *reply.
-	if mtype.NumIn() != 3 {
-		log.Printf("rpc.Register: method %q has %d input parameters; needs exactly three\n", mname, mtype.NumIn())
+	// Method needs at least two ins: receiver, args..., *reply.
+	if mtype.NumIn() < 2 {
+		log.Printf("rpc.Register: method %q has %d input parameters; needs at least two\n", mname, mtype.NumIn())
 		return nil
 	}
-	// First arg need not be a pointer.
-	argType := mtype.In(1)
-	if !isExportedOrBuiltinType(argType) {
-		log.Printf("rpc.Register: argument type of method %q is not exported: %q\n", mname, argType)
-		return nil
+	// Args need not be pointers.
+	argTypes := make([]reflect.Type, 0, mtype.NumIn()-2)
+	for i := 1; i < mtype.NumIn()-1; i++ {
+		argType := mtype.In(i)
+		if !isExportedOrBuiltinType(argType) {
+			log.Printf("rpc.Register: argument type of method %q is not exported: %q\n", mname, argType)
+			return nil
+		}
+		argTypes = append(argTypes, argType)
 	}
-	// Second arg must be a pointer.
-	replyType := mtype.In(2)
+	// Last arg must be a pointer.
+	replyType := mtype.In(mtype.NumIn() - 1)
 	if replyType.Kind() != reflect.Ptr {
 		log.Printf("rpc.Register: reply type of method %q is not a pointer: %q\n", mname, replyType)
 		return nil
@@ -150,7 +208,7 @@ func suitableMethod(method reflect.Method) *methodType {
 		log.Printf("rpc.Register: return type of method %q is %q, must be error\n", mname, returnType)
 		return nil
 	}
-	return &methodType{method: method, ArgType: argType, ReplyType: replyType}
+	return &methodType{method: method, ArgTypes: argTypes, ReplyType: replyType}
 }
 
 // Is this type exported or a builtin?
@@ -0,0 +1,116 @@
+package rpcutil
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type TestAPI struct{}
+
+func (t *TestAPI) Echo(value string, reply *interface{}) error {
+	*reply = value
+	return nil
+}
+
+type testError struct {
+	code int64
+	data string
+}
+
+func (e *testError) Error() string          { return "test error" }
+func (e *testError) ErrorCode() int64       { return e.code }
+func (e *testError) ErrorData() interface{} { return e.data }
+
+// Fail returns an Error with the code, or a plain error when code is 0
+func (t *TestAPI) Fail(code int64, reply *interface{}) error {
+	if code == 0 {
+		return errors.New("plain error")
+	}
+	return errors.Wrap(&testError{code: code, data: "details"}, "wrapped")
+}
+
+func TestServeHTTPErrors(t *testing.T) {
+	server := NewServer()
+	if err := server.Register("test", &TestAPI{}); err != nil {
+		t.Fatal(err)
+	}
+	body := `[{"jsonrpc":"2.0","id":1,"method":"test_fail","params":[-32001]},
+		{"jsonrpc":"2.0","id":2,"method":"test_fail","params":[0]},
+		{"jsonrpc":"2.0","id":3,"method":"test_fail","params":["x"]}]`
+	w := httptest.NewRecorder()
+	server.HTTPHandler(nil).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+
+	var resps []struct {
+		Error *jsonError `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resps); err != nil {
+		t.Fatalf("decode %s: %v", w.Body.String(), err)
+	}
+	want := []jsonError{
+		{Code: -32001, Message: "test error", Data: "details"},
+		{Code: -32603, Message: "Internal error", Data: "plain error"},
+		{Code: -32602, Message: "Invalid params"},
+	}
+	if len(resps) != len(want) {
+		t.Fatalf("got %d responses, want %d: %s", len(resps), len(want), w.Body.String())
+	}
+	for i, resp := range resps {
+		// 参数解析错误的data是解码错误，不比较
+		if resp.Error != nil && want[i].Data == nil {
+			resp.Error.Data = nil
+		}
+		if resp.Error == nil || *resp.Error != want[i] {
+			t.Errorf("response %d: got error %+v, want %+v", i, resp.Error, want[i])
+		}
+	}
+}
+
+func TestServeHTTPEchoesIDs(t *testing.T) {
+	server := NewServer()
+	if err := server.Register("test", &TestAPI{}); err != nil {
+		t.Fatal(err)
+	}
+	body := `[{"jsonrpc":"2.0","id":"a-1","method":"test_echo","params":["x"]},
+		{"jsonrpc":"2.0","id":7,"method":"test_echo","params":["y"]},
+		{"jsonrpc":"2.0","id":null,"method":"test_echo","params":["z"]},
+		{"jsonrpc":"2.0","id":{"x":1},"method":"test_echo","params":["w"]},
+		{"jsonrpc":"2.0","id":"b","method":"test_missing"}]`
+	w := httptest.NewRecorder()
+	server.HTTPHandler(nil).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+
+	var resps []struct {
+		ID     json.RawMessage `json:"id"`
+		Result interface{}     `json:"result"`
+		Error  *jsonError      `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resps); err != nil {
+		t.Fatalf("decode %s: %v", w.Body.String(), err)
+	}
+	want := []struct {
+		id     string
+		result interface{}
+		code   int64
+	}{
+		{`"a-1"`, "x", 0},
+		{`7`, "y", 0},
+		{`null`, "z", 0},
+		{`null`, nil, -32600},
+		{`"b"`, nil, -32601},
+	}
+	if len(resps) != len(want) {
+		t.Fatalf("got %d responses, want %d: %s", len(resps), len(want), w.Body.String())
+	}
+	for i, resp := range resps {
+		code := int64(0)
+		if resp.Error != nil {
+			code = resp.Error.Code
+		}
+		if string(resp.ID) != want[i].id || resp.Result != want[i].result || code != want[i].code {
+			t.Errorf("response %d: got id %s result %v code %d, want id %s result %v code %d",
+				i, resp.ID, resp.Result, code, want[i].id, want[i].result, want[i].code)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package rpcutil
+
+import (
+	"blockchain-event-plugin/logger"
+	"encoding/json"
+	"errors"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsReadLimit    = 5 * 1024 * 1024
+	wsWriteTimeout = 10 * time.Second
+
+	subscribeMethodSuffix    = "_subscribe"
+	unsubscribeMethodSuffix  = "_unsubscribe"
+	notificationMethodSuffix = "_subscription"
+)
+
+// ErrNotifierClosed is returned by Notify when the subscription was cancelled or the connection is gone
+var ErrNotifierClosed = errors.New("subscription is closed")
+
+// SubscriptionFunc starts the subscription with the params following the subscription name.
+// It must return quickly and push notifications from its own goroutine until the notifier is closed.
+type SubscriptionFunc func(notifier *Notifier, params []json.RawMessage) error
+
+// Notifier is tied to a subscription created over a WebSocket connection
+// and is used to push notifications to the subscriber.
+type Notifier struct {
+	id     string
+	method string
+	conn   *wsConn
+
+	ready     chan struct{} // closed once the subscription id has been sent
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// ID returns the subscription id
+func (n *Notifier) ID() string { return n.id }
+
+// Closed returns a channel that is closed when the subscription is cancelled
+func (n *Notifier) Closed() <-chan struct{} { return n.closed }
+
+// Notify sends a notification with the given result to the subscriber
+func (n *Notifier) Notify(result interface{}) error {
+	select {
+	case <-n.ready:
+	case <-n.closed:
+		return ErrNotifierClosed
+	}
+	select {
+	case <-n.closed:
+		return ErrNotifierClosed
+	default:
+	}
+	return n.conn.write(&jsonNotification{
+		Version: "2.0",
+		Method:  n.method,
+		Params:  jsonSubscriptionResult{Subscription: n.id, Result: result},
+	})
+}
+
+// Close cancels the subscription, for instance when its subscriber can not keep up
+func (n *Notifier) Close() {
+	n.conn.subsMu.Lock()
+	delete(n.conn.subs, n.id)
+	n.conn.subsMu.Unlock()
+	n.close()
+}
+
+func (n *Notifier) close() {
+	n.closeOnce.Do(func() { close(n.closed) })
+}
+
+// RegisterSubscription registers a subscription that can be created with <namespace>_subscribe
+func (s *Server) RegisterSubscription(namespace, name string, fn SubscriptionFunc) error {
+	if _, dup := s.subs.LoadOrStore(namespace+"_"+name, fn); dup {
+		return errors.New("rpc: subscription already defined: " + namespace + " " + name)
+	}
+	return nil
+}
+
+// ListenWSServe open websocket support can serve subscriptions,
+// only the given namespaces are served, or all of them if modules is empty
+func (s *Server) ListenWSServe(addr string, modules []string) {
+	listenWSServe(addr, s.WSHandler(modules))
+}
+
+// WSHandler returns the handler serving JSON-RPC and subscriptions over WebSocket
+// for the given namespaces, or all of them if modules is empty
+func (s *Server) WSHandler(modules []string) http.Handler {
+	ns := newNamespaces(modules)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.serveWS(w, req, ns)
+	})
+}
+
+// NewWSServer returns the server serving WebSocket connections on addr. Shutdown does not
+// wait for the hijacked connections, they are closed by Server.Close.
+func NewWSServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{Addr: addr, Handler: handler}
+}
+
+func listenWSServe(addr string, handler http.Handler) {
+	if err := NewWSServer(addr, handler).ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Fatal("RPC server over WebSocket is error: ", err)
+	}
+}
+
+// ServeWS upgrades the request to a WebSocket connection and serves
+// JSON-RPC requests and subscriptions of all namespaces on it until it is closed.
+func (s *Server) ServeWS(w http.ResponseWriter, req *http.Request) {
+	s.serveWS(w, req, nil)
+}
+
+func (s *Server) serveWS(w http.ResponseWriter, req *http.Request, ns namespaces) {
+	if s.GetState() == 1 {
+		jsonErr := new(jsonError).Error(-32603, "Internal error", "Node channel closed")
+		resp := s.codec.NewResponse(nil, jsonErr)
+		byts, _ := s.codec.EncodeResponses(resp)
+		String(w, http.StatusUnauthorized, byts)
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     s.checkOrigin,
+	}
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		logger.Warn("WebSocket upgrade error", "err", err)
+		return
+	}
+	c := &wsConn{
+		server: s,
+		conn:   conn,
+		ns:     ns,
+		caller: s.newCaller(req),
+		subs:   make(map[string]*Notifier),
+	}
+	s.conns.Store(c, struct{}{})
+	defer s.conns.Delete(c)
+	c.readLoop()
+}
+
+// SetOrigins sets the origins allowed to open a WebSocket connection, "*" allows any origin
+func (s *Server) SetOrigins(origins []string) {
+	s.origins = origins
+}
+
+// checkOrigin accepts the upgrades without Origin header, which are not sent by a browser,
+// and the allowed origins. When none is set any origin is accepted if the requests are not
+// authenticated, otherwise only the origin of the same host, so that a web page can not use
+// the credentials held by the browser.
+func (s *Server) checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(s.origins) == 0 {
+		if s.auth == nil {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, req.Host)
+	}
+	for _, allowed := range s.origins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsConn is a single WebSocket connection with its active subscriptions
+type wsConn struct {
+	server  *Server
+	conn    *websocket.Conn
+	ns      namespaces
+	caller  caller // client of the connection, authenticated on upgrade
+	writeMu sync.Mutex
+	subsMu  sync.Mutex
+	subs    map[string]*Notifier
+}
+
+func (c *wsConn) readLoop() {
+	defer c.close()
+
+	c.conn.SetReadLimit(wsReadLimit)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.Debug("WebSocket read error", "err", err)
+			}
+			return
+		}
+		c.handle(data)
+	}
+}
+
+func (c *wsConn) handle(data []byte) {
+	s := c.server
+	msgs, batch, err := s.codec.ReadBatchRequest(data)
+	if err == nil && batch {
+		err = s.checkBatch(msgs)
+	}
+	if err != nil {
+		jsonErr := new(jsonError).Error(-32600, "Invalid Request", err.Error())
+		c.write(s.codec.NewResponse(nil, jsonErr))
+		return
+	}
+
+	// the requests of a batch are executed in order, and the subscriptions it creates
+	// start notifying once the response carrying their ids has been sent
+	var (
+		resps     []*jsonResponse
+		notifiers []*Notifier
+	)
+	for _, msg := range msgs {
+		resp, notifier := c.dispatch(msg)
+		resps = append(resps, resp)
+		if notifier != nil {
+			notifiers = append(notifiers, notifier)
+		}
+	}
+	if batch {
+		err = c.write(resps)
+	} else {
+		err = c.write(resps[0])
+	}
+	if err != nil {
+		logger.Debug("WebSocket write error", "err", err)
+	}
+	for _, notifier := range notifiers {
+		close(notifier.ready)
+	}
+}
+
+// dispatch executes a single request, the returned notifier is set when a subscription was created
+func (c *wsConn) dispatch(msg json.RawMessage) (*jsonResponse, *Notifier) {
+	s := c.server
+	rpcReq, err := s.codec.ReadRequest(msg)
+	if err != nil {
+		jsonErr := new(jsonError).Error(-32600, "Invalid Request", err.Error())
+		resp := s.codec.NewResponse(nil, jsonErr)
+		observeCall(unknownMethod, resp, time.Now())
+		return resp, nil
+	}
+
+	switch method := rpcReq.Method(); {
+	case strings.HasSuffix(method, subscribeMethodSuffix):
+		if resp := c.check(rpcReq); resp != nil {
+			return resp, nil
+		}
+		return c.subscribe(rpcReq)
+	case strings.HasSuffix(method, unsubscribeMethodSuffix):
+		if resp := c.check(rpcReq); resp != nil {
+			return resp, nil
+		}
+		return c.unsubscribe(rpcReq), nil
+	default:
+		return s.call(rpcReq, c.ns, c.caller), nil
+	}
+}
+
+// check authorizes and rate limits a subscribe or unsubscribe request like a method call
+func (c *wsConn) check(req *jsonRequest) *jsonResponse {
+	if resp := c.server.authorize(c.caller, req); resp != nil {
+		return resp
+	}
+	return c.server.allow(c.caller, req)
+}
+
+// subscribe creates the subscription named by the first param. The returned notifier
+// must be made ready once the response with the subscription id has been sent.
+func (c *wsConn) subscribe(req *jsonRequest) (*jsonResponse, *Notifier) {
+	s := c.server
+	var name string
+	if len(req.Args) == 0 {
+		return c.errorResponse(req, invalidParamsCode, "Invalid params", "subscription name is required"), nil
+	}
+	if err := s.codec.ReadRequestBody(req.Args[0], &name); err != nil {
+		return c.errorResponse(req, invalidParamsCode, "Invalid params", err.Error()), nil
+	}
+	namespace := strings.TrimSuffix(req.Method(), subscribeMethodSuffix)
+	fn, ok := s.subs.Load(namespace + "_" + name)
+	if !ok || !c.ns.enabled(namespace) {
+		return c.errorResponse(req, -32601, "Method not found", "rpc: no such subscription "+name), nil
+	}
+
+	notifier := &Notifier{
+		id:     string(rpc.NewID()),
+		method: namespace + notificationMethodSuffix,
+		conn:   c,
+		ready:  make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	if err := fn.(SubscriptionFunc)(notifier, req.Args[1:]); err != nil {
+		notifier.close()
+		return c.errorResponse(req, invalidParamsCode, "Invalid params", err.Error()), nil
+	}
+
+	c.subsMu.Lock()
+	c.subs[notifier.id] = notifier
+	c.subsMu.Unlock()
+
+	resp := s.codec.NewResponse(notifier.id, nil)
+	resp.SetReqIdent(req.Ident())
+	return resp, notifier
+}
+
+func (c *wsConn) unsubscribe(req *jsonRequest) *jsonResponse {
+	var id string
+	if len(req.Args) == 0 {
+		return c.errorResponse(req, invalidParamsCode, "Invalid params", "subscription id is required")
+	}
+	if err := c.server.codec.ReadRequestBody(req.Args[0], &id); err != nil {
+		return c.errorResponse(req, invalidParamsCode, "Invalid params", err.Error())
+	}
+
+	c.subsMu.Lock()
+	notifier, found := c.subs[id]
+	delete(c.subs, id)
+	c.subsMu.Unlock()
+	if found {
+		notifier.close()
+	}
+
+	resp := c.server.codec.NewResponse(found, nil)
+	resp.SetReqIdent(req.Ident())
+	return resp
+}
+
+func (c *wsConn) errorResponse(req *jsonRequest, code int64, msg, data string) *jsonResponse {
+	jsonErr := new(jsonError).Error(code, msg, data)
+	resp := c.server.codec.NewResponse(nil, jsonErr)
+	resp.SetReqIdent(req.Ident())
+	return resp
+}
+
+func (c *wsConn) write(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteJSON(v)
+}
+
+// close cancels all subscriptions of the connection
+func (c *wsConn) close() {
+	c.subsMu.Lock()
+	for id, notifier := range c.subs {
+		notifier.close()
+		delete(c.subs, id)
+	}
+	c.subsMu.Unlock()
+	c.conn.Close()
+}
+
+// shutdown tells the peer the server is going away and closes the connection,
+// which ends its read loop
+func (c *wsConn) shutdown() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown")
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+	c.close()
+}
@@ -0,0 +1,38 @@
+package rpcutil
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWSCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    bool
+		origins []string
+		origin  string
+		want    bool
+	}{
+		{name: "no origin header", auth: true, want: true},
+		{name: "any origin without auth", origin: "https://evil.example", want: true},
+		{name: "other origin with auth", auth: true, origin: "https://evil.example"},
+		{name: "same host with auth", auth: true, origin: "https://rpc.example:8546", want: true},
+		{name: "allowed origin", auth: true, origins: []string{"https://app.example/"}, origin: "https://APP.example", want: true},
+		{name: "origin not allowed", origins: []string{"https://app.example"}, origin: "https://evil.example"},
+		{name: "wildcard", auth: true, origins: []string{"*"}, origin: "https://evil.example", want: true},
+	}
+	for _, test := range tests {
+		server := NewServer()
+		server.SetOrigins(test.origins)
+		if test.auth {
+			server.SetAuthenticator(&Authenticator{})
+		}
+		req := httptest.NewRequest("GET", "http://rpc.example:8546/", nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		if got := server.checkOrigin(req); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -23,11 +23,21 @@ func GetInt(params string) int {
 	return viper.GetInt(params)
 }
 
+// GetStringSlice 获取字符串数组类型的配置
+func GetStringSlice(params string) []string {
+	return viper.GetStringSlice(params)
+}
+
 // GetBool 获取布尔类型的配置
 func GetBool(params string) bool {
 	return viper.GetBool(params)
 }
 
+// UnmarshalKey 将配置解析到结构体
+func UnmarshalKey(params string, rawVal interface{}) error {
+	return viper.UnmarshalKey(params, rawVal)
+}
+
 // Config viper解析配置文件
 func Config() error {
 	viper.AddConfigPath("./config")
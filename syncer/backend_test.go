@@ -0,0 +1,343 @@
+package syncer
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"blockchain-event-plugin/types"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/filters"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var testAddress = common.HexToAddress("0x000000000000000000000000000000000000000a")
+
+// memStore is an in-memory Store holding the blocks, logs, bloombits and backfill jobs
+// of a chain, the other methods are not implemented
+type memStore struct {
+	dbdrive.Store
+
+	mu       sync.Mutex
+	blocks   map[int64]dbdrive.BlockBloom
+	logs     []dbdrive.Logs
+	sections map[int64][][]byte
+	jobs     map[int64]dbdrive.BackfillJob
+	chunks   map[int64][]int64
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		blocks:   make(map[int64]dbdrive.BlockBloom),
+		sections: make(map[int64][][]byte),
+		jobs:     make(map[int64]dbdrive.BackfillJob),
+		chunks:   make(map[int64][]int64),
+	}
+}
+
+func (m *memStore) GetBlockHeight() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var height int64
+	for number := range m.blocks {
+		if number > height {
+			height = number
+		}
+	}
+	return height, nil
+}
+
+func (m *memStore) GetBlockHashByBlockNumber(blockNum int64) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	block, ok := m.blocks[blockNum]
+	if !ok {
+		return "", &dbdrive.Error{Kind: dbdrive.ErrNotFound, Err: fmt.Errorf("block %d", blockNum)}
+	}
+	return block.BlockHash, nil
+}
+
+func (m *memStore) GetBlockByNumber(blockNum int64) (dbdrive.BlockBloom, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	block, ok := m.blocks[blockNum]
+	if !ok {
+		return dbdrive.BlockBloom{}, &dbdrive.Error{Kind: dbdrive.ErrNotFound, Err: fmt.Errorf("block %d", blockNum)}
+	}
+	return block, nil
+}
+
+func (m *memStore) GetBloomsByRange(from, to int64) ([]dbdrive.BlockBloom, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var blooms []dbdrive.BlockBloom
+	for number := from; number <= to; number++ {
+		if block, ok := m.blocks[number]; ok {
+			blooms = append(blooms, block)
+		}
+	}
+	return blooms, nil
+}
+
+func (m *memStore) SaveLogs(logs []ethtypes.Log) error {
+	return m.SaveBlocks(nil, logs)
+}
+
+func (m *memStore) SaveBlocks(blooms []dbdrive.BlockBloom, logs []ethtypes.Log) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, bloom := range blooms {
+		m.blocks[bloom.BlockNumber] = bloom
+		delete(m.sections, bloom.BlockNumber/dbdrive.BloomBitsSectionSize)
+	}
+	m.logs = append(m.logs, dbdrive.ToLogs(logs)...)
+	return nil
+}
+
+func (m *memStore) RollbackBlocks(ancestor int64) ([]dbdrive.Logs, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var removed []dbdrive.Logs
+	for i, log := range m.logs {
+		if logNumber(log) > ancestor && !log.Removed {
+			m.logs[i].Removed = true
+			removed = append(removed, m.logs[i])
+		}
+	}
+	for number := range m.blocks {
+		if number > ancestor {
+			delete(m.blocks, number)
+		}
+	}
+	for section := range m.sections {
+		if section >= (ancestor+1)/dbdrive.BloomBitsSectionSize {
+			delete(m.sections, section)
+		}
+	}
+	return removed, nil
+}
+
+func (m *memStore) GetBloomBitsSections(from, to int64) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sections []int64
+	for section := range m.sections {
+		if section >= from && section <= to {
+			sections = append(sections, section)
+		}
+	}
+	sort.Slice(sections, func(i, j int) bool { return sections[i] < sections[j] })
+	return sections, nil
+}
+
+func (m *memStore) SaveBloomBits(section int64, bits [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sections[section] = bits
+	return nil
+}
+
+func (m *memStore) CreateBackfillJob(job *dbdrive.BackfillJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job.ID = int64(len(m.jobs) + 1)
+	m.jobs[job.ID] = *job
+	return nil
+}
+
+func (m *memStore) UpdateBackfillJob(job dbdrive.BackfillJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[job.ID] = job
+	return nil
+}
+
+func (m *memStore) GetBackfillJob(id int64) (*dbdrive.BackfillJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, nil
+	}
+	return &job, nil
+}
+
+func (m *memStore) GetBackfillJobs(status string) ([]dbdrive.BackfillJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var jobs []dbdrive.BackfillJob
+	for _, job := range m.jobs {
+		if job.Status == status {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs, nil
+}
+
+func (m *memStore) SaveBackfillChunk(jobID, fromBlock int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.chunks[jobID] = append(m.chunks[jobID], fromBlock)
+	return nil
+}
+
+func (m *memStore) GetBackfillChunks(jobID int64) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]int64(nil), m.chunks[jobID]...), nil
+}
+
+// removedLogs returns the block numbers of the logs marked as removed
+func (m *memStore) removedLogs() []int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var numbers []int64
+	for _, log := range m.logs {
+		if log.Removed {
+			numbers = append(numbers, logNumber(log))
+		}
+	}
+	return numbers
+}
+
+func logNumber(log dbdrive.Logs) int64 {
+	return int64(hexutil.MustDecodeUint64(log.BlockNumber))
+}
+
+// fakeChain is an upstream node serving eth_blockNumber, eth_getBlockByNumber and eth_getLogs
+// for the blocks 0 to head of its canonical chain, every block other than 0 has a log
+type fakeChain struct {
+	mu     sync.Mutex
+	blocks []*types.Block
+	logs   map[string][]ethtypes.Log // by block hash
+	forks  int
+}
+
+func newFakeChain(head int) *fakeChain {
+	c := &fakeChain{logs: make(map[string][]ethtypes.Log)}
+	c.blocks = append(c.blocks, &types.Block{Hash: c.hash(0), ParentHash: common.Hash{}.String(), LogsBloom: emptyBloom()})
+	c.extend(head)
+	return c
+}
+
+func (c *fakeChain) hash(number int) string {
+	return crypto.Keccak256Hash([]byte(fmt.Sprintf("%d-%d", c.forks, number))).String()
+}
+
+func emptyBloom() string {
+	return hexutil.Encode(ethtypes.Bloom{}.Bytes())
+}
+
+// extend appends n blocks to the canonical chain
+func (c *fakeChain) extend(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < n; i++ {
+		number := len(c.blocks)
+		block := &types.Block{
+			Number:     hexutil.Uint64(number),
+			Hash:       c.hash(number),
+			ParentHash: c.blocks[number-1].Hash,
+			Timestamp:  hexutil.Uint64(1600000000 + number),
+		}
+		log := ethtypes.Log{
+			Address:     testAddress,
+			Topics:      []common.Hash{common.HexToHash(block.Hash)},
+			BlockNumber: uint64(number),
+			BlockHash:   common.HexToHash(block.Hash),
+			TxHash:      common.HexToHash(block.Hash),
+		}
+		var bloom ethtypes.Bloom
+		bloom.Add(log.Address.Bytes())
+		block.LogsBloom = hexutil.Encode(bloom.Bytes())
+		c.blocks = append(c.blocks, block)
+		c.logs[block.Hash] = []ethtypes.Log{log}
+	}
+}
+
+// reorg replaces the blocks above ancestor with n blocks of a new fork
+func (c *fakeChain) reorg(ancestor int64, n int) {
+	c.mu.Lock()
+	c.blocks = c.blocks[:ancestor+1]
+	c.forks++
+	c.mu.Unlock()
+	c.extend(n)
+}
+
+func (c *fakeChain) block(number int64) *types.Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.blocks[number]
+}
+
+func (c *fakeChain) BlockNumber() hexutil.Uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return hexutil.Uint64(len(c.blocks) - 1)
+}
+
+func (c *fakeChain) GetBlockByNumber(number rpc.BlockNumber, full bool) *types.Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if number < 0 || int(number) >= len(c.blocks) {
+		return nil
+	}
+	return c.blocks[number]
+}
+
+func (c *fakeChain) GetLogs(crit filters.FilterCriteria) []ethtypes.Log {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	logs := []ethtypes.Log{}
+	if crit.BlockHash != nil {
+		return append(logs, c.logs[crit.BlockHash.String()]...)
+	}
+	for number := crit.FromBlock.Int64(); number <= crit.ToBlock.Int64() && int(number) < len(c.blocks); number++ {
+		logs = append(logs, c.logs[c.blocks[number].Hash]...)
+	}
+	return logs
+}
+
+// newTestService returns a service syncing the chain into the store, it is not started
+func newTestService(t testing.TB, chain *fakeChain, store *memStore) *Service {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", chain); err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.DialInProc(server)
+	t.Cleanup(func() {
+		client.Close()
+		server.Stop()
+	})
+	return &Service{
+		store:        store,
+		rpcClient:    client,
+		client:       ethclient.NewClient(client),
+		chain:        Chain{ChainID: 1},
+		pollInterval: DefaultPollInterval,
+		watchList:    newWatchList(),
+		jobs:         make(map[int64]*backfillJob),
+		quit:         make(chan struct{}),
+	}
+}
+
+// checkStored checks that the store holds the canonical blocks from..height of the chain
+func checkStored(t *testing.T, store *memStore, chain *fakeChain, from, height int64) {
+	t.Helper()
+	if got, _ := store.GetBlockHeight(); got != height {
+		t.Fatalf("stored height %d, want %d", got, height)
+	}
+	for number := from; number <= height; number++ {
+		hash, err := store.GetBlockHashByBlockNumber(number)
+		if err != nil || !strings.EqualFold(hash, chain.block(number).Hash) {
+			t.Fatalf("block %d: stored hash %s, error %v, want %s", number, hash, err, chain.block(number).Hash)
+		}
+	}
+}
@@ -0,0 +1,522 @@
+package syncer
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"blockchain-event-plugin/logger"
+	"blockchain-event-plugin/metrics"
+	"blockchain-event-plugin/setting"
+	"blockchain-event-plugin/types"
+	"context"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pkg/errors"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBackfillWorkers   = 4
+	defaultBackfillRetries   = 5
+	defaultBackfillChunkSize = 1000
+
+	backfillRetryBackoff = time.Second
+	maxBackfillBackoff   = 30 * time.Second
+
+	// blockBatchSize is the number of blocks fetched by a single batch request
+	blockBatchSize = 100
+)
+
+// ErrInvalidBackfill is returned when a backfill range can not be started
+var ErrInvalidBackfill = errors.New("invalid backfill range")
+
+// errBackfillAborted is returned by a chunk whose job was cancelled, failed or stopped
+var errBackfillAborted = errors.New("backfill aborted")
+
+// BackfillStatus is the progress of a backfill job
+type BackfillStatus struct {
+	ID        hexutil.Uint64 `json:"id"`
+	FromBlock hexutil.Uint64 `json:"fromBlock"`
+	ToBlock   hexutil.Uint64 `json:"toBlock"`
+	Address   string         `json:"address,omitempty"`
+	Topics    []string       `json:"topics,omitempty"`
+	Status    string         `json:"status"`
+	Chunks    int            `json:"chunks"`
+	Completed int            `json:"completed"`
+	Error     string         `json:"error,omitempty"`
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+}
+
+// backfillJob is a backfill job run by the service
+type backfillJob struct {
+	mu        sync.Mutex
+	job       dbdrive.BackfillJob
+	completed int
+
+	abortOnce sync.Once
+	abort     chan struct{} // closed when the job is cancelled or failed
+	done      chan struct{} // closed when the workers have exited
+}
+
+func newBackfillJob(job dbdrive.BackfillJob, completed int) *backfillJob {
+	return &backfillJob{job: job, completed: completed, abort: make(chan struct{}), done: make(chan struct{})}
+}
+
+// stop aborts the running job with the final status, only the first call has an effect
+func (j *backfillJob) stop(status string, err error) {
+	j.abortOnce.Do(func() {
+		j.mu.Lock()
+		j.job.Status = status
+		if err != nil {
+			j.job.Error = err.Error()
+		}
+		j.mu.Unlock()
+		close(j.abort)
+	})
+}
+
+func (j *backfillJob) status() BackfillStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return toBackfillStatus(j.job, j.completed)
+}
+
+func toBackfillStatus(job dbdrive.BackfillJob, completed int) BackfillStatus {
+	return BackfillStatus{
+		ID:        hexutil.Uint64(job.ID),
+		FromBlock: hexutil.Uint64(job.FromBlock),
+		ToBlock:   hexutil.Uint64(job.ToBlock),
+		Address:   job.Address,
+		Topics:    job.Topics,
+		Status:    job.Status,
+		Chunks:    int((job.ToBlock-job.FromBlock)/job.ChunkSize + 1),
+		Completed: completed,
+		Error:     job.Error,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+}
+
+// chunkStarts returns the first block of every chunk of the job
+func chunkStarts(job dbdrive.BackfillJob) []int64 {
+	var starts []int64
+	for from := job.FromBlock; from <= job.ToBlock; from += job.ChunkSize {
+		starts = append(starts, from)
+	}
+	return starts
+}
+
+func backfillWorkers() int {
+	if workers := setting.GetInt("backfill.workers"); workers > 0 {
+		return workers
+	}
+	return defaultBackfillWorkers
+}
+
+func backfillRetries() int {
+	if retries := setting.GetInt("backfill.max_retries"); retries > 0 {
+		return retries
+	}
+	return defaultBackfillRetries
+}
+
+func backfillChunkSize() int64 {
+	if size := setting.GetInt("backfill.chunk_size"); size > 0 {
+		return int64(size)
+	}
+	return defaultBackfillChunkSize
+}
+
+// StartBackfill starts a job storing the blocks and logs of [from, to] that are missing.
+// The range must be between the start block and the synced height, the blocks above are
+// stored by the sync loop. When watch is not nil, only the logs of the contract are stored,
+// its blocks are already stored.
+func (s *Service) StartBackfill(from, to int64, watch *dbdrive.Watch) (BackfillStatus, error) {
+	if from < 0 || from > to {
+		return BackfillStatus{}, errors.Wrapf(ErrInvalidBackfill, "[%d, %d]", from, to)
+	}
+	if from < s.startBlock {
+		return BackfillStatus{}, errors.Wrapf(ErrInvalidBackfill, "fromBlock %d is below the start block %d", from, s.startBlock)
+	}
+	job := dbdrive.BackfillJob{FromBlock: from, ToBlock: to, ChunkSize: backfillChunkSize(), Status: dbdrive.BackfillRunning}
+	if watch != nil {
+		address, topics, err := fromWatch(*watch)
+		if err != nil {
+			return BackfillStatus{}, errors.Wrap(ErrInvalidBackfill, err.Error())
+		}
+		normalized := toWatch(address, topics)
+		job.Address, job.Topics = normalized.Address, normalized.Topics
+	}
+	height, err := s.store.GetBlockHeight()
+	if err != nil {
+		return BackfillStatus{}, errors.Wrap(err, "get stored block height")
+	}
+	if to > height {
+		return BackfillStatus{}, errors.Wrapf(ErrInvalidBackfill, "toBlock %d is above the synced height %d", to, height)
+	}
+
+	if err := s.store.CreateBackfillJob(&job); err != nil {
+		return BackfillStatus{}, errors.Wrap(err, "create backfill job")
+	}
+	j := newBackfillJob(job, 0)
+	s.runBackfill(j, chunkStarts(job))
+	return j.status(), nil
+}
+
+// Backfill returns the status of the backfill job, or nil if it does not exist.
+// The status of a running job is kept in memory, the finished jobs are read from the store.
+func (s *Service) Backfill(id int64) (*BackfillStatus, error) {
+	s.jobsMu.Lock()
+	j, ok := s.jobs[id]
+	s.jobsMu.Unlock()
+	if ok {
+		status := j.status()
+		return &status, nil
+	}
+
+	job, err := s.store.GetBackfillJob(id)
+	if err != nil || job == nil {
+		return nil, err
+	}
+	chunks, err := s.store.GetBackfillChunks(id)
+	if err != nil {
+		return nil, err
+	}
+	status := toBackfillStatus(*job, len(chunks))
+	return &status, nil
+}
+
+// CancelBackfill cancels the running backfill job, the chunks already stored are kept.
+// It returns false if the job does not exist or is not running.
+func (s *Service) CancelBackfill(id int64) (bool, error) {
+	s.jobsMu.Lock()
+	j, ok := s.jobs[id]
+	s.jobsMu.Unlock()
+	if !ok || j.status().Status != dbdrive.BackfillRunning {
+		return false, nil
+	}
+	j.stop(dbdrive.BackfillCancelled, nil)
+	<-j.done
+	return true, nil
+}
+
+// WaitBackfill waits until the backfill job is no longer running and returns its status
+func (s *Service) WaitBackfill(id int64) (*BackfillStatus, error) {
+	s.jobsMu.Lock()
+	j, ok := s.jobs[id]
+	s.jobsMu.Unlock()
+	if ok {
+		select {
+		case <-j.done:
+		case <-s.quit:
+		}
+	}
+	return s.Backfill(id)
+}
+
+// resumeBackfills restarts the jobs that were running when the service was stopped,
+// skipping their checkpointed chunks.
+func (s *Service) resumeBackfills() error {
+	jobs, err := s.store.GetBackfillJobs(dbdrive.BackfillRunning)
+	if err != nil {
+		return errors.Wrap(err, "get running backfill jobs")
+	}
+	for _, job := range jobs {
+		chunks, err := s.store.GetBackfillChunks(job.ID)
+		if err != nil {
+			return errors.Wrapf(err, "get chunks of backfill job %d", job.ID)
+		}
+		completed := make(map[int64]bool, len(chunks))
+		for _, from := range chunks {
+			completed[from] = true
+		}
+		var pending []int64
+		for _, from := range chunkStarts(job) {
+			if !completed[from] {
+				pending = append(pending, from)
+			}
+		}
+		logger.Info("Backfill job resumed", "chainId", s.chain.ChainID, "job", job.ID, "pending", len(pending))
+		s.runBackfill(newBackfillJob(job, len(chunks)), pending)
+	}
+	return nil
+}
+
+// runBackfill processes the chunks of the job with the worker pool in the background
+func (s *Service) runBackfill(j *backfillJob, chunks []int64) {
+	s.jobsMu.Lock()
+	s.jobs[j.job.ID] = j
+	s.jobsMu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(j.done)
+
+		tasks := make(chan int64)
+		var wg sync.WaitGroup
+		for i := 0; i < backfillWorkers(); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for from := range tasks {
+					if err := s.backfillChunk(j, from); err != nil {
+						if err != errBackfillAborted {
+							j.stop(dbdrive.BackfillFailed, err)
+						}
+					}
+				}
+			}()
+		}
+	feed:
+		for _, from := range chunks {
+			select {
+			case tasks <- from:
+			case <-j.abort:
+				break feed
+			case <-s.quit:
+				break feed
+			}
+		}
+		close(tasks)
+		wg.Wait()
+
+		// 服务停止时任务保持running状态，重启后从检查点继续
+		select {
+		case <-s.quit:
+			if j.status().Status == dbdrive.BackfillRunning {
+				return
+			}
+		default:
+			j.stop(dbdrive.BackfillDone, nil)
+		}
+		j.mu.Lock()
+		j.job.UpdatedAt = time.Now().UTC()
+		err := s.store.UpdateBackfillJob(j.job)
+		j.mu.Unlock()
+		status := j.status()
+		if err != nil {
+			logger.Error("Update backfill job error", "chainId", s.chain.ChainID, "job", status.ID, "err", err)
+		} else {
+			// 结束的任务从存储查询状态，更新失败时保留在内存中以返回最终状态
+			s.jobsMu.Lock()
+			delete(s.jobs, j.job.ID)
+			s.jobsMu.Unlock()
+		}
+		logger.Info("Backfill job finished", "chainId", s.chain.ChainID, "job", status.ID, "status", status.Status,
+			"completed", status.Completed, "chunks", status.Chunks, "err", status.Error)
+	}()
+}
+
+// backfillChunk stores the chunk starting at from and checkpoints it, retrying with
+// an exponential backoff on error.
+func (s *Service) backfillChunk(j *backfillJob, from int64) error {
+	to := from + j.job.ChunkSize - 1
+	if to > j.job.ToBlock {
+		to = j.job.ToBlock
+	}
+
+	backoff := backfillRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := s.backfillRange(j.job, from, to)
+		if err == nil {
+			break
+		}
+		if attempt >= backfillRetries() {
+			return errors.Wrapf(err, "backfill [%d, %d]", from, to)
+		}
+		metrics.GetOrRegisterCounter(s.metricName("backfill", "chunks/retried")).Inc(1)
+		logger.Warn("Backfill chunk error, retrying", "chainId", s.chain.ChainID, "job", j.job.ID, "from", from, "to", to,
+			"attempt", attempt+1, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-j.abort:
+			return errBackfillAborted
+		case <-s.quit:
+			return errBackfillAborted
+		}
+		if backoff *= 2; backoff > maxBackfillBackoff {
+			backoff = maxBackfillBackoff
+		}
+	}
+
+	if err := s.store.SaveBackfillChunk(j.job.ID, from); err != nil {
+		return errors.Wrapf(err, "checkpoint chunk %d", from)
+	}
+	j.mu.Lock()
+	j.completed++
+	j.mu.Unlock()
+	metrics.GetOrRegisterCounter(s.metricName("backfill", "chunks/completed")).Inc(1)
+	metrics.GetOrRegisterCounter(s.metricName("backfill", "blocks")).Inc(to - from + 1)
+	return nil
+}
+
+// backfillRange stores the blocks of [from, to] that are not stored yet with the logs of the range,
+// or only the logs of the contract for a job with an address
+func (s *Service) backfillRange(job dbdrive.BackfillJob, from, to int64) error {
+	if job.Address != "" {
+		return s.backfillLogs(job, from, to)
+	}
+	stored, err := s.store.GetBloomsByRange(from, to)
+	if err != nil {
+		return errors.Wrap(err, "get stored blooms")
+	}
+	isStored := make(map[int64]bool, len(stored))
+	for _, bloom := range stored {
+		isStored[bloom.BlockNumber] = true
+	}
+	var missing []int64
+	for number := from; number <= to; number++ {
+		if !isStored[number] {
+			missing = append(missing, number)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	blocks, err := s.fetchBlocks(missing)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	ethlogs, err := s.client.FilterLogs(ctx, s.watchList.Query(ethereum.FilterQuery{FromBlock: big.NewInt(from), ToBlock: big.NewInt(to)}))
+	if err != nil {
+		return errors.Wrap(err, "filter logs")
+	}
+	if err := s.checkCanonical(stored, blocks, ethlogs); err != nil {
+		return err
+	}
+	blooms := make([]dbdrive.BlockBloom, 0, len(blocks))
+	for i := range blocks {
+		blooms = append(blooms, blockBloom(&blocks[i]))
+	}
+	if err := s.store.SaveBlocks(blooms, s.watchList.Filter(ethlogs)); err != nil {
+		return errors.Wrap(err, "save blocks")
+	}
+	return nil
+}
+
+// backfillLogs stores the logs of the contract of the job in [from, to]
+func (s *Service) backfillLogs(job dbdrive.BackfillJob, from, to int64) error {
+	address, topics, err := fromWatch(dbdrive.Watch{Address: job.Address, Topics: job.Topics})
+	if err != nil {
+		return err
+	}
+	query := ethereum.FilterQuery{FromBlock: big.NewInt(from), ToBlock: big.NewInt(to), Addresses: []common.Address{address}}
+	if len(topics) > 0 {
+		query.Topics = [][]common.Hash{topics}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	ethlogs, err := s.client.FilterLogs(ctx, query)
+	if err != nil {
+		return errors.Wrap(err, "filter logs")
+	}
+	stored, err := s.store.GetBloomsByRange(from, to)
+	if err != nil {
+		return errors.Wrap(err, "get stored blooms")
+	}
+	if err := s.checkCanonical(stored, nil, ethlogs); err != nil {
+		return err
+	}
+	return errors.Wrap(s.store.SaveLogs(ethlogs), "save logs")
+}
+
+// checkCanonical checks that the fetched blocks link to the stored or fetched blocks around them
+// and that the logs belong to these blocks. A mismatch means that the chain was reorganized while
+// the range was fetched, the chunk is retried once the sync loop has rolled the stored blocks back.
+func (s *Service) checkCanonical(stored []dbdrive.BlockBloom, blocks []types.Block, logs []ethtypes.Log) error {
+	hashes := make(map[int64]string, len(stored)+len(blocks))
+	for _, bloom := range stored {
+		hashes[bloom.BlockNumber] = bloom.BlockHash
+	}
+	for _, block := range blocks {
+		hashes[int64(block.Number)] = block.Hash
+	}
+
+	for i, block := range blocks {
+		number := int64(block.Number)
+		parent, ok := hashes[number-1]
+		if !ok {
+			hash, err := s.store.GetBlockHashByBlockNumber(number - 1)
+			if err != nil && !errors.Is(err, dbdrive.ErrNotFound) {
+				return errors.Wrapf(err, "get stored block hash %d", number-1)
+			}
+			parent, ok = hash, err == nil
+		}
+		if ok && !strings.EqualFold(parent, block.ParentHash) {
+			return errors.Errorf("block %d does not link to block %d, the chain was reorganized", number, number-1)
+		}
+
+		// 下一个区块也是获取的区块时由它检查
+		if i+1 < len(blocks) && int64(blocks[i+1].Number) == number+1 {
+			continue
+		}
+		child, err := s.store.GetBlockByNumber(number + 1)
+		if errors.Is(err, dbdrive.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "get stored block %d", number+1)
+		}
+		if child.ParentHash != "" && !strings.EqualFold(child.ParentHash, block.Hash) {
+			return errors.Errorf("block %d does not link to block %d, the chain was reorganized", number+1, number)
+		}
+	}
+
+	for _, log := range logs {
+		if hash, ok := hashes[int64(log.BlockNumber)]; ok && !strings.EqualFold(hash, log.BlockHash.String()) {
+			return errors.Errorf("log of block %d is not in the block %s, the chain was reorganized", log.BlockNumber, hash)
+		}
+	}
+	return nil
+}
+
+// fetchBlocks 批量获取指定高度的区块信息
+func (s *Service) fetchBlocks(numbers []int64) ([]types.Block, error) {
+	blocks := make([]types.Block, 0, len(numbers))
+	for begin := 0; begin < len(numbers); begin += blockBatchSize {
+		end := begin + blockBatchSize
+		if end > len(numbers) {
+			end = len(numbers)
+		}
+		raws := make([]json.RawMessage, end-begin)
+		batch := make([]rpc.BatchElem, end-begin)
+		for i := range batch {
+			batch[i] = rpc.BatchElem{
+				Method: "eth_getBlockByNumber",
+				Args:   []interface{}{hexutil.EncodeBig(big.NewInt(numbers[begin+i])), false},
+				Result: &raws[i],
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		err := s.rpcClient.BatchCallContext(ctx, batch)
+		cancel()
+		if err != nil {
+			return nil, errors.Wrap(err, "get blocks by number")
+		}
+		for i, elem := range batch {
+			number := numbers[begin+i]
+			if elem.Error != nil {
+				return nil, errors.Wrapf(elem.Error, "get block %d", number)
+			}
+			if len(raws[i]) == 0 || string(raws[i]) == "null" {
+				return nil, errors.Wrapf(errBlockNotFound, "block %d", number)
+			}
+			var block types.Block
+			if err := json.Unmarshal(raws[i], &block); err != nil {
+				return nil, errors.Wrapf(err, "decode block %d", number)
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks, nil
+}
@@ -0,0 +1,131 @@
+package syncer
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"github.com/pkg/errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// storeBlocks stores the canonical blocks of the chain with numbers
+func storeBlocks(t *testing.T, store *memStore, chain *fakeChain, numbers ...int64) {
+	t.Helper()
+	var blooms []dbdrive.BlockBloom
+	for _, number := range numbers {
+		blooms = append(blooms, blockBloom(chain.block(number)))
+	}
+	if err := store.SaveBlocks(blooms, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartBackfillRange(t *testing.T) {
+	chain := newFakeChain(30)
+	store := newMemStore()
+	storeBlocks(t, store, chain, 20)
+	s := newTestService(t, chain, store)
+	s.startBlock = 10
+
+	tests := []struct {
+		from, to int64
+	}{
+		{from: -1, to: 5},
+		{from: 15, to: 12},
+		{from: 5, to: 15},  // 低于起始区块
+		{from: 12, to: 25}, // 高于已同步的高度
+	}
+	for _, test := range tests {
+		if _, err := s.StartBackfill(test.from, test.to, nil); !errors.Is(err, ErrInvalidBackfill) {
+			t.Errorf("[%d, %d]: got error %v, want %v", test.from, test.to, err, ErrInvalidBackfill)
+		}
+	}
+	if len(store.jobs) != 0 {
+		t.Errorf("created %d jobs for invalid ranges", len(store.jobs))
+	}
+}
+
+func TestResumeBackfill(t *testing.T) {
+	chain := newFakeChain(40)
+	store := newMemStore()
+	storeBlocks(t, store, chain, 31)
+	s := newTestService(t, chain, store)
+
+	// 服务停止前完成了前两个chunk的检查点
+	job := dbdrive.BackfillJob{FromBlock: 1, ToBlock: 30, ChunkSize: 5, Status: dbdrive.BackfillRunning}
+	if err := store.CreateBackfillJob(&job); err != nil {
+		t.Fatal(err)
+	}
+	for _, from := range []int64{1, 6} {
+		if err := store.SaveBackfillChunk(job.ID, from); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.resumeBackfills(); err != nil {
+		t.Fatal(err)
+	}
+	status, err := s.WaitBackfill(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != dbdrive.BackfillDone || status.Chunks != 6 || status.Completed != 6 {
+		t.Errorf("got status %s with %d of %d chunks, want done with 6 of 6", status.Status, status.Completed, status.Chunks)
+	}
+	// 结束的任务不再保留在内存中
+	s.jobsMu.Lock()
+	running := len(s.jobs)
+	s.jobsMu.Unlock()
+	if running != 0 {
+		t.Errorf("%d finished jobs kept in memory", running)
+	}
+
+	// 已完成的chunk不再回填
+	for number := int64(1); number <= 10; number++ {
+		if _, err := store.GetBlockHashByBlockNumber(number); !errors.Is(err, dbdrive.ErrNotFound) {
+			t.Errorf("block %d of a checkpointed chunk was backfilled", number)
+		}
+	}
+	checkStored(t, store, chain, 11, 31)
+	chunks, _ := store.GetBackfillChunks(job.ID)
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i] < chunks[j] })
+	if want := []int64{1, 6, 11, 16, 21, 26}; !reflect.DeepEqual(chunks, want) {
+		t.Errorf("got checkpoints %v, want %v", chunks, want)
+	}
+}
+
+func TestBackfillRangeReorg(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored []int64
+		valid  bool
+	}{
+		{name: "no stored neighbours", valid: true},
+		{name: "canonical neighbours", stored: []int64{9, 13, 21}, valid: true},
+		{name: "stale parent", stored: []int64{9}},
+		{name: "stale child", stored: []int64{21}},
+		{name: "stale block in range", stored: []int64{13}},
+	}
+	for _, test := range tests {
+		chain := newFakeChain(25)
+		store := newMemStore()
+		if test.valid {
+			storeBlocks(t, store, chain, test.stored...)
+		} else {
+			// 存储旧分叉的区块后上游链发生重组
+			old := newFakeChain(25)
+			old.reorg(0, 25)
+			storeBlocks(t, store, old, test.stored...)
+		}
+		s := newTestService(t, chain, store)
+
+		err := s.backfillRange(dbdrive.BackfillJob{}, 10, 20)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got error %v, want valid %v", test.name, err, test.valid)
+		}
+		if !test.valid {
+			if _, err := store.GetBlockHashByBlockNumber(15); !errors.Is(err, dbdrive.ErrNotFound) {
+				t.Errorf("%s: stored blocks that do not link to the stored chain", test.name)
+			}
+		}
+	}
+}
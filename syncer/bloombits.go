@@ -0,0 +1,139 @@
+package syncer
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"blockchain-event-plugin/logger"
+	"github.com/ethereum/go-ethereum/common/bitutil"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/bloombits"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// bloomBitsInterval is the interval between two runs of the bloombits indexer
+const bloomBitsInterval = time.Minute
+
+// indexLoop rotates the stored blooms into bloombits sections until the service is stopped.
+func (s *Service) indexLoop() {
+	defer s.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-timer.C:
+		}
+
+		if err := s.indexBloomBits(); err != nil {
+			logger.Error("Index bloombits error", "chainId", s.chain.ChainID, "err", err)
+		}
+		timer.Reset(bloomBitsInterval)
+	}
+}
+
+// indexBloomBits builds the missing sections from the one of the start block whose last block
+// is deeper than maxReorgDepth, so that an indexed section is never rolled back by a reorganization.
+// Sections with blocks missing are skipped and indexed on a later run once they are stored.
+func (s *Service) indexBloomBits() error {
+	height, err := s.store.GetBlockHeight()
+	if err != nil {
+		return errors.Wrap(err, "get stored block height")
+	}
+	first := s.startBlock / dbdrive.BloomBitsSectionSize
+	sections, err := s.store.GetBloomBitsSections(first, height/dbdrive.BloomBitsSectionSize)
+	if err != nil {
+		return errors.Wrap(err, "get bloombits sections")
+	}
+	indexed := make(map[int64]bool, len(sections))
+	for _, section := range sections {
+		indexed[section] = true
+	}
+	for section := first; (section+1)*dbdrive.BloomBitsSectionSize-1+maxReorgDepth <= height; section++ {
+		if indexed[section] {
+			continue
+		}
+		select {
+		case <-s.quit:
+			return nil
+		default:
+		}
+		ok, err := s.indexSection(section)
+		if err != nil {
+			return errors.Wrapf(err, "index section %d", section)
+		}
+		if ok {
+			logger.Info("Index bloombits section successful", "chainId", s.chain.ChainID, "section", section)
+		}
+	}
+	return nil
+}
+
+// InvalidateBloomBits drops the index of the section, it is built again from the stored blooms on the next run
+func (s *Service) InvalidateBloomBits(section int64) error {
+	if section < 0 {
+		return errors.Errorf("invalid section %d", section)
+	}
+	return errors.Wrapf(s.store.DeleteBloomBits(section, section), "delete bloombits section %d", section)
+}
+
+// indexSection rotates the blooms of the section into one bit vector per bloom bit and reports
+// whether it was indexed. Blocks below the start block contribute their bloom when they are
+// stored and an empty one otherwise, the section is skipped when any other block is not stored.
+func (s *Service) indexSection(section int64) (bool, error) {
+	from := section * dbdrive.BloomBitsSectionSize
+	to := from + dbdrive.BloomBitsSectionSize - 1
+	blooms, err := s.store.GetBloomsByRange(from, to)
+	if err != nil {
+		return false, errors.Wrap(err, "get blooms")
+	}
+	first := from
+	if first < s.startBlock {
+		first = s.startBlock
+	}
+	// 回填的起始区块之前的区块不计入，它们不能代替缺失的区块
+	stored := int64(0)
+	for _, bloom := range blooms {
+		if bloom.BlockNumber >= first {
+			stored++
+		}
+	}
+	if missing := to - first + 1 - stored; missing > 0 {
+		logger.Debug("Skip bloombits section with missing blocks", "chainId", s.chain.ChainID, "section", section, "missing", missing)
+		return false, nil
+	}
+
+	gen, err := bloombits.NewGenerator(dbdrive.BloomBitsSectionSize)
+	if err != nil {
+		return false, err
+	}
+	next := from
+	for _, bloom := range blooms {
+		for ; next < bloom.BlockNumber; next++ {
+			if err := gen.AddBloom(uint(next-from), ethtypes.Bloom{}); err != nil {
+				return false, err
+			}
+		}
+		data, err := hexutil.Decode(bloom.Bloom)
+		if err != nil {
+			return false, errors.Wrapf(err, "decode bloom of block %d", bloom.BlockNumber)
+		}
+		if err := gen.AddBloom(uint(next-from), ethtypes.BytesToBloom(data)); err != nil {
+			return false, err
+		}
+		next++
+	}
+
+	bits := make([][]byte, ethtypes.BloomBitLength)
+	for i := range bits {
+		vector, err := gen.Bitset(uint(i))
+		if err != nil {
+			return false, err
+		}
+		bits[i] = bitutil.CompressBytes(vector)
+	}
+	return true, s.store.SaveBloomBits(section, bits)
+}
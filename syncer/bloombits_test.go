@@ -0,0 +1,56 @@
+package syncer
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"testing"
+)
+
+func TestIndexSectionGaps(t *testing.T) {
+	const startBlock = 100
+	tests := []struct {
+		name     string
+		preStart []int64 // stored blocks below the start block
+		missing  []int64 // blocks of the section from the start block that are not stored
+		want     bool
+	}{
+		{name: "complete", want: true},
+		{name: "complete with pre-start blocks", preStart: []int64{10, 20}, want: true},
+		{name: "gap", missing: []int64{startBlock + 5}},
+		{name: "gap covered by pre-start blocks", preStart: []int64{10, 20}, missing: []int64{startBlock + 5, 4000}},
+		{name: "last block missing", preStart: []int64{10}, missing: []int64{dbdrive.BloomBitsSectionSize - 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newMemStore()
+			s := newTestService(t, newFakeChain(0), store)
+			s.startBlock = startBlock
+
+			missing := make(map[int64]bool)
+			for _, number := range test.missing {
+				missing[number] = true
+			}
+			blocks := append([]int64(nil), test.preStart...)
+			for number := int64(startBlock); number < dbdrive.BloomBitsSectionSize; number++ {
+				if !missing[number] {
+					blocks = append(blocks, number)
+				}
+			}
+			var blooms []dbdrive.BlockBloom
+			for _, number := range blocks {
+				blooms = append(blooms, dbdrive.BlockBloom{BlockNumber: number, Bloom: emptyBloom()})
+			}
+			if err := store.SaveBlocks(blooms, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			indexed, err := s.indexSection(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sections, _ := store.GetBloomBitsSections(0, 0)
+			if indexed != test.want || len(sections) == 1 != test.want {
+				t.Errorf("got indexed %v with sections %v, want %v", indexed, sections, test.want)
+			}
+		})
+	}
+}
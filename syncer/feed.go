@@ -0,0 +1,69 @@
+package syncer
+
+import (
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+// ErrSubscriptionDropped is delivered on Err of a subscription whose buffer was full
+var ErrSubscriptionDropped = errors.New("subscriber too slow, subscription dropped")
+
+// feed delivers events to the subscribers without ever blocking the sender. A subscriber
+// whose buffer is full is dropped, so a slow consumer can not stall the ingestion.
+type feed struct {
+	mu   sync.Mutex
+	subs map[*feedSub]struct{}
+}
+
+// feedSub is a subscription of a feed, send delivers an event to the channel of the
+// subscriber without blocking and reports whether it was delivered
+type feedSub struct {
+	feed *feed
+	send func(v interface{}) bool
+	err  chan error
+	once sync.Once
+}
+
+func (f *feed) subscribe(send func(v interface{}) bool) event.Subscription {
+	sub := &feedSub{feed: f, send: send, err: make(chan error, 1)}
+	f.mu.Lock()
+	if f.subs == nil {
+		f.subs = make(map[*feedSub]struct{})
+	}
+	f.subs[sub] = struct{}{}
+	f.mu.Unlock()
+	return sub
+}
+
+// send delivers the event to every subscriber and drops the ones that are full
+func (f *feed) send(v interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subs {
+		if !sub.send(v) {
+			delete(f.subs, sub)
+			sub.close(ErrSubscriptionDropped)
+		}
+	}
+}
+
+func (s *feedSub) Unsubscribe() {
+	s.feed.mu.Lock()
+	delete(s.feed.subs, s)
+	s.feed.mu.Unlock()
+	s.close(nil)
+}
+
+func (s *feedSub) Err() <-chan error {
+	return s.err
+}
+
+func (s *feedSub) close(err error) {
+	s.once.Do(func() {
+		if err != nil {
+			s.err <- err
+		}
+		close(s.err)
+	})
+}
@@ -0,0 +1,138 @@
+package syncer
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"blockchain-event-plugin/metrics"
+	"blockchain-event-plugin/types"
+	"context"
+	"fmt"
+	"time"
+)
+
+// SyncStatus is the ingestion progress of the sync service
+type SyncStatus struct {
+	UpstreamHead  int64     // head of the upstream node when it was last polled
+	UpstreamTime  time.Time // when the upstream head was last polled
+	IndexedHead   int64     // last block stored by the service
+	IndexedTime   time.Time // timestamp of IndexedHead, zero until known
+	LastError     string    // last ingestion error
+	LastErrorTime time.Time
+}
+
+// Lag returns how many blocks and seconds IndexedHead is behind UpstreamHead,
+// seconds is -1 while the timestamp of IndexedHead is unknown
+func (st SyncStatus) Lag() (blocks, seconds int64) {
+	if st.UpstreamHead > st.IndexedHead {
+		blocks = st.UpstreamHead - st.IndexedHead
+	}
+	switch {
+	case st.IndexedTime.IsZero():
+		seconds = -1
+	case blocks > 0:
+		if seconds = int64(time.Since(st.IndexedTime) / time.Second); seconds < 0 {
+			seconds = 0
+		}
+	}
+	return blocks, seconds
+}
+
+// Status returns the ingestion progress recorded by the sync loop
+func (s *Service) Status() SyncStatus {
+	s.statusMu.RLock()
+	defer s.statusMu.RUnlock()
+	return s.status
+}
+
+// Ping checks that the upstream node is reachable
+func (s *Service) Ping(ctx context.Context) error {
+	_, err := s.client.BlockNumber(ctx)
+	return err
+}
+
+func (s *Service) setUpstreamHead(head int64) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.status.UpstreamHead, s.status.UpstreamTime = head, time.Now()
+}
+
+func (s *Service) setIndexed(block *types.Block) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.status.IndexedHead = int64(block.Number)
+	s.status.IndexedTime = time.Unix(int64(block.Timestamp), 0)
+}
+
+// resetIndexed records the ancestor a reorg rolled back to, its timestamp is unknown
+func (s *Service) resetIndexed(ancestor int64) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.status.IndexedHead, s.status.IndexedTime = ancestor, time.Time{}
+}
+
+func (s *Service) setError(err error) {
+	metrics.GetOrRegisterCounter(s.metricName("sync", "errors")).Inc(1)
+
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.status.LastError, s.status.LastErrorTime = err.Error(), time.Now()
+}
+
+// initIndexedTime fetches the timestamp of the stored head once when the service
+// starts caught up, so that the lag is known before a new block is stored
+func (s *Service) initIndexedTime(height int64) {
+	s.statusMu.RLock()
+	known := s.status.IndexedHead == height && !s.status.IndexedTime.IsZero()
+	s.statusMu.RUnlock()
+	if known || height <= 0 {
+		return
+	}
+	block, _, err := s.fetchBlock(height)
+	if err != nil {
+		return
+	}
+	s.setIndexed(block)
+}
+
+// metricName 返回链的指标名称，如sync/chain1/head/indexed
+func (s *Service) metricName(group, name string) string {
+	return fmt.Sprintf("%s/chain%d/%s", group, s.chain.ChainID, name)
+}
+
+// registerMetrics 注册同步高度、落后程度和回填进度的指标，在导出时读取
+func (s *Service) registerMetrics() {
+	metrics.NewFunctionalGauge(s.metricName("sync", "head/indexed"), func() int64 {
+		return s.Status().IndexedHead
+	})
+	metrics.NewFunctionalGauge(s.metricName("sync", "head/upstream"), func() int64 {
+		return s.Status().UpstreamHead
+	})
+	metrics.NewFunctionalGauge(s.metricName("sync", "lag/blocks"), func() int64 {
+		blocks, _ := s.Status().Lag()
+		return blocks
+	})
+	metrics.NewFunctionalGauge(s.metricName("sync", "lag/seconds"), func() int64 {
+		_, seconds := s.Status().Lag()
+		return seconds
+	})
+	metrics.NewFunctionalGauge(s.metricName("backfill", "jobs/running"), func() int64 {
+		running, _ := s.backfillProgress()
+		return running
+	})
+	metrics.NewFunctionalGauge(s.metricName("backfill", "chunks/pending"), func() int64 {
+		_, pending := s.backfillProgress()
+		return pending
+	})
+}
+
+// backfillProgress returns the number of running backfill jobs and of their pending chunks
+func (s *Service) backfillProgress() (running, pending int64) {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	for _, j := range s.jobs {
+		if status := j.status(); status.Status == dbdrive.BackfillRunning {
+			running++
+			pending += int64(status.Chunks - status.Completed)
+		}
+	}
+	return running, pending
+}
@@ -0,0 +1,506 @@
+package syncer
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"blockchain-event-plugin/logger"
+	"blockchain-event-plugin/metrics"
+	"blockchain-event-plugin/setting"
+	"blockchain-event-plugin/types"
+	"context"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pkg/errors"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPollInterval = 3 * time.Second
+	requestTimeout      = 30 * time.Second
+
+	// maxReorgDepth is the number of blocks walked back looking for the common ancestor
+	maxReorgDepth = 1024
+)
+
+var (
+	// errBlockNotFound is returned when the upstream node does not know the requested block yet.
+	errBlockNotFound = errors.New("block not found")
+	// errReorgTooDeep is returned when no common ancestor is found within maxReorgDepth blocks,
+	// the sync loop stops since the stored chain can not be repaired by a rollback.
+	errReorgTooDeep = errors.New("reorg deeper than the limit")
+)
+
+// ChainEvent is posted after a block and its logs have been stored.
+type ChainEvent struct {
+	Block  types.Block
+	Header json.RawMessage // header fields of the block as returned by the upstream node
+	Logs   []dbdrive.Logs
+}
+
+// RemovedLogsEvent is posted when a chain reorganization drops the stored blocks above Ancestor.
+type RemovedLogsEvent struct {
+	Ancestor int64
+	Logs     []dbdrive.Logs
+}
+
+// SyncEvent is either a ChainEvent or a RemovedLogsEvent, exactly one of them is set
+type SyncEvent struct {
+	Chain   *ChainEvent
+	Removed *RemovedLogsEvent
+}
+
+// Service tails the head of the upstream node and persists the block bloom
+// and logs of every block, resuming from the highest stored block.
+type Service struct {
+	store        dbdrive.Store
+	rpcClient    *rpc.Client
+	client       *ethclient.Client
+	chain        Chain
+	startBlock   int64
+	pollInterval time.Duration
+	watchList    *WatchList
+	backfills    []dbdrive.Watch // configured contracts to backfill on start
+
+	chainIDMu sync.Mutex
+	chainID   *big.Int
+
+	jobsMu sync.Mutex
+	jobs   map[int64]*backfillJob // running backfill jobs, removed once finished
+
+	statusMu sync.RWMutex
+	status   SyncStatus
+
+	events feed // ChainEvent and RemovedLogsEvent in the order they happened
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Chain is a chain synced by the plugin, its data is stored under ChainID.
+type Chain struct {
+	ChainID    int64           `mapstructure:"chain_id"`
+	RPCAddr    string          `mapstructure:"rpc_addr"`
+	StartBlock int64           `mapstructure:"start_block"`
+	Watch      []dbdrive.Watch `mapstructure:"watch"`
+}
+
+// RPCAddr 获取上游节点的RPC地址
+func RPCAddr() string {
+	url := setting.GetString("sync.rpc_addr")
+	if url == "" {
+		url = os.Getenv("SyncRpcAddr")
+		logger.Info("Command line get SyncRpcAddr:", url)
+	}
+	return url
+}
+
+// Chains 获取配置的链，未配置chains时使用sync和watch配置的单链，数据存储在chain 0下
+func Chains() ([]Chain, error) {
+	var chains []Chain
+	if err := setting.UnmarshalKey("chains", &chains); err != nil {
+		return nil, errors.Wrap(err, "parse chains")
+	}
+	if len(chains) == 0 {
+		var watch []dbdrive.Watch
+		if err := setting.UnmarshalKey("watch.contracts", &watch); err != nil {
+			return nil, errors.Wrap(err, "parse watch.contracts")
+		}
+		return []Chain{{
+			RPCAddr:    RPCAddr(),
+			StartBlock: int64(setting.GetInt("sync.start_block")),
+			Watch:      watch,
+		}}, nil
+	}
+
+	seen := make(map[int64]bool)
+	for _, chain := range chains {
+		if chain.ChainID <= 0 {
+			return nil, errors.Errorf("invalid chain id %d", chain.ChainID)
+		}
+		if seen[chain.ChainID] {
+			return nil, errors.Errorf("duplicate chain id %d", chain.ChainID)
+		}
+		seen[chain.ChainID] = true
+	}
+	return chains, nil
+}
+
+// New 创建链的同步服务，store为该链的存储
+func New(chain Chain, store dbdrive.Store) (*Service, error) {
+	if chain.RPCAddr == "" {
+		return nil, errors.New("sync rpc address is empty")
+	}
+	rpcClient, err := rpc.Dial(chain.RPCAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial upstream node")
+	}
+
+	pollInterval := time.Duration(setting.GetInt("sync.poll_interval")) * time.Millisecond
+	if pollInterval <= 0 {
+		pollInterval = DefaultPollInterval
+	}
+
+	s := &Service{
+		store:        store,
+		rpcClient:    rpcClient,
+		client:       ethclient.NewClient(rpcClient),
+		chain:        chain,
+		startBlock:   chain.StartBlock,
+		pollInterval: pollInterval,
+		watchList:    newWatchList(),
+		jobs:         make(map[int64]*backfillJob),
+		quit:         make(chan struct{}),
+	}
+	if s.backfills, err = s.loadWatchList(); err != nil {
+		rpcClient.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Start 启动后台同步
+func (s *Service) Start() {
+	s.registerMetrics()
+
+	s.wg.Add(2)
+	go s.loop()
+	go s.indexLoop()
+
+	if err := s.resumeBackfills(); err != nil {
+		logger.Error("Resume backfill jobs error", "chainId", s.chain.ChainID, "err", err)
+	}
+
+	for _, watch := range s.backfills {
+		if err := s.backfillWatch(watch, s.startBlock); err != nil {
+			logger.Error("Backfill contract error", "chainId", s.chain.ChainID, "address", watch.Address, "err", err)
+		}
+	}
+	s.backfills = nil
+}
+
+// Stop 停止后台同步，等待当前区块处理完成
+func (s *Service) Stop() {
+	close(s.quit)
+	s.wg.Wait()
+	s.rpcClient.Close()
+}
+
+// ChainID returns the configured chain id, or for a single-chain deployment the
+// chain id of the upstream node, which is fetched once and cached.
+func (s *Service) ChainID() (*big.Int, error) {
+	if s.chain.ChainID != 0 {
+		return big.NewInt(s.chain.ChainID), nil
+	}
+	s.chainIDMu.Lock()
+	defer s.chainIDMu.Unlock()
+
+	if s.chainID == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		chainID, err := s.client.ChainID(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "get upstream chain id")
+		}
+		s.chainID = chainID
+	}
+	return new(big.Int).Set(s.chainID), nil
+}
+
+// SubscribeChainEvent registers a subscription of ChainEvent. The channel must be buffered,
+// the subscription is dropped with ErrSubscriptionDropped when it is full.
+func (s *Service) SubscribeChainEvent(ch chan<- ChainEvent) event.Subscription {
+	return s.events.subscribe(func(v interface{}) bool {
+		ev, ok := v.(ChainEvent)
+		if !ok {
+			return true
+		}
+		select {
+		case ch <- ev:
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+// SubscribeRemovedLogsEvent registers a subscription of RemovedLogsEvent. The channel must be
+// buffered, the subscription is dropped with ErrSubscriptionDropped when it is full.
+func (s *Service) SubscribeRemovedLogsEvent(ch chan<- RemovedLogsEvent) event.Subscription {
+	return s.events.subscribe(func(v interface{}) bool {
+		ev, ok := v.(RemovedLogsEvent)
+		if !ok {
+			return true
+		}
+		select {
+		case ch <- ev:
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+// SubscribeSyncEvent registers a subscription of both events in the order they happened, the
+// logs removed by a rollback are delivered before the blocks stored after it. The channel must
+// be buffered, the subscription is dropped with ErrSubscriptionDropped when it is full.
+func (s *Service) SubscribeSyncEvent(ch chan<- SyncEvent) event.Subscription {
+	return s.events.subscribe(func(v interface{}) bool {
+		var ev SyncEvent
+		switch v := v.(type) {
+		case ChainEvent:
+			ev.Chain = &v
+		case RemovedLogsEvent:
+			ev.Removed = &v
+		}
+		select {
+		case ch <- ev:
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+// loop follows the upstream head until the service is stopped.
+func (s *Service) loop() {
+	defer s.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-timer.C:
+		}
+
+		if err := s.syncToHead(); err != nil {
+			logger.Error("Sync to head error", "chainId", s.chain.ChainID, "err", err)
+			s.setError(err)
+			// 超过深度限制的重组需要人工处理，停止同步避免反复回滚
+			if errors.Is(err, errReorgTooDeep) {
+				logger.Error("Sync stopped", "chainId", s.chain.ChainID)
+				return
+			}
+		}
+		timer.Reset(s.pollInterval)
+	}
+}
+
+// syncToHead persists every block between the last stored height and the upstream head.
+func (s *Service) syncToHead() error {
+	height, err := s.store.GetBlockHeight()
+	if err != nil {
+		return errors.Wrap(err, "get stored block height")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	head, err := s.client.BlockNumber(ctx)
+	cancel()
+	if err != nil {
+		return errors.Wrap(err, "get upstream block number")
+	}
+	s.setUpstreamHead(int64(head))
+
+	// 重组到不高于已存储高度的链时不会获取新区块，每次轮询检查已存储的最高区块
+	if height, err = s.checkHead(height, int64(head)); err != nil {
+		return err
+	}
+	next := height + 1
+	if next < s.startBlock {
+		next = s.startBlock
+	}
+	if next > int64(head) {
+		s.initIndexedTime(height)
+	}
+
+	for number := next; number <= int64(head); number++ {
+		select {
+		case <-s.quit:
+			return nil
+		default:
+		}
+		block, raw, err := s.fetchBlock(number)
+		if err != nil {
+			return errors.Wrapf(err, "fetch block %d", number)
+		}
+
+		// 检测链重组，回滚到公共祖先后从祖先的下一个区块继续同步
+		ancestor, reorged, err := s.findAncestor(block)
+		if err != nil {
+			return errors.Wrapf(err, "find ancestor of block %d", number)
+		}
+		if reorged {
+			if err := s.rollback(ancestor); err != nil {
+				return err
+			}
+			number = ancestor
+			continue
+		}
+
+		if err := s.syncBlock(block, raw); err != nil {
+			return errors.Wrapf(err, "sync block %d", number)
+		}
+	}
+	return nil
+}
+
+// checkHead compares the stored block at the stored height, or at the upstream head when it is
+// lower, with the canonical block and rolls back to their common ancestor when they differ.
+// It returns the stored height after the rollback.
+func (s *Service) checkHead(height, head int64) (int64, error) {
+	number := height
+	if head < number {
+		number = head
+	}
+	if number <= 0 || number < s.startBlock {
+		return height, nil
+	}
+	stored, err := s.store.GetBlockHashByBlockNumber(number)
+	if errors.Is(err, dbdrive.ErrNotFound) {
+		return height, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "get stored block hash")
+	}
+	block, _, err := s.fetchBlock(number)
+	if err != nil {
+		return 0, errors.Wrapf(err, "fetch block %d", number)
+	}
+	if strings.EqualFold(stored, block.Hash) {
+		return height, nil
+	}
+
+	ancestor, _, err := s.findAncestor(block)
+	if err != nil {
+		return 0, errors.Wrapf(err, "find ancestor of block %d", number)
+	}
+	if err := s.rollback(ancestor); err != nil {
+		return 0, err
+	}
+	return ancestor, nil
+}
+
+// findAncestor checks that the parent of block matches the stored chain. If it does
+// not, the canonical chain is walked back until a stored block hash matches, and the
+// height of that common ancestor is returned with reorged set to true. errReorgTooDeep
+// is returned when no ancestor is found within maxReorgDepth blocks.
+func (s *Service) findAncestor(block *types.Block) (ancestor int64, reorged bool, err error) {
+	number := int64(block.Number)
+	parentHash := block.ParentHash
+	for n := number - 1; n > 0; n-- {
+		stored, err := s.store.GetBlockHashByBlockNumber(n)
+		if err != nil && !errors.Is(err, dbdrive.ErrNotFound) {
+			return 0, false, errors.Wrap(err, "get stored block hash")
+		}
+		// 未存储的高度视为公共祖先
+		if err != nil || strings.EqualFold(stored, parentHash) {
+			return n, n != number-1, nil
+		}
+		if number-n >= maxReorgDepth {
+			return 0, false, errors.Wrapf(errReorgTooDeep, "no common ancestor within %d blocks of block %d", maxReorgDepth, number)
+		}
+
+		canonical, _, err := s.fetchBlock(n)
+		if err != nil {
+			return 0, false, errors.Wrapf(err, "fetch block %d", n)
+		}
+		parentHash = canonical.ParentHash
+	}
+	return 0, number > 1, nil
+}
+
+// rollback drops the stored blocks above ancestor and marks their logs as removed.
+func (s *Service) rollback(ancestor int64) error {
+	removed, err := s.store.RollbackBlocks(ancestor)
+	if err != nil {
+		return errors.Wrapf(err, "rollback to block %d", ancestor)
+	}
+	s.resetIndexed(ancestor)
+	metrics.GetOrRegisterCounter(s.metricName("sync", "reorgs")).Inc(1)
+	logger.Warn("Chain reorganization detected", "ancestor", ancestor, "removedLogs", len(removed))
+	s.events.send(RemovedLogsEvent{Ancestor: ancestor, Logs: removed})
+	return nil
+}
+
+// syncBlock fetches the logs of a single block from the upstream node and stores
+// them with the bloom of the block.
+func (s *Service) syncBlock(block *types.Block, raw json.RawMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	blockHash := common.HexToHash(block.Hash)
+	ethlogs, err := s.client.FilterLogs(ctx, s.watchList.Query(ethereum.FilterQuery{BlockHash: &blockHash}))
+	if err != nil {
+		return errors.Wrap(err, "filter logs")
+	}
+	ethlogs = s.watchList.Filter(ethlogs)
+
+	if err := s.store.SaveBlocks([]dbdrive.BlockBloom{blockBloom(block)}, ethlogs); err != nil {
+		return errors.Wrap(err, "save block")
+	}
+
+	s.setIndexed(block)
+	logger.Debug("Sync block successful", "number", uint64(block.Number), "hash", block.Hash, "logs", len(ethlogs))
+
+	s.events.send(ChainEvent{Block: *block, Header: headerJSON(raw), Logs: dbdrive.ToLogs(ethlogs)})
+	return nil
+}
+
+// headerJSON strips the transactions and uncles from a block returned by eth_getBlockByNumber.
+func headerJSON(raw json.RawMessage) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return raw
+	}
+	delete(fields, "transactions")
+	delete(fields, "uncles")
+	header, err := json.Marshal(fields)
+	if err != nil {
+		return raw
+	}
+	return header
+}
+
+// blockBloom 区块存储的bloom和区块头字段
+func blockBloom(block *types.Block) dbdrive.BlockBloom {
+	return dbdrive.BlockBloom{
+		BlockNumber: int64(block.Number),
+		BlockHash:   block.Hash,
+		Bloom:       block.LogsBloom,
+		ParentHash:  block.ParentHash,
+		Timestamp:   uint64(block.Timestamp),
+		GasLimit:    uint64(block.GasLimit),
+		GasUsed:     uint64(block.GasUsed),
+		Miner:       block.Miner,
+		ExtraData:   block.ExtraData,
+	}
+}
+
+// fetchBlock 链上获取指定高度的区块信息
+func (s *Service) fetchBlock(number int64) (*types.Block, json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	var raw json.RawMessage
+	if err := s.rpcClient.CallContext(ctx, &raw, "eth_getBlockByNumber", hexutil.EncodeBig(big.NewInt(number)), false); err != nil {
+		return nil, nil, errors.Wrap(err, "get block by number")
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil, errBlockNotFound
+	}
+
+	var block types.Block
+	if err := json.Unmarshal(raw, &block); err != nil {
+		return nil, nil, errors.Wrap(err, "decode block")
+	}
+	return &block, raw, nil
+}
@@ -0,0 +1,132 @@
+package syncer
+
+import (
+	"github.com/pkg/errors"
+	"reflect"
+	"testing"
+)
+
+func TestSyncReorg(t *testing.T) {
+	tests := []struct {
+		name         string
+		head         int64 // blocks synced before the reorg
+		ancestor     int64 // last block kept by the reorg
+		newBlocks    int   // blocks of the new fork above ancestor
+		wantHeight   int64
+		wantAncestor int64 // ancestor of the removed logs event, -1 if none
+		wantErr      error
+	}{
+		{name: "no reorg", head: 10, ancestor: 10, newBlocks: 3, wantHeight: 13, wantAncestor: -1},
+		{name: "longer fork", head: 10, ancestor: 7, newBlocks: 5, wantHeight: 12, wantAncestor: 7},
+		{name: "same height fork", head: 10, ancestor: 7, newBlocks: 3, wantHeight: 10, wantAncestor: 7},
+		{name: "shorter fork", head: 10, ancestor: 7, newBlocks: 1, wantHeight: 8, wantAncestor: 7},
+		{name: "head replaced", head: 10, ancestor: 9, newBlocks: 1, wantHeight: 10, wantAncestor: 9},
+		{name: "deeper than limit", head: maxReorgDepth + 20, ancestor: 10, newBlocks: maxReorgDepth + 10,
+			wantHeight: maxReorgDepth + 20, wantAncestor: -1, wantErr: errReorgTooDeep},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain, store := newFakeChain(int(test.head)), newMemStore()
+			s := newTestService(t, chain, store)
+			if err := s.syncToHead(); err != nil {
+				t.Fatal(err)
+			}
+			checkStored(t, store, chain, 1, test.head)
+
+			removedCh := make(chan RemovedLogsEvent, 1)
+			sub := s.SubscribeRemovedLogsEvent(removedCh)
+			defer sub.Unsubscribe()
+			orphaned := make(map[int64]string)
+			for number := test.ancestor + 1; number <= test.head; number++ {
+				orphaned[number] = chain.block(number).Hash
+			}
+
+			chain.reorg(test.ancestor, test.newBlocks)
+			if err := s.syncToHead(); !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr != nil {
+				if height, _ := store.GetBlockHeight(); height != test.wantHeight || len(store.removedLogs()) != 0 {
+					t.Fatalf("stored height %d with %d removed logs after the error", height, len(store.removedLogs()))
+				}
+				return
+			}
+			checkStored(t, store, chain, 1, test.wantHeight)
+
+			// 被回滚区块的logs标记为removed并按回滚通知
+			var wantRemoved []int64
+			for number := test.ancestor + 1; number <= test.head && test.wantAncestor >= 0; number++ {
+				wantRemoved = append(wantRemoved, number)
+			}
+			if got := store.removedLogs(); !reflect.DeepEqual(got, wantRemoved) {
+				t.Errorf("removed logs of blocks %v, want %v", got, wantRemoved)
+			}
+			select {
+			case ev := <-removedCh:
+				if ev.Ancestor != test.wantAncestor || len(ev.Logs) != len(wantRemoved) {
+					t.Errorf("got removed logs event at %d with %d logs, want %d with %d", ev.Ancestor, len(ev.Logs), test.wantAncestor, len(wantRemoved))
+				}
+				for _, log := range ev.Logs {
+					if !log.Removed || orphaned[logNumber(log)] != log.BlockHash {
+						t.Errorf("removed log %+v is not of an orphaned block", log)
+					}
+				}
+			default:
+				if test.wantAncestor >= 0 {
+					t.Error("no removed logs event")
+				}
+			}
+		})
+	}
+}
+
+func TestFindAncestor(t *testing.T) {
+	chain, store := newFakeChain(20), newMemStore()
+	s := newTestService(t, chain, store)
+	if err := s.syncToHead(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 父区块与存储一致时不回滚
+	chain.extend(1)
+	ancestor, reorged, err := s.findAncestor(chain.block(21))
+	if err != nil || reorged || ancestor != 20 {
+		t.Errorf("extended chain: got ancestor %d, reorged %v, error %v", ancestor, reorged, err)
+	}
+
+	chain.reorg(12, 9)
+	ancestor, reorged, err = s.findAncestor(chain.block(21))
+	if err != nil || !reorged || ancestor != 12 {
+		t.Errorf("fork at 12: got ancestor %d, reorged %v, error %v", ancestor, reorged, err)
+	}
+}
+
+func TestSyncEventOrder(t *testing.T) {
+	chain, store := newFakeChain(10), newMemStore()
+	s := newTestService(t, chain, store)
+	if err := s.syncToHead(); err != nil {
+		t.Fatal(err)
+	}
+
+	eventCh := make(chan SyncEvent, 16)
+	sub := s.SubscribeSyncEvent(eventCh)
+	defer sub.Unsubscribe()
+	chain.reorg(8, 4)
+	if err := s.syncToHead(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 先推送回滚的logs，再按顺序推送新链的区块
+	var got []int64
+	for len(eventCh) > 0 {
+		ev := <-eventCh
+		if ev.Removed != nil {
+			got = append(got, -ev.Removed.Ancestor)
+		} else {
+			got = append(got, int64(ev.Chain.Block.Number))
+		}
+	}
+	if want := []int64{-8, 9, 10, 11, 12}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %v, want %v (negative for the ancestor of a rollback)", got, want)
+	}
+}
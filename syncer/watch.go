@@ -0,0 +1,216 @@
+package syncer
+
+import (
+	"blockchain-event-plugin/dbdrive"
+	"blockchain-event-plugin/logger"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// WatchList is the set of watched contracts with their optional topic0 filters.
+// An empty WatchList matches every log.
+type WatchList struct {
+	mu      sync.RWMutex
+	entries map[common.Address][]common.Hash
+}
+
+func newWatchList() *WatchList {
+	return &WatchList{entries: make(map[common.Address][]common.Hash)}
+}
+
+// Query restricts the query to the watched contracts. Since the topic0 filters
+// are per contract, they are only pushed upstream when every contract has one,
+// the logs must still be passed through Filter.
+func (w *WatchList) Query(query ethereum.FilterQuery) ethereum.FilterQuery {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if len(w.entries) == 0 {
+		return query
+	}
+	var topic0s []common.Hash
+	allTopics := true
+	for address, topics := range w.entries {
+		query.Addresses = append(query.Addresses, address)
+		if len(topics) == 0 {
+			allTopics = false
+		}
+		topic0s = append(topic0s, topics...)
+	}
+	if allTopics {
+		query.Topics = [][]common.Hash{topic0s}
+	}
+	return query
+}
+
+// Filter returns the logs matching the watch list
+func (w *WatchList) Filter(logs []ethtypes.Log) []ethtypes.Log {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if len(w.entries) == 0 {
+		return logs
+	}
+	var ret []ethtypes.Log
+	for _, log := range logs {
+		topics, ok := w.entries[log.Address]
+		if !ok {
+			continue
+		}
+		if len(topics) > 0 && (len(log.Topics) == 0 || !includes(topics, log.Topics[0])) {
+			continue
+		}
+		ret = append(ret, log)
+	}
+	return ret
+}
+
+// List returns the watched contracts ordered by address
+func (w *WatchList) List() []dbdrive.Watch {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	watches := make([]dbdrive.Watch, 0, len(w.entries))
+	for address, topics := range w.entries {
+		watches = append(watches, toWatch(address, topics))
+	}
+	sort.Slice(watches, func(i, j int) bool { return watches[i].Address < watches[j].Address })
+	return watches
+}
+
+func (w *WatchList) set(address common.Address, topics []common.Hash) (isNew, wasEmpty bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, exists := w.entries[address]
+	wasEmpty = len(w.entries) == 0
+	w.entries[address] = topics
+	return !exists, wasEmpty
+}
+
+func (w *WatchList) remove(address common.Address) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.entries, address)
+}
+
+func includes(hashes []common.Hash, hash common.Hash) bool {
+	for _, h := range hashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func toWatch(address common.Address, topics []common.Hash) dbdrive.Watch {
+	watch := dbdrive.Watch{Address: strings.ToLower(address.String())}
+	for _, topic := range topics {
+		watch.Topics = append(watch.Topics, topic.String())
+	}
+	return watch
+}
+
+// fromWatch validates a stored or configured watch entry
+func fromWatch(watch dbdrive.Watch) (common.Address, []common.Hash, error) {
+	if !common.IsHexAddress(watch.Address) {
+		return common.Address{}, nil, errors.Errorf("invalid watch address %q", watch.Address)
+	}
+	var topics []common.Hash
+	for _, topic := range watch.Topics {
+		if len(strings.TrimPrefix(topic, "0x")) != 2*common.HashLength {
+			return common.Address{}, nil, errors.Errorf("invalid watch topic %q", topic)
+		}
+		topics = append(topics, common.HexToHash(topic))
+	}
+	return common.HexToAddress(watch.Address), topics, nil
+}
+
+// WatchList returns the watch list applied to the ingestion
+func (s *Service) WatchList() *WatchList {
+	return s.watchList
+}
+
+// loadWatchList loads the persisted watch list and adds the contracts configured for
+// the chain. The configured contracts that are new are returned to be backfilled.
+func (s *Service) loadWatchList() ([]dbdrive.Watch, error) {
+	stored, err := s.store.GetWatchList()
+	if err != nil {
+		return nil, errors.Wrap(err, "get watch list")
+	}
+	for _, watch := range stored {
+		address, topics, err := fromWatch(watch)
+		if err != nil {
+			return nil, err
+		}
+		s.watchList.set(address, topics)
+	}
+
+	// 监听列表原本为空时所有合约的logs都已存储，无需回填
+	var added []dbdrive.Watch
+	for _, watch := range s.chain.Watch {
+		address, topics, err := fromWatch(watch)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.store.SaveWatch(toWatch(address, topics)); err != nil {
+			return nil, errors.Wrap(err, "save watch")
+		}
+		if isNew, _ := s.watchList.set(address, topics); isNew && len(stored) > 0 {
+			added = append(added, toWatch(address, topics))
+		}
+	}
+	return added, nil
+}
+
+// AddWatch persists the contract in the watch list. A contract that was not watched
+// before is backfilled from fromBlock up to the stored height by a backfill job, unless
+// the watch list was empty, in which case all of its logs are already stored.
+func (s *Service) AddWatch(address common.Address, topics []common.Hash, fromBlock int64) error {
+	if err := s.store.SaveWatch(toWatch(address, topics)); err != nil {
+		return errors.Wrap(err, "save watch")
+	}
+	isNew, wasEmpty := s.watchList.set(address, topics)
+	logger.Info("Watch contract", "address", address, "topics", len(topics), "new", isNew)
+	if isNew && !wasEmpty {
+		return s.backfillWatch(toWatch(address, topics), fromBlock)
+	}
+	return nil
+}
+
+// RemoveWatch removes the contract from the watch list, its stored logs are kept
+func (s *Service) RemoveWatch(address common.Address) error {
+	if err := s.store.DeleteWatch(address.String()); err != nil {
+		return errors.Wrap(err, "delete watch")
+	}
+	s.watchList.remove(address)
+	logger.Info("Unwatch contract", "address", address)
+	return nil
+}
+
+// backfillWatch starts a backfill job storing the logs of the contract between fromBlock
+// and the stored height, nothing is backfilled when no block is stored in that range.
+func (s *Service) backfillWatch(watch dbdrive.Watch, fromBlock int64) error {
+	if fromBlock < s.startBlock {
+		fromBlock = s.startBlock
+	}
+	height, err := s.store.GetBlockHeight()
+	if err != nil {
+		return errors.Wrap(err, "get stored block height")
+	}
+	if fromBlock > height {
+		return nil
+	}
+	status, err := s.StartBackfill(fromBlock, height, &watch)
+	if err != nil {
+		return err
+	}
+	logger.Info("Backfill contract start", "chainId", s.chain.ChainID, "address", watch.Address, "job", status.ID,
+		"from", fromBlock, "to", height)
+	return nil
+}
@@ -4,5 +4,9 @@ var (
 	InvalidRequest = &Error{Code: -32600, Message: "Invalid Request"}
 	MethodNotFound = &Error{Code: -32601, Message: "Method not found"}
 	SystemError    = &Error{Code: -32603, Message: "Internal error"}
-	InvalidParams  = &Error{Code: -32000, Message: "Invalid params"}
+	InvalidParams  = &Error{Code: -32602, Message: "Invalid params"}
+
+	// 存储错误，参照EIP-1474
+	ResourceNotFound    = &Error{Code: -32001, Message: "Resource not found"}
+	ResourceUnavailable = &Error{Code: -32002, Message: "Resource unavailable"}
 )
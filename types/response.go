@@ -1,7 +1,5 @@
 package types
 
-var version = "2.0"
-
 func ErrorMsg(code int64, message, msgData string) *Error {
 	return &Error{
 		Code:    code,
@@ -10,17 +8,18 @@ func ErrorMsg(code int64, message, msgData string) *Error {
 	}
 }
 
-func Responses(id string, errmsg *Error, result interface{}) *Response {
-	if errmsg != nil {
-		return &Response{
-			ID:      id,
-			Version: version,
-			Error:   errmsg,
-		}
-	}
-	return &Response{
-		ID:      id,
-		Version: version,
-		Result:  result,
+// Error returns the message, an *Error returned by an RPC method is sent to the client with its code and data
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) ErrorCode() int64 {
+	return e.Code
+}
+
+func (e *Error) ErrorData() interface{} {
+	if e.Data == "" {
+		return nil
 	}
+	return e.Data
 }
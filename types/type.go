@@ -8,15 +8,14 @@ type Error struct {
 	Data    string `json:"data,omitempty"`
 }
 
-type Response struct {
-	ID      string      `json:"id"`
-	Version string      `json:"jsonrpc"`
-	Error   interface{} `json:"error,omitempty"`
-	Result  interface{} `json:"result,omitempty"`
-}
-
 type Block struct {
-	Number    hexutil.Uint64
-	Hash      string
-	LogsBloom string
+	Number     hexutil.Uint64 `json:"number"`
+	Hash       string         `json:"hash"`
+	ParentHash string         `json:"parentHash"`
+	LogsBloom  string         `json:"logsBloom"`
+	Timestamp  hexutil.Uint64 `json:"timestamp"`
+	GasLimit   hexutil.Uint64 `json:"gasLimit"`
+	GasUsed    hexutil.Uint64 `json:"gasUsed"`
+	Miner      string         `json:"miner"`
+	ExtraData  string         `json:"extraData"`
 }